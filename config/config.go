@@ -1,14 +1,87 @@
 package config
 
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
 type Default struct {
 	Server        ServerConfig
 	Bepaid        Bepaid
 	ExternalURL   string `env:"EXTERNAL_URL,required"`
 	Notifications Notifications
-	//JWTSecret string `env:"JWT_SECRET,required"`
-	DBPath string `env:"DB_PATH" envDefault:"./app.db"`
-	WebURL string `env:"WEB_URL" envDefault:"http://localhost:3000"`
-	PayPal PayPal
+	Auth          Auth
+	DBPath        string `env:"DB_PATH" envDefault:"./app.db"`
+	WebURL        string `env:"WEB_URL" envDefault:"http://localhost:3000"`
+	// AdminURL is where invitation and password reset links point to.
+	AdminURL   string `env:"ADMIN_URL" envDefault:"http://localhost:3000/admin"`
+	PayPal     PayPal
+	Production bool `env:"PRODUCTION" envDefault:"false"`
+}
+
+// Validate checks the settings the server can't start without.
+func (cfg Default) Validate() error {
+	if cfg.Production && cfg.Auth.JWTSecret == "" {
+		return errors.New("JWT_SECRET is required in production")
+	}
+
+	if cfg.Production && len(cfg.Auth.JWTSecret) < 32 {
+		return errors.New("JWT_SECRET must be at least 32 characters long")
+	}
+
+	if cfg.Auth.TokenLifetime <= 0 {
+		return errors.New("AUTH_TOKEN_LIFETIME must be positive")
+	}
+
+	if cfg.Notifications.Email.Host != "" && cfg.Notifications.Email.From == "" {
+		return errors.New("SMTP_FROM is required with SMTP_HOST")
+	}
+
+	if cfg.Auth.SessionLifetime < cfg.Auth.TokenLifetime {
+		return errors.New("AUTH_SESSION_LIFETIME can't be shorter than AUTH_TOKEN_LIFETIME")
+	}
+
+	switch strings.ToLower(cfg.Auth.CookieSameSite) {
+	case "default", "lax", "strict", "none":
+	default:
+		return errors.New("AUTH_COOKIE_SAMESITE must be one of default, lax, strict or none")
+	}
+
+	return nil
+}
+
+type Auth struct {
+	// JWTSecret signs the admin tokens. JWTPreviousSecret is only used to
+	// verify them, so that the secret can be rotated without signing
+	// everyone out: move the old secret there until its tokens expire.
+	JWTSecret         string `env:"JWT_SECRET"`
+	JWTPreviousSecret string `env:"JWT_PREVIOUS_SECRET"`
+	// TokenLifetime is how long an access token is valid. SessionLifetime
+	// is how long a session lasts without refreshing it.
+	TokenLifetime     time.Duration `env:"AUTH_TOKEN_LIFETIME" envDefault:"15m"`
+	SessionLifetime   time.Duration `env:"AUTH_SESSION_LIFETIME" envDefault:"720h"`
+	CookieName        string        `env:"AUTH_COOKIE_NAME" envDefault:"clan_cookie"`
+	RefreshCookieName string        `env:"AUTH_REFRESH_COOKIE_NAME" envDefault:"clan_refresh"`
+	CookieDomain      string        `env:"AUTH_COOKIE_DOMAIN"`
+	CookieSameSite    string        `env:"AUTH_COOKIE_SAMESITE" envDefault:"none"`
+	CookieSecure      bool          `env:"AUTH_COOKIE_SECURE" envDefault:"true"`
+	// TOTPIssuer is the name authenticator apps show for the admin accounts.
+	TOTPIssuer string `env:"AUTH_TOTP_ISSUER" envDefault:"Clan Platform"`
+}
+
+func (a Auth) SameSite() http.SameSite {
+	switch strings.ToLower(a.CookieSameSite) {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteDefaultMode
+	}
 }
 
 type ServerConfig struct {
@@ -17,20 +90,37 @@ type ServerConfig struct {
 }
 
 type PayPal struct {
-	ClientID     string `env:"PAYPAL_CLIENT_ID,required"`
-	ClientSecret string `env:"PAYPAL_CLIENT_SECRET,required"`
-	LiveMode     bool   `env:"PAYPAL_LIVE_MODE" envDefault:"false"`
+	ClientID     string   `env:"PAYPAL_CLIENT_ID,required"`
+	ClientSecret string   `env:"PAYPAL_CLIENT_SECRET,required"`
+	LiveMode     bool     `env:"PAYPAL_LIVE_MODE" envDefault:"false"`
+	WebhookID    string   `env:"PAYPAL_WEBHOOK_ID"`
+	ApiURL       string   `env:"PAYPAL_API_URL"`
+	Currencies   []string `env:"PAYPAL_CURRENCIES" envDefault:"USD"`
 }
 
 type Bepaid struct {
-	ShopID    string `env:"BEPAID_SHOP_ID,required"`
-	SecretKey string `env:"BEPAID_SECRET_KEY,required"`
-	ApiURL    string `env:"BEPAID_API_URL" envDefault:"https://checkout.bepaid.by"`
-	TestMode  bool   `env:"BEPAID_TEST_MODE" envDefault:"true"`
+	ShopID     string `env:"BEPAID_SHOP_ID,required"`
+	SecretKey  string `env:"BEPAID_SECRET_KEY,required"`
+	ApiURL     string `env:"BEPAID_API_URL" envDefault:"https://checkout.bepaid.by"`
+	GatewayURL string `env:"BEPAID_GATEWAY_URL" envDefault:"https://gateway.bepaid.by"`
+	TestMode   bool   `env:"BEPAID_TEST_MODE" envDefault:"true"`
+	// bePaid only accepts BYN for our shop
+	Currencies []string `env:"BEPAID_CURRENCIES" envDefault:"BYN"`
 }
 
 type Notifications struct {
 	Telegram Telegram
+	Email    Email
+}
+
+// Email is the SMTP server account messages are sent through. They are only
+// logged if Host is empty.
+type Email struct {
+	Host     string `env:"SMTP_HOST"`
+	Port     int    `env:"SMTP_PORT" envDefault:"587"`
+	Username string `env:"SMTP_USERNAME"`
+	Password string `env:"SMTP_PASSWORD"`
+	From     string `env:"SMTP_FROM"`
 }
 
 type Telegram struct {
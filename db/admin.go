@@ -4,6 +4,15 @@ import (
 	"time"
 )
 
+const (
+	RoleOwner       = "owner"
+	RoleManager     = "manager"
+	RoleFulfillment = "fulfillment"
+	RoleViewer      = "viewer"
+)
+
+var ValidRoles = []string{RoleOwner, RoleManager, RoleFulfillment, RoleViewer}
+
 type User struct {
 	ID        int64      `db:"id" json:"id"`
 	Email     string     `db:"email" json:"email"`
@@ -14,6 +23,9 @@ type User struct {
 	AvatarURL string     `db:"avatar_url" json:"avatar_url"`
 	Role      string     `db:"role" json:"role"`
 	Name      *string    `db:"name" json:"name"`
+	// TwoFactorEnabled tells if the user signs in with an authenticator app
+	// code after the password.
+	TwoFactorEnabled bool `db:"two_factor_enabled" json:"two_factor_enabled"`
 }
 
 func (s Storage) getUserByQuery(query string, args ...interface{}) (*User, error) {
@@ -23,11 +35,13 @@ func (s Storage) getUserByQuery(query string, args ...interface{}) (*User, error
 		&user.ID,
 		&user.Email,
 		&user.Name,
+		&user.Role,
 		&user.AvatarURL,
 		&user.Password,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 		&user.DeletedAt,
+		&user.TwoFactorEnabled,
 	)
 
 	if IsNoRowsError(err) {
@@ -41,7 +55,7 @@ func (s Storage) getUserByQuery(query string, args ...interface{}) (*User, error
 
 func (s Storage) GetUserByEmail(email string) (*User, error) {
 	query := `
-		SELECT id, email, name, avatar_url, password, created_at, updated_at, deleted_at
+		SELECT id, email, name, role, avatar_url, password, created_at, updated_at, deleted_at, totp_enabled_at IS NOT NULL
 		FROM users WHERE email = ?
 	`
 	return s.getUserByQuery(query, email)
@@ -49,37 +63,216 @@ func (s Storage) GetUserByEmail(email string) (*User, error) {
 
 func (s Storage) GetUserByID(id int64) (*User, error) {
 	query := `
-		SELECT id, email, name, avatar_url, password, created_at, updated_at, deleted_at
+		SELECT id, email, name, role, avatar_url, password, created_at, updated_at, deleted_at, totp_enabled_at IS NOT NULL
 		FROM users WHERE id = ?
 	`
 	return s.getUserByQuery(query, id)
 }
 
-func (s Storage) CreateUser(user User) (*User, error) {
+// UpdateUserRole changes the role of the user. The last owner can't be
+// demoted, ErrLastOwner is returned then.
+func (s Storage) UpdateUserRole(id int64, role string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE users SET role = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND deleted_at IS NULL`, role, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	var owners int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE role = ? AND deleted_at IS NULL`, RoleOwner).Scan(&owners); err != nil {
+		return err
+	}
+
+	if owners == 0 {
+		return ErrLastOwner
+	}
+
+	return tx.Commit()
+}
+
+// UpdateUserPassword sets the password hash of the user and ends the user's
+// other sessions.
+func (s Storage) UpdateUserPassword(id int64, password string, sessionID int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE users SET password = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND deleted_at IS NULL`, password, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	if err := revokeUserSessions(tx, id, sessionID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CreatePasswordReset stores a password reset token valid for ttl for the
+// active user with the email, and returns the user. Earlier tokens of the
+// user stop working.
+func (s Storage) CreatePasswordReset(email, tokenHash string, ttl time.Duration) (*User, error) {
+	user, err := s.GetUserByEmail(email)
+	if err != nil {
+		return nil, err
+	} else if user.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM password_resets WHERE user_id = ? AND used_at IS NULL`, user.ID); err != nil {
+		return nil, err
+	}
+
 	query := `
-		INSERT INTO users (email, name, avatar_url, password, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?)
+		INSERT INTO password_resets (user_id, token_hash, expires_at)
+		VALUES (?, ?, datetime('now', ?))
 	`
 
-	res, err := s.db.Exec(query, user.Email, user.Name, user.AvatarURL, user.Password, user.CreatedAt, user.UpdatedAt)
+	if _, err := tx.Exec(query, user.ID, tokenHash, ttlModifier(ttl)); err != nil {
+		return nil, err
+	}
+
+	return user, tx.Commit()
+}
+
+// ResetPassword sets the password of the user the reset token was issued
+// for and signs the user out everywhere. ErrNotFound is returned for an
+// unknown, used or expired token.
+func (s Storage) ResetPassword(tokenHash, password string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	var resetID, userID int64
+	err = tx.QueryRow(`
+		SELECT r.id, r.user_id
+		FROM password_resets r
+		JOIN users u ON u.id = r.user_id
+		WHERE r.token_hash = ? AND r.used_at IS NULL AND r.expires_at > CURRENT_TIMESTAMP AND u.deleted_at IS NULL
+	`, tokenHash).Scan(&resetID, &userID)
+
+	if err != nil && IsNoRowsError(err) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`UPDATE password_resets SET used_at = CURRENT_TIMESTAMP WHERE id = ?`, resetID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`UPDATE users SET password = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, password, userID); err != nil {
+		return err
+	}
+
+	if err := revokeUserSessions(tx, userID, 0); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetUserActive deactivates the user, signing the user out everywhere, or
+// brings a deactivated user back. The last owner can't be deactivated,
+// ErrLastOwner is returned then.
+func (s Storage) SetUserActive(id int64, active bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `UPDATE users SET deleted_at = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
+	if !active {
+		query = `UPDATE users SET deleted_at = COALESCE(deleted_at, CURRENT_TIMESTAMP), updated_at = CURRENT_TIMESTAMP WHERE id = ?`
+	}
+
+	res, err := tx.Exec(query, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	if !active {
+		var owners int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE role = ? AND deleted_at IS NULL`, RoleOwner).Scan(&owners); err != nil {
+			return err
+		}
+
+		if owners == 0 {
+			return ErrLastOwner
+		}
+
+		if err := revokeUserSessions(tx, id, 0); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ListUsers returns a page of the admin users, newest first, filtered by
+// email and creation time.
+func (s Storage) ListUsers(q ListQuery) (*Page[User], error) {
+	var f filter
+	f.created("created_at", q)
+	f.email("email", q)
+
+	total, err := s.count("users", f)
 	if err != nil {
 		return nil, err
 	}
 
-	if id, err := res.LastInsertId(); err != nil {
+	if err := f.after("id", q.Cursor); err != nil {
 		return nil, err
-	} else {
-		return s.GetUserByID(id)
 	}
-}
 
-func (s Storage) ListUsers() ([]User, error) {
 	query := `
-		SELECT id, email, name, role, avatar_url, created_at, updated_at, deleted_at
-		FROM users
+		SELECT id, email, name, role, avatar_url, created_at, updated_at, deleted_at, totp_enabled_at IS NOT NULL
+		FROM users` + f.where() + `
+		ORDER BY id DESC
+		LIMIT ?
 	`
 
-	rows, err := s.db.Query(query)
+	rows, err := s.db.Query(query, append(f.args, q.PageLimit()+1)...)
 	if err != nil {
 		return nil, err
 	}
@@ -99,6 +292,7 @@ func (s Storage) ListUsers() ([]User, error) {
 			&user.CreatedAt,
 			&user.UpdatedAt,
 			&user.DeletedAt,
+			&user.TwoFactorEnabled,
 		); err != nil {
 			return nil, err
 		}
@@ -107,5 +301,9 @@ func (s Storage) ListUsers() ([]User, error) {
 
 	}
 
-	return users, nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return newPage(users, q.PageLimit(), total, func(u User) int64 { return u.ID }), nil
 }
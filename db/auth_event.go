@@ -0,0 +1,183 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	AuthSignInSucceeded = "sign_in_succeeded"
+	AuthSignInFailed    = "sign_in_failed"
+	// AuthSignInBlocked is an attempt refused without checking the
+	// password, because of too many failures before it.
+	AuthSignInBlocked = "sign_in_blocked"
+	// AuthTwoFactorChallenged is a sign-in with the right password that
+	// waits for the second factor.
+	AuthTwoFactorChallenged = "two_factor_challenged"
+	AuthTwoFactorFailed     = "two_factor_failed"
+	// AuthPasswordResetRequested is a password reset link asked for, which
+	// is throttled on its own, apart from the sign-ins.
+	AuthPasswordResetRequested = "password_reset_requested"
+)
+
+type AuthEvent struct {
+	ID        int64     `db:"id" json:"id"`
+	UserID    *int64    `db:"user_id" json:"user_id"`
+	Email     string    `db:"email" json:"email"`
+	Event     string    `db:"event" json:"event"`
+	IP        string    `db:"ip" json:"ip"`
+	UserAgent string    `db:"user_agent" json:"user_agent"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+func (s Storage) CreateAuthEvent(e AuthEvent) error {
+	query := `
+		INSERT INTO auth_events (user_id, email, event, ip, user_agent)
+		VALUES (?, ?, ?, ?, ?)
+	`
+
+	_, err := s.db.Exec(query, e.UserID, e.Email, e.Event, e.IP, e.UserAgent)
+
+	return err
+}
+
+// SignInFailures counts failed sign-ins within the window before now, wrong
+// passwords and wrong second factors alike.
+type SignInFailures struct {
+	// Account counts the failures for the email since its last successful
+	// sign-in.
+	Account     int
+	LastAccount time.Time
+	// IP counts the failures from the IP address, whatever the email.
+	IP     int
+	LastIP time.Time
+}
+
+// ListSignInFailures returns the recent failed sign-ins for the email and
+// from the IP address.
+func (s Storage) ListSignInFailures(email, ip string, window time.Duration) (*SignInFailures, error) {
+	var f SignInFailures
+	var lastAccount, lastIP int64
+
+	query := `
+		SELECT COUNT(*), COALESCE(MAX(strftime('%s', created_at)), 0)
+		FROM auth_events
+		WHERE email = ? AND event IN (?, ?) AND created_at > datetime('now', ?)
+		  AND id > COALESCE((SELECT MAX(id) FROM auth_events WHERE email = ? AND event = ?), 0)
+	`
+
+	since := fmt.Sprintf("-%d seconds", int(window.Seconds()))
+
+	if err := s.db.QueryRow(query, email, AuthSignInFailed, AuthTwoFactorFailed, since, email, AuthSignInSucceeded).Scan(&f.Account, &lastAccount); err != nil {
+		return nil, err
+	}
+
+	query = `
+		SELECT COUNT(*), COALESCE(MAX(strftime('%s', created_at)), 0)
+		FROM auth_events
+		WHERE ip = ? AND event IN (?, ?) AND created_at > datetime('now', ?)
+	`
+
+	if err := s.db.QueryRow(query, ip, AuthSignInFailed, AuthTwoFactorFailed, since).Scan(&f.IP, &lastIP); err != nil {
+		return nil, err
+	}
+
+	f.LastAccount = time.Unix(lastAccount, 0)
+	f.LastIP = time.Unix(lastIP, 0)
+
+	return &f, nil
+}
+
+// ListPasswordResetRequests returns the recent password reset requests for
+// the email and from the IP address, counted the way SignInFailures are.
+func (s Storage) ListPasswordResetRequests(email, ip string, window time.Duration) (*SignInFailures, error) {
+	var f SignInFailures
+	var lastAccount, lastIP int64
+
+	query := `
+		SELECT COUNT(*), COALESCE(MAX(strftime('%s', created_at)), 0)
+		FROM auth_events
+		WHERE email = ? AND event = ? AND created_at > datetime('now', ?)
+	`
+
+	since := fmt.Sprintf("-%d seconds", int(window.Seconds()))
+
+	if err := s.db.QueryRow(query, email, AuthPasswordResetRequested, since).Scan(&f.Account, &lastAccount); err != nil {
+		return nil, err
+	}
+
+	query = `
+		SELECT COUNT(*), COALESCE(MAX(strftime('%s', created_at)), 0)
+		FROM auth_events
+		WHERE ip = ? AND event = ? AND created_at > datetime('now', ?)
+	`
+
+	if err := s.db.QueryRow(query, ip, AuthPasswordResetRequested, since).Scan(&f.IP, &lastIP); err != nil {
+		return nil, err
+	}
+
+	f.LastAccount = time.Unix(lastAccount, 0)
+	f.LastIP = time.Unix(lastIP, 0)
+
+	return &f, nil
+}
+
+// ListAuthEvents returns a page of the auth events, newest first, filtered
+// by event, email and time.
+func (s Storage) ListAuthEvents(q ListQuery) (*Page[AuthEvent], error) {
+	var f filter
+	if q.Status != "" {
+		f.add("event = ?", q.Status)
+	}
+
+	f.created("created_at", q)
+	f.email("email", q)
+
+	total, err := s.count("auth_events", f)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.after("id", q.Cursor); err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT id, user_id, email, event, ip, user_agent, created_at
+		FROM auth_events` + f.where() + `
+		ORDER BY id DESC
+		LIMIT ?
+	`
+
+	rows, err := s.db.Query(query, append(f.args, q.PageLimit()+1)...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	events := make([]AuthEvent, 0)
+
+	for rows.Next() {
+		var e AuthEvent
+		if err := rows.Scan(
+			&e.ID,
+			&e.UserID,
+			&e.Email,
+			&e.Event,
+			&e.IP,
+			&e.UserAgent,
+			&e.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		events = append(events, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return newPage(events, q.PageLimit(), total, func(e AuthEvent) int64 { return e.ID }), nil
+}
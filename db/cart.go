@@ -9,22 +9,27 @@ import (
 )
 
 type Cart struct {
-	ID             int64           `json:"id" db:"id"`
-	Items          []LineItem      `json:"items" db:"items"`
-	CustomerID     *int64          `json:"customer_id" db:"customer_id"`
-	CurrencyCode   string          `json:"currency_code" db:"currency_code"`
-	CurrencySymbol string          `json:"currency_symbol" db:"currency_symbol"`
-	Total          int             `json:"total" db:"total"`
-	Count          int             `json:"count" db:"count"`
-	Subtotal       int             `json:"subtotal" db:"subtotal"`
-	Discount       *Discount       `json:"discount" db:"discount"`
-	DiscountID     *int64          `json:"discount_id" db:"discount_id"`
-	CreatedAt      time.Time       `json:"created_at" db:"created_at"`
-	UpdatedAt      time.Time       `json:"updated_at" db:"updated_at"`
-	DeletedAt      *time.Time      `json:"deleted_at" db:"deleted_at"`
-	Context        CustomerContext `json:"context" db:"context"`
-	DiscountAmount int             `json:"discount_amount" db:"-"`
-	Customer       *Customer       `json:"customer" db:"-"`
+	ID               int64           `json:"id" db:"id"`
+	Items            []LineItem      `json:"items" db:"items"`
+	CustomerID       *int64          `json:"customer_id" db:"customer_id"`
+	CurrencyCode     string          `json:"currency_code" db:"currency_code"`
+	CurrencySymbol   string          `json:"currency_symbol" db:"currency_symbol"`
+	Total            int             `json:"total" db:"total"`
+	Count            int             `json:"count" db:"count"`
+	Subtotal         int             `json:"subtotal" db:"subtotal"`
+	Discount         *Discount       `json:"discount" db:"discount"`
+	DiscountID       *int64          `json:"discount_id" db:"discount_id"`
+	CreatedAt        time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt        time.Time       `json:"updated_at" db:"updated_at"`
+	DeletedAt        *time.Time      `json:"deleted_at" db:"deleted_at"`
+	CompletedAt      *time.Time      `json:"completed_at" db:"completed_at"`
+	Context          CustomerContext `json:"context" db:"context"`
+	DiscountAmount   int             `json:"discount_amount" db:"-"`
+	DiscountReason   DiscountReason  `json:"discount_reason,omitempty" db:"-"`
+	Customer         *Customer       `json:"customer" db:"-"`
+	ShippingMethodID *int64          `json:"shipping_method_id" db:"shipping_method_id"`
+	ShippingMethod   *ShippingMethod `json:"shipping_method" db:"-"`
+	ShippingAmount   int             `json:"shipping_amount" db:"-"`
 }
 
 type CustomerContext struct {
@@ -86,15 +91,17 @@ func (s Storage) GetCartByID(id int64, locale string) (*Cart, error) {
 			c.created_at,
 			c.updated_at,
 			c.deleted_at,
+			c.completed_at,
 			c.context,
 			c.currency_code,
 			COALESCE(cr.symbol, '$') AS currency_symbol,
-			c.discount_id
+			c.discount_id,
+			c.shipping_method_id
 		FROM
 			cart c
 		LEFT JOIN currencies cr ON c.currency_code = cr.code
 		WHERE
-			c.id = ?;`
+			c.id = ? AND c.deleted_at IS NULL;`
 
 	row := s.db.QueryRow(q, id)
 
@@ -104,10 +111,12 @@ func (s Storage) GetCartByID(id int64, locale string) (*Cart, error) {
 		&cart.CreatedAt,
 		&cart.UpdatedAt,
 		&cart.DeletedAt,
+		&cart.CompletedAt,
 		&cart.Context,
 		&cart.CurrencyCode,
 		&cart.CurrencySymbol,
 		&cart.DiscountID,
+		&cart.ShippingMethodID,
 	)
 
 	if err != nil && IsNoRowsError(err) {
@@ -130,69 +139,71 @@ func (s Storage) GetCartByID(id int64, locale string) (*Cart, error) {
 
 	cart.Items = items
 	for _, item := range items {
-		salePrice := item.Price
-		if item.SalePrice != nil {
-			salePrice = *item.SalePrice
-		}
-
 		cart.Subtotal += item.Price * item.Quantity
 		cart.Count += item.Quantity
-		cart.Total += salePrice * item.Quantity
+		cart.Total += item.salePrice() * item.Quantity
 	}
 
-	if cart.DiscountID != nil {
-		discount, err := s.GetDiscount(DiscountQuery{ID: *cart.DiscountID})
+	if cart.CustomerID != nil {
+		customer, err := s.GetCustomerByID(*cart.CustomerID)
 		if err != nil {
 			return nil, err
 		}
 
-		if discount.Value > 0 {
-			var discountAmount int
-			switch discount.Type {
-			case "percentage":
-				discountAmount = cart.Total * discount.Value / 100
-			case "fixed":
-				discountAmount = discount.Value
-			}
-
-			cart.Total -= discountAmount
-			cart.DiscountAmount = discountAmount
-		}
+		cart.Customer = customer
+	}
 
-		cart.Discount = discount
+	methods, err := s.ListCartShippingMethods(&cart)
+	if err != nil {
+		return nil, err
 	}
 
-	// delivery
-	if cart.CurrencyCode == "USD" {
-		cart.Total += 10
-	} else {
-		cart.Total += 25
+	// selected method if it is still available for the destination, cheapest otherwise
+	for i, m := range methods {
+		if i == 0 || (cart.ShippingMethodID != nil && m.ID == *cart.ShippingMethodID) {
+			cart.ShippingMethod = &methods[i]
+		}
 	}
 
-	// only for testing purposes
-	if len(cart.Items) == 1 && cart.Items[0].ProductName == "Test Product" {
-		cart.Total = 1
-		cart.Subtotal = 1
+	if cart.ShippingMethod != nil {
+		cart.ShippingAmount = cart.ShippingMethod.Price
+		cart.Total += cart.ShippingAmount
 	}
 
-	if cart.CustomerID != nil {
-		customer, err := s.GetCustomerByID(*cart.CustomerID)
+	// a discount that no longer applies stays on the cart with the reason,
+	// but takes nothing off
+	if cart.DiscountID != nil {
+		discount, err := s.GetDiscount(DiscountQuery{ID: *cart.DiscountID})
 		if err != nil {
 			return nil, err
 		}
 
-		cart.Customer = customer
+		if cart.DiscountReason, err = s.ValidateCartDiscount(*discount, cart); err != nil {
+			return nil, err
+		} else if cart.DiscountReason == "" {
+			cart.DiscountAmount = discount.Amount(cart)
+			cart.Total -= cart.DiscountAmount
+		}
+
+		cart.Discount = discount
+	}
+
+	// only for testing purposes
+	if len(cart.Items) == 1 && cart.Items[0].ProductName == "Test Product" {
+		cart.Total = 1
+		cart.Subtotal = 1
 	}
 
 	return &cart, nil
 }
 
 func lineItemQuery() string {
-	return `
+	return fmt.Sprintf(`
 			SELECT li.id,
 				   li.cart_id,
 				   li.order_id,
 				   li.variant_id,
+				   pv.product_id,
 				   li.quantity,
 				   li.created_at,
 				   li.updated_at,
@@ -201,20 +212,18 @@ func lineItemQuery() string {
 				   COALESCE(pt.name, p.name) AS product_name,
 				   p.cover_image_url AS image_url,
 				   vp.price,
-				   sp.sale_price
+				   %s AS sale_price
 			FROM line_items li
 			JOIN product_variants pv on li.variant_id = pv.id
 			JOIN products p on pv.product_id = p.id
-			LEFT JOIN sale_prices sp on li.variant_id = sp.variant_id AND sp.currency_code = ?
 			JOIN variant_prices vp on li.variant_id = vp.variant_id AND vp.currency_code = ?
 			LEFT JOIN product_translations pt on p.id = pt.product_id AND pt.language = ?
-		`
+		`, activeSalePrice("li.variant_id", "?"))
 }
 
 type LineItemQuery struct {
 	Locale   string
 	CartID   int64
-	OrderID  int64
 	Currency string
 }
 
@@ -233,9 +242,6 @@ func (s Storage) GetLineItems(query LineItemQuery) ([]LineItem, error) {
 	if query.CartID > 0 {
 		q = fmt.Sprintf("%s WHERE li.cart_id = %d", q, query.CartID)
 		args = append(args, query.CartID)
-	} else if query.OrderID > 0 {
-		q = fmt.Sprintf("%s WHERE li.order_id = %d", q, query.OrderID)
-		args = append(args, query.OrderID)
 	}
 
 	rows, err := s.db.Query(q, args...)
@@ -253,6 +259,7 @@ func (s Storage) GetLineItems(query LineItemQuery) ([]LineItem, error) {
 			&item.CartID,
 			&item.OrderID,
 			&item.VariantID,
+			&item.ProductID,
 			&item.Quantity,
 			&item.CreatedAt,
 			&item.UpdatedAt,
@@ -266,6 +273,7 @@ func (s Storage) GetLineItems(query LineItemQuery) ([]LineItem, error) {
 			return nil, err
 		}
 
+		item.CurrencyCode = currency
 		items = append(items, item)
 	}
 
@@ -303,10 +311,47 @@ func (s Storage) CreateCart(cart Cart, locale string) (*Cart, error) {
 	return s.GetCartByID(id, locale)
 }
 
-func (s Storage) UpdateCartCurrency(cartID int64, currency string) error {
-	_, err := s.db.Exec("UPDATE cart SET currency_code = ? WHERE id = ?", currency, cartID)
+// openCart is the condition for carts that can still be changed, a cart is
+// completed once an order is placed from it.
+func openCart(alias string) string {
+	return fmt.Sprintf("%[1]s.completed_at IS NULL AND %[1]s.deleted_at IS NULL", alias)
+}
 
-	return err
+// updateOpenCart runs an UPDATE of an open cart and tells apart a missing
+// cart from a completed one.
+func (s Storage) updateOpenCart(cartID int64, set string, args ...interface{}) error {
+	res, err := s.db.Exec("UPDATE cart SET "+set+", updated_at = CURRENT_TIMESTAMP WHERE id = ? AND "+openCart("cart"), append(args, cartID)...)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return s.closedCartError(cartID)
+	}
+
+	return nil
+}
+
+// closedCartError explains why a change to the cart didn't apply.
+func (s Storage) closedCartError(cartID int64) error {
+	var completed bool
+	err := s.db.QueryRow("SELECT completed_at IS NOT NULL FROM cart WHERE id = ? AND deleted_at IS NULL", cartID).Scan(&completed)
+
+	if IsNoRowsError(err) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	} else if completed {
+		return ErrCartCompleted
+	}
+
+	return nil
+}
+
+func (s Storage) UpdateCartCurrency(cartID int64, currency string) error {
+	return s.updateOpenCart(cartID, "currency_code = ?", currency)
 }
 
 func (s Storage) DeleteCart(id int64) error {
@@ -316,19 +361,23 @@ func (s Storage) DeleteCart(id int64) error {
 }
 
 func (s Storage) UpdateCartDiscount(cartID int64, discountID int64) error {
-	_, err := s.db.Exec("UPDATE cart SET discount_id = ? WHERE id = ?", discountID, cartID)
-
-	return err
+	return s.updateOpenCart(cartID, "discount_id = ?", discountID)
 }
 
 func (s Storage) DropCartDiscount(cartID int64) error {
-	_, err := s.db.Exec("UPDATE cart SET discount_id = NULL WHERE id = ?", cartID)
+	return s.updateOpenCart(cartID, "discount_id = NULL")
+}
 
-	return err
+func (s Storage) UpdateCartShippingMethod(cartID int64, shippingMethodID int64) error {
+	return s.updateOpenCart(cartID, "shipping_method_id = ?", shippingMethodID)
 }
 
 func (s Storage) UpdateCartCustomer(cartID int64, customerID int64) error {
-	_, err := s.db.Exec("UPDATE cart SET customer_id = ? WHERE id = ?", customerID, cartID)
+	return s.updateOpenCart(cartID, "customer_id = ?", customerID)
+}
 
-	return err
+// CompleteCart locks the cart once an order is placed from it. It returns
+// ErrCartCompleted if another checkout got there first.
+func (s Storage) CompleteCart(cartID int64) error {
+	return s.updateOpenCart(cartID, "completed_at = CURRENT_TIMESTAMP")
 }
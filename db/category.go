@@ -0,0 +1,249 @@
+package db
+
+type Category struct {
+	ID       int64  `db:"id" json:"id"`
+	Handle   string `db:"handle" json:"handle"`
+	Name     string `db:"name" json:"name"`
+	Position int    `db:"position" json:"position"`
+
+	Translations []CategoryTranslation `json:"translations,omitempty"`
+}
+
+type CategoryTranslation struct {
+	CategoryID int64  `db:"category_id" json:"category_id"`
+	Language   string `db:"language" json:"language"`
+	Name       string `db:"name" json:"name"`
+}
+
+// ListCategories lists the categories that aren't deleted in navigation
+// order, named in the locale if there is a translation.
+func (s Storage) ListCategories(locale string) ([]Category, error) {
+	query := `
+		SELECT c.id, c.handle, COALESCE(ct.name, c.name), c.position
+		FROM product_categories c
+		LEFT JOIN category_translations ct ON ct.category_id = c.id AND ct.language = ?
+		WHERE c.deleted_at IS NULL
+		ORDER BY c.position, c.id
+	`
+
+	rows, err := s.db.Query(query, locale)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	categories := make([]Category, 0)
+
+	for rows.Next() {
+		var c Category
+		if err := rows.Scan(&c.ID, &c.Handle, &c.Name, &c.Position); err != nil {
+			return nil, err
+		}
+
+		categories = append(categories, c)
+	}
+
+	return categories, rows.Err()
+}
+
+func (s Storage) GetCategory(id int64) (*Category, error) {
+	query := `
+		SELECT id, handle, name, position
+		FROM product_categories
+		WHERE id = ? AND deleted_at IS NULL
+	`
+
+	var c Category
+	err := s.db.QueryRow(query, id).Scan(&c.ID, &c.Handle, &c.Name, &c.Position)
+
+	if IsNoRowsError(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if c.Translations, err = s.ListCategoryTranslations(id); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// CreateCategory returns ErrAlreadyExists if the handle or the name is taken,
+// also by a deleted category.
+func (s Storage) CreateCategory(c Category) (*Category, error) {
+	query := `
+		INSERT INTO product_categories (handle, name, position)
+		VALUES (?, ?, ?)
+	`
+
+	res, err := s.db.Exec(query, c.Handle, c.Name, c.Position)
+
+	if err != nil && IsDuplicateError(err) {
+		return nil, ErrAlreadyExists
+	} else if err != nil {
+		return nil, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetCategory(id)
+}
+
+func (s Storage) UpdateCategory(c Category) (*Category, error) {
+	query := `
+		UPDATE product_categories
+		SET handle = ?, name = ?, position = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND deleted_at IS NULL
+	`
+
+	res, err := s.db.Exec(query, c.Handle, c.Name, c.Position, c.ID)
+
+	if err != nil && IsDuplicateError(err) {
+		return nil, ErrAlreadyExists
+	} else if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrNotFound
+	}
+
+	return s.GetCategory(c.ID)
+}
+
+// DeleteCategory soft-deletes a category. Its products stay linked but the
+// category is no longer listed or used as a filter.
+func (s Storage) DeleteCategory(id int64) error {
+	query := `
+		UPDATE product_categories
+		SET deleted_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND deleted_at IS NULL
+	`
+
+	res, err := s.db.Exec(query, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s Storage) ListCategoryTranslations(categoryID int64) ([]CategoryTranslation, error) {
+	rows, err := s.db.Query("SELECT category_id, language, name FROM category_translations WHERE category_id = ? ORDER BY language", categoryID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	translations := make([]CategoryTranslation, 0)
+
+	for rows.Next() {
+		var t CategoryTranslation
+		if err := rows.Scan(&t.CategoryID, &t.Language, &t.Name); err != nil {
+			return nil, err
+		}
+
+		translations = append(translations, t)
+	}
+
+	return translations, rows.Err()
+}
+
+// SaveCategoryTranslation creates or replaces the name of a category for a
+// language.
+func (s Storage) SaveCategoryTranslation(t CategoryTranslation) (*CategoryTranslation, error) {
+	query := `
+		INSERT INTO category_translations (category_id, language, name)
+		SELECT c.id, ?, ?
+		FROM product_categories c
+		WHERE c.id = ? AND c.deleted_at IS NULL
+		ON CONFLICT (category_id, language) DO UPDATE
+		SET name = excluded.name
+	`
+
+	res, err := s.db.Exec(query, t.Language, t.Name, t.CategoryID)
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrNotFound
+	}
+
+	return &t, nil
+}
+
+func (s Storage) DeleteCategoryTranslation(categoryID int64, language string) error {
+	res, err := s.db.Exec("DELETE FROM category_translations WHERE category_id = ? AND language = ?", categoryID, language)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// SetProductCategories replaces the categories of a product. ErrNotFound is
+// returned if the product or one of the categories doesn't exist.
+func (s Storage) SetProductCategories(productID int64, categoryIDs []int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM products WHERE id = ? AND deleted_at IS NULL)", productID).Scan(&exists); err != nil {
+		return err
+	} else if !exists {
+		return ErrNotFound
+	}
+
+	if _, err := tx.Exec("DELETE FROM product_category_products WHERE product_id = ?", productID); err != nil {
+		return err
+	}
+
+	query := `
+		INSERT OR IGNORE INTO product_category_products (product_id, category_id)
+		SELECT ?, c.id
+		FROM product_categories c
+		WHERE c.id = ? AND c.deleted_at IS NULL
+	`
+
+	for _, categoryID := range categoryIDs {
+		res, err := tx.Exec(query, productID, categoryID)
+		if err != nil {
+			return err
+		}
+
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrNotFound
+		}
+	}
+
+	return tx.Commit()
+}
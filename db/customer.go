@@ -108,18 +108,33 @@ func (s Storage) UpdateCustomer(c *Customer) (*Customer, error) {
 	return s.GetCustomerByID(c.ID)
 }
 
-func (s Storage) ListCustomers() ([]Customer, error) {
-	var customers []Customer
+// ListCustomers returns a page of the customers, newest first, filtered by
+// email and creation time.
+func (s Storage) ListCustomers(q ListQuery) (*Page[Customer], error) {
+	var f filter
+	f.created("created_at", q)
+	f.email("email", q)
+
+	total, err := s.count("customers", f)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.after("id", q.Cursor); err != nil {
+		return nil, err
+	}
 
-	query := `SELECT * FROM customers`
-	rows, err := s.db.Query(query)
+	query := `SELECT * FROM customers` + f.where() + ` ORDER BY id DESC LIMIT ?`
+	rows, err := s.db.Query(query, append(f.args, q.PageLimit()+1)...)
 
 	if err != nil {
-		return customers, err
+		return nil, err
 	}
 
 	defer rows.Close()
 
+	customers := make([]Customer, 0)
+
 	for rows.Next() {
 		var c Customer
 		err := rows.Scan(
@@ -136,11 +151,15 @@ func (s Storage) ListCustomers() ([]Customer, error) {
 		)
 
 		if err != nil {
-			return customers, err
+			return nil, err
 		}
 
 		customers = append(customers, c)
 	}
 
-	return customers, nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return newPage(customers, q.PageLimit(), total, func(c Customer) int64 { return c.ID }), nil
 }
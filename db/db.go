@@ -2,11 +2,116 @@ package db
 
 import (
 	"database/sql"
+	"fmt"
 	"github.com/mattn/go-sqlite3"
+	"strings"
 )
 
 type Storage struct {
-	db *sql.DB
+	db conn
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx, so helpers can run
+// either standalone or as part of a larger transaction.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// conn is what a Storage runs its queries on: the database, or the
+// transaction of a WithTx unit of work.
+type conn interface {
+	querier
+	Begin() (txConn, error)
+}
+
+type txConn interface {
+	querier
+	Commit() error
+	Rollback() error
+}
+
+type sqlDB struct {
+	*sql.DB
+}
+
+func (d sqlDB) Begin() (txConn, error) {
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// unitOfWork is the conn of a Storage inside WithTx. Methods that start
+// their own transaction get a savepoint instead, so they still roll back
+// their own changes on error without ending the unit of work.
+type unitOfWork struct {
+	txConn
+	savepoints *int
+}
+
+func (u unitOfWork) Begin() (txConn, error) {
+	*u.savepoints++
+
+	sp := &savepoint{querier: u.txConn, name: fmt.Sprintf("sp_%d", *u.savepoints)}
+	if _, err := u.Exec("SAVEPOINT " + sp.name); err != nil {
+		return nil, err
+	}
+
+	return sp, nil
+}
+
+type savepoint struct {
+	querier
+	name string
+	done bool
+}
+
+func (sp *savepoint) Commit() error {
+	if sp.done {
+		return sql.ErrTxDone
+	}
+
+	sp.done = true
+	_, err := sp.Exec("RELEASE " + sp.name)
+
+	return err
+}
+
+func (sp *savepoint) Rollback() error {
+	if sp.done {
+		return sql.ErrTxDone
+	}
+
+	sp.done = true
+	if _, err := sp.Exec("ROLLBACK TO " + sp.name); err != nil {
+		return err
+	}
+
+	_, err := sp.Exec("RELEASE " + sp.name)
+
+	return err
+}
+
+// WithTx runs fn as a single unit of work: every method of the Storage passed
+// to fn takes part in one transaction, which is committed if fn returns nil
+// and rolled back otherwise.
+func (s Storage) WithTx(fn func(tx Storage) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := fn(Storage{db: unitOfWork{txConn: tx, savepoints: new(int)}}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func init() {
@@ -39,7 +144,15 @@ func init() {
 }
 
 func ConnectDB(dbPath string) (*Storage, error) {
-	db, err := sql.Open("sql", dbPath)
+	// Start transactions with BEGIN IMMEDIATE so that concurrent writers
+	// (e.g. two checkouts reserving the same variant) are serialized
+	// instead of failing when upgrading a read lock.
+	sep := "?"
+	if strings.Contains(dbPath, "?") {
+		sep = "&"
+	}
+
+	db, err := sql.Open("sql", dbPath+sep+"_txlock=immediate")
 	if err != nil {
 		return nil, err
 	}
@@ -48,5 +161,5 @@ func ConnectDB(dbPath string) (*Storage, error) {
 		return nil, err
 	}
 
-	return &Storage{db: db}, nil
+	return &Storage{db: sqlDB{db}}, nil
 }
@@ -1,32 +1,144 @@
 package db
 
 import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
 	"time"
 )
 
+const (
+	redemptionReserved = "reserved"
+	redemptionRedeemed = "redeemed"
+	redemptionReleased = "released"
+)
+
+const (
+	DiscountPercentage   = "percentage"
+	DiscountFixed        = "fixed"
+	DiscountFreeShipping = "free_shipping"
+)
+
+var ValidDiscountTypes = []string{DiscountPercentage, DiscountFixed, DiscountFreeShipping}
+
+// DiscountReason tells why a discount doesn't apply to a cart.
+type DiscountReason string
+
+const (
+	DiscountInactive            DiscountReason = "inactive"
+	DiscountNotStarted          DiscountReason = "not_started"
+	DiscountExpired             DiscountReason = "expired"
+	DiscountUsageLimitReached   DiscountReason = "usage_limit_reached"
+	DiscountCurrencyUnsupported DiscountReason = "currency_not_supported"
+	DiscountMinSubtotalNotMet   DiscountReason = "min_subtotal_not_met"
+	DiscountNoEligibleItems     DiscountReason = "no_eligible_items"
+	DiscountAlreadyUsed         DiscountReason = "already_used"
+)
+
 type Discount struct {
-	ID         int64      `db:"id" json:"id"`
-	Code       string     `db:"code" json:"code"`
-	IsActive   bool       `db:"is_active" json:"is_active"`
-	Type       string     `db:"type" json:"type"`
-	UsageLimit int        `db:"usage_limit" json:"usage_limit"`
-	UsageCount int        `db:"usage_count" json:"usage_count"`
-	StartsAt   time.Time  `db:"starts_at" json:"starts_at"`
-	EndsAt     *time.Time `db:"ends_at" json:"ends_at" extensions:"x-nullable"`
-	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
-	UpdatedAt  time.Time  `db:"updated_at" json:"updated_at"`
-	DeletedAt  *time.Time `db:"deleted_at" json:"deleted_at"`
-	Value      int        `db:"value" json:"value"`
-}
-
-func (d Discount) IsValid() bool {
+	ID              int64            `db:"id" json:"id"`
+	Code            string           `db:"code" json:"code"`
+	IsActive        bool             `db:"is_active" json:"is_active"`
+	Type            string           `db:"type" json:"type"`
+	UsageLimit      int              `db:"usage_limit" json:"usage_limit"`
+	UsageCount      int              `db:"usage_count" json:"usage_count"`
+	StartsAt        time.Time        `db:"starts_at" json:"starts_at"`
+	EndsAt          *time.Time       `db:"ends_at" json:"ends_at" extensions:"x-nullable"`
+	CreatedAt       time.Time        `db:"created_at" json:"created_at"`
+	UpdatedAt       time.Time        `db:"updated_at" json:"updated_at"`
+	DeletedAt       *time.Time       `db:"deleted_at" json:"deleted_at"`
+	Value           int              `db:"value" json:"value"`
+	MinSubtotal     int              `db:"min_subtotal" json:"min_subtotal"`
+	OncePerCustomer bool             `db:"once_per_customer" json:"once_per_customer"`
+	Amounts         []DiscountAmount `json:"amounts"`
+	ProductIDs      []int64          `json:"product_ids"`
+	CategoryIDs     []int64          `json:"category_ids"`
+
+	// products the discount is limited to, directly or through a category,
+	// nil if it applies to every product
+	eligible map[int64]bool
+}
+
+// DiscountAmount overrides the fixed amount and the minimum subtotal of a
+// discount for carts in the currency.
+type DiscountAmount struct {
+	CurrencyCode string `db:"currency_code" json:"currency_code"`
+	Value        int    `db:"value" json:"value"`
+	MinSubtotal  int    `db:"min_subtotal" json:"min_subtotal"`
+}
+
+func (d Discount) amountFor(currency string) (DiscountAmount, bool) {
+	for _, a := range d.Amounts {
+		if a.CurrencyCode == currency {
+			return a, true
+		}
+	}
+
+	return DiscountAmount{CurrencyCode: currency, Value: d.Value, MinSubtotal: d.MinSubtotal}, len(d.Amounts) == 0
+}
+
+func (d Discount) appliesTo(productID int64) bool {
+	return d.eligible == nil || d.eligible[productID]
+}
+
+// eligibleTotal is what the cart items the discount applies to cost, after
+// sale prices.
+func (d Discount) eligibleTotal(cart Cart) int {
+	var total int
+	for _, item := range cart.Items {
+		if d.appliesTo(item.ProductID) {
+			total += item.salePrice() * item.Quantity
+		}
+	}
+
+	return total
+}
+
+// IsValid checks the discount against the cart and returns the reason it
+// doesn't apply. Redemptions by the cart's customer are checked by
+// Storage.ValidateCartDiscount.
+func (d Discount) IsValid(cart Cart) (bool, DiscountReason) {
 	now := time.Now()
 
-	// should be active, not expired, and not reached usage limit - if limit is 0, it means unlimited
-	return d.IsActive &&
-		d.StartsAt.Before(now) &&
-		(d.EndsAt == nil || d.EndsAt.After(now)) &&
-		(d.UsageLimit == 0 || d.UsageCount < d.UsageLimit)
+	amount, ok := d.amountFor(cart.CurrencyCode)
+
+	// usage limit 0 means unlimited
+	switch {
+	case !d.IsActive || d.DeletedAt != nil:
+		return false, DiscountInactive
+	case d.StartsAt.After(now):
+		return false, DiscountNotStarted
+	case d.EndsAt != nil && !d.EndsAt.After(now):
+		return false, DiscountExpired
+	case d.UsageLimit > 0 && d.UsageCount >= d.UsageLimit:
+		return false, DiscountUsageLimitReached
+	case !ok && d.Type == DiscountFixed:
+		return false, DiscountCurrencyUnsupported
+	case d.eligibleTotal(cart) == 0:
+		return false, DiscountNoEligibleItems
+	case d.eligibleTotal(cart) < amount.MinSubtotal:
+		return false, DiscountMinSubtotalNotMet
+	}
+
+	return true, ""
+}
+
+// Amount is how much the discount takes off the cart total, it never exceeds
+// the price of the items or the shipping it applies to.
+func (d Discount) Amount(cart Cart) int {
+	switch d.Type {
+	case DiscountPercentage:
+		return d.eligibleTotal(cart) * d.Value / 100
+	case DiscountFixed:
+		amount, _ := d.amountFor(cart.CurrencyCode)
+		return min(amount.Value, d.eligibleTotal(cart))
+	case DiscountFreeShipping:
+		return cart.ShippingAmount
+	}
+
+	return 0
 }
 
 type DiscountQuery struct {
@@ -40,7 +152,7 @@ func (s Storage) GetDiscount(query DiscountQuery) (*Discount, error) {
 	var args interface{}
 
 	q := `
-		SELECT id, code, is_active, type, usage_limit, usage_count, starts_at, ends_at, created_at, updated_at, deleted_at, value
+		SELECT id, code, is_active, type, usage_limit, usage_count, starts_at, ends_at, created_at, updated_at, deleted_at, value, min_subtotal, once_per_customer
 		FROM discounts
 	`
 
@@ -66,6 +178,8 @@ func (s Storage) GetDiscount(query DiscountQuery) (*Discount, error) {
 		&discount.UpdatedAt,
 		&discount.DeletedAt,
 		&discount.Value,
+		&discount.MinSubtotal,
+		&discount.OncePerCustomer,
 	)
 
 	if IsNoRowsError(err) {
@@ -74,30 +188,51 @@ func (s Storage) GetDiscount(query DiscountQuery) (*Discount, error) {
 		return nil, err
 	}
 
+	if err := s.loadDiscountRules(&discount); err != nil {
+		return nil, err
+	}
+
 	return &discount, nil
 }
 
-func (s Storage) UpdateDiscountUsageCount(id int64) error {
-	query := `
-		UPDATE discounts
-		SET usage_count = usage_count + 1
-		WHERE id = ?;
-	`
+const (
+	DiscountStatusActive   = "active"
+	DiscountStatusInactive = "inactive"
+)
 
-	_, err := s.db.Exec(query, id)
+// ListDiscounts returns a page of the discounts that aren't deleted, newest
+// first, filtered by being active and by creation time.
+func (s Storage) ListDiscounts(q ListQuery) (*Page[Discount], error) {
+	discounts := make([]Discount, 0)
 
-	return err
-}
+	f := filter{conds: []string{"deleted_at IS NULL"}}
+
+	switch q.Status {
+	case DiscountStatusActive:
+		f.add("is_active = TRUE")
+	case DiscountStatusInactive:
+		f.add("is_active = FALSE")
+	}
+
+	f.created("created_at", q)
+
+	total, err := s.count("discounts", f)
+	if err != nil {
+		return nil, err
+	}
 
-func (s Storage) ListDiscounts() ([]Discount, error) {
-	var discounts []Discount
+	if err := f.after("id", q.Cursor); err != nil {
+		return nil, err
+	}
 
 	query := `
-		SELECT id, code, is_active, type, usage_limit, usage_count, starts_at, ends_at, created_at, updated_at, deleted_at, value
-		FROM discounts
+		SELECT id, code, is_active, type, usage_limit, usage_count, starts_at, ends_at, created_at, updated_at, deleted_at, value, min_subtotal, once_per_customer
+		FROM discounts` + f.where() + `
+		ORDER BY id DESC
+		LIMIT ?
 	`
 
-	rows, err := s.db.Query(query)
+	rows, err := s.db.Query(query, append(f.args, q.PageLimit()+1)...)
 	if err != nil {
 		return nil, err
 	}
@@ -118,6 +253,8 @@ func (s Storage) ListDiscounts() ([]Discount, error) {
 			&discount.UpdatedAt,
 			&discount.DeletedAt,
 			&discount.Value,
+			&discount.MinSubtotal,
+			&discount.OncePerCustomer,
 		)
 		if err != nil {
 			return nil, err
@@ -126,5 +263,513 @@ func (s Storage) ListDiscounts() ([]Discount, error) {
 		discounts = append(discounts, discount)
 	}
 
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	page := newPage(discounts, q.PageLimit(), total, func(d Discount) int64 { return d.ID })
+
+	for i := range page.Items {
+		if err := s.loadDiscountRules(&page.Items[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return page, nil
+}
+
+// CreateDiscount stores the discount with its per currency amounts and the
+// products and categories it is limited to. Codes are unique regardless of
+// case, ErrAlreadyExists is returned for a taken code and ErrNotFound for an
+// unknown product or category.
+func (s Storage) CreateDiscount(d Discount) (*Discount, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	id, err := createDiscount(tx, d)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return s.GetDiscount(DiscountQuery{ID: id})
+}
+
+func createDiscount(q querier, d Discount) (int64, error) {
+	query := `
+		INSERT INTO discounts (code, type, value, is_active, starts_at, ends_at, usage_limit, min_subtotal, once_per_customer)
+		VALUES (?, ?, ?, ?, COALESCE(?, CURRENT_TIMESTAMP), ?, ?, ?, ?)
+	`
+
+	var startsAt *time.Time
+	if !d.StartsAt.IsZero() {
+		startsAt = &d.StartsAt
+	}
+
+	res, err := q.Exec(query, d.Code, d.Type, d.Value, d.IsActive, startsAt, d.EndsAt, d.UsageLimit, d.MinSubtotal, d.OncePerCustomer)
+
+	if err != nil && IsDuplicateError(err) {
+		return 0, ErrAlreadyExists
+	} else if err != nil {
+		return 0, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return id, saveDiscountRules(q, id, d)
+}
+
+// UpdateDiscount changes a discount that isn't deleted and replaces its
+// rules. Redemptions are kept.
+func (s Storage) UpdateDiscount(d Discount) (*Discount, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+		UPDATE discounts
+		SET code = ?, type = ?, value = ?, is_active = ?, starts_at = COALESCE(?, starts_at), ends_at = ?,
+			usage_limit = ?, min_subtotal = ?, once_per_customer = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND deleted_at IS NULL
+	`
+
+	var startsAt *time.Time
+	if !d.StartsAt.IsZero() {
+		startsAt = &d.StartsAt
+	}
+
+	res, err := tx.Exec(query, d.Code, d.Type, d.Value, d.IsActive, startsAt, d.EndsAt, d.UsageLimit, d.MinSubtotal, d.OncePerCustomer, d.ID)
+
+	if err != nil && IsDuplicateError(err) {
+		return nil, ErrAlreadyExists
+	} else if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrNotFound
+	}
+
+	if err := saveDiscountRules(tx, d.ID, d); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return s.GetDiscount(DiscountQuery{ID: d.ID})
+}
+
+func saveDiscountRules(q querier, id int64, d Discount) error {
+	for _, table := range []string{"discount_amounts", "discount_products", "discount_categories"} {
+		if _, err := q.Exec(fmt.Sprintf("DELETE FROM %s WHERE discount_id = ?", table), id); err != nil {
+			return err
+		}
+	}
+
+	for _, a := range d.Amounts {
+		query := "INSERT INTO discount_amounts (discount_id, currency_code, value, min_subtotal) VALUES (?, ?, ?, ?)"
+		if _, err := q.Exec(query, id, a.CurrencyCode, a.Value, a.MinSubtotal); err != nil && IsDuplicateError(err) {
+			return ErrAlreadyExists
+		} else if err != nil {
+			return err
+		}
+	}
+
+	for _, productID := range d.ProductIDs {
+		query := "INSERT OR IGNORE INTO discount_products (discount_id, product_id) VALUES (?, ?)"
+		if _, err := q.Exec(query, id, productID); err != nil && IsForeignKeyError(err) {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+	}
+
+	for _, categoryID := range d.CategoryIDs {
+		query := "INSERT OR IGNORE INTO discount_categories (discount_id, category_id) VALUES (?, ?)"
+		if _, err := q.Exec(query, id, categoryID); err != nil && IsForeignKeyError(err) {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s Storage) SetDiscountActive(id int64, active bool) error {
+	query := `
+		UPDATE discounts
+		SET is_active = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND deleted_at IS NULL
+	`
+
+	res, err := s.db.Exec(query, active, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// DeleteDiscount soft-deletes a discount and deactivates it. Carts and orders
+// keep referring to it and its code can't be reused.
+func (s Storage) DeleteDiscount(id int64) error {
+	query := `
+		UPDATE discounts
+		SET deleted_at = CURRENT_TIMESTAMP, is_active = FALSE, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND deleted_at IS NULL
+	`
+
+	res, err := s.db.Exec(query, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// discountCodeAlphabet leaves out characters that are easy to confuse when
+// a code is typed in: 0/O and 1/I/L.
+const discountCodeAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+
+const discountCodeLength = 8
+
+const maxDiscountCodeCollisions = 10
+
+func randomDiscountCode(prefix string) (string, error) {
+	b := make([]byte, discountCodeLength)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(discountCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+
+		b[i] = discountCodeAlphabet[n.Int64()]
+	}
+
+	return strings.ToUpper(prefix) + string(b), nil
+}
+
+// GenerateDiscounts creates count single-use discounts with random codes
+// starting with the prefix, all with the terms of d. Codes that collide with
+// an existing one, in any case, are generated again; ErrAlreadyExists is
+// returned if that keeps happening. Either all discounts are created or none.
+func (s Storage) GenerateDiscounts(d Discount, prefix string, count int) ([]Discount, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	d.UsageLimit = 1
+
+	ids := make([]int64, 0, count)
+	for collisions := 0; len(ids) < count; {
+		if d.Code, err = randomDiscountCode(prefix); err != nil {
+			return nil, err
+		}
+
+		id, err := createDiscount(tx, d)
+		if errors.Is(err, ErrAlreadyExists) && collisions < maxDiscountCodeCollisions {
+			collisions++
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	discounts := make([]Discount, 0, count)
+	for _, id := range ids {
+		discount, err := s.GetDiscount(DiscountQuery{ID: id})
+		if err != nil {
+			return nil, err
+		}
+
+		discounts = append(discounts, *discount)
+	}
+
 	return discounts, nil
 }
+
+// loadDiscountRules loads the per currency amounts and the products and
+// categories the discount is limited to.
+func (s Storage) loadDiscountRules(d *Discount) error {
+	d.Amounts = make([]DiscountAmount, 0)
+	d.ProductIDs = make([]int64, 0)
+	d.CategoryIDs = make([]int64, 0)
+
+	rows, err := s.db.Query("SELECT currency_code, value, min_subtotal FROM discount_amounts WHERE discount_id = ? ORDER BY currency_code", d.ID)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var a DiscountAmount
+		if err := rows.Scan(&a.CurrencyCode, &a.Value, &a.MinSubtotal); err != nil {
+			return err
+		}
+
+		d.Amounts = append(d.Amounts, a)
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if d.ProductIDs, err = s.discountIDs("SELECT product_id FROM discount_products WHERE discount_id = ? ORDER BY product_id", d.ID); err != nil {
+		return err
+	}
+
+	if d.CategoryIDs, err = s.discountIDs("SELECT category_id FROM discount_categories WHERE discount_id = ? ORDER BY category_id", d.ID); err != nil {
+		return err
+	}
+
+	if len(d.ProductIDs) == 0 && len(d.CategoryIDs) == 0 {
+		d.eligible = nil
+		return nil
+	}
+
+	query := `
+		SELECT product_id FROM discount_products WHERE discount_id = ?
+		UNION
+		SELECT cp.product_id
+		FROM discount_categories dc
+		JOIN product_category_products cp ON cp.category_id = dc.category_id
+		WHERE dc.discount_id = ?
+	`
+
+	products, err := s.discountIDs(query, d.ID, d.ID)
+	if err != nil {
+		return err
+	}
+
+	d.eligible = make(map[int64]bool, len(products))
+	for _, id := range products {
+		d.eligible[id] = true
+	}
+
+	return nil
+}
+
+func (s Storage) discountIDs(query string, args ...interface{}) ([]int64, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// ValidateCartDiscount checks the discount against the cart like
+// Discount.IsValid and, for once per customer discounts, that the cart's
+// customer hasn't redeemed it already with another order. It returns an
+// empty reason if the discount applies.
+func (s Storage) ValidateCartDiscount(d Discount, cart Cart) (DiscountReason, error) {
+	if ok, reason := d.IsValid(cart); !ok {
+		return reason, nil
+	}
+
+	if !d.OncePerCustomer || cart.Customer == nil {
+		return "", nil
+	}
+
+	query := fmt.Sprintf(`
+		SELECT EXISTS(
+			SELECT 1
+			FROM discount_redemptions r
+			JOIN orders o ON o.id = r.order_id
+			JOIN customers c ON c.id = o.customer_id
+			WHERE r.discount_id = ? AND LOWER(c.email) = LOWER(?) AND o.cart_id != ? AND %s
+		)
+	`, activeRedemption("r"))
+
+	var used bool
+	if err := s.db.QueryRow(query, d.ID, cart.Customer.Email, cart.ID).Scan(&used); err != nil {
+		return "", err
+	} else if used {
+		return DiscountAlreadyUsed, nil
+	}
+
+	return "", nil
+}
+
+// activeRedemption is the condition for redemptions that count against the
+// limits of a discount: redeemed by a paid order or held by an unpaid one.
+func activeRedemption(alias string) string {
+	return fmt.Sprintf("(%[1]s.status = '%[2]s' OR (%[1]s.status = '%[3]s' AND %[1]s.expires_at > CURRENT_TIMESTAMP))",
+		alias, redemptionRedeemed, redemptionReserved)
+}
+
+// ReserveOrderDiscount holds a redemption of the order's discount until the
+// order is paid, for as long as its stock is reserved. Active reservations
+// count against the usage limit and the once per customer rule, so concurrent
+// checkouts can't redeem a code more times than allowed; ErrDiscountUsedUp is
+// returned when it's used up. Orders without a discount are ignored, a
+// released or expired reservation of the order is renewed.
+func (s Storage) ReserveOrderDiscount(orderID int64) error {
+	var active bool
+	query := fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM discount_redemptions r WHERE r.order_id = ? AND %s)", activeRedemption("r"))
+
+	if err := s.db.QueryRow(query, orderID).Scan(&active); err != nil {
+		return err
+	} else if active {
+		return nil
+	}
+
+	query = fmt.Sprintf(`
+		INSERT INTO discount_redemptions (discount_id, order_id, status, expires_at)
+		SELECT d.id, o.id, ?, datetime('now', ?)
+		FROM orders o
+		JOIN discounts d ON d.id = o.discount_id
+		JOIN customers c ON c.id = o.customer_id
+		WHERE o.id = ? AND (d.usage_limit = 0 OR d.usage_count + (
+			SELECT COUNT(*)
+			FROM discount_redemptions r
+			WHERE r.discount_id = d.id AND r.status = ? AND r.expires_at > CURRENT_TIMESTAMP
+		) < d.usage_limit)
+		  AND (NOT d.once_per_customer OR NOT EXISTS (
+			SELECT 1
+			FROM discount_redemptions r
+			JOIN orders ro ON ro.id = r.order_id
+			JOIN customers rc ON rc.id = ro.customer_id
+			WHERE r.discount_id = d.id AND LOWER(rc.email) = LOWER(c.email) AND %s
+		))
+		ON CONFLICT (order_id) DO UPDATE
+		SET status = excluded.status, expires_at = excluded.expires_at, updated_at = CURRENT_TIMESTAMP
+	`, activeRedemption("r"))
+
+	ttl := fmt.Sprintf("+%d seconds", int(StockReservationTTL.Seconds()))
+
+	res, err := s.db.Exec(query, redemptionReserved, ttl, orderID, redemptionReserved)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n > 0 {
+		return nil
+	}
+
+	var discountID *int64
+	err = s.db.QueryRow("SELECT discount_id FROM orders WHERE id = ?", orderID).Scan(&discountID)
+
+	if IsNoRowsError(err) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	} else if discountID == nil {
+		return nil
+	}
+
+	return ErrDiscountUsedUp
+}
+
+// redeemOrderDiscount counts the discount of a paid order as used. A paid
+// order is redeemed even if its reservation expired in the meantime.
+func redeemOrderDiscount(q querier, orderID int64) error {
+	query := `
+		INSERT INTO discount_redemptions (discount_id, order_id, status, expires_at)
+		SELECT discount_id, id, ?, CURRENT_TIMESTAMP
+		FROM orders
+		WHERE id = ? AND discount_id IS NOT NULL
+		ON CONFLICT (order_id) DO UPDATE
+		SET status = excluded.status, updated_at = CURRENT_TIMESTAMP
+		WHERE status != excluded.status
+	`
+
+	res, err := q.Exec(query, redemptionRedeemed, orderID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return nil
+	}
+
+	query = `
+		UPDATE discounts
+		SET usage_count = usage_count + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = (SELECT discount_id FROM discount_redemptions WHERE order_id = ?)
+	`
+
+	_, err = q.Exec(query, orderID)
+
+	return err
+}
+
+// releaseOrderDiscount gives the redemption of a cancelled, failed or
+// refunded order back to the discount.
+func releaseOrderDiscount(q querier, orderID int64) error {
+	query := `
+		UPDATE discounts
+		SET usage_count = MAX(usage_count - 1, 0), updated_at = CURRENT_TIMESTAMP
+		WHERE id = (SELECT discount_id FROM discount_redemptions WHERE order_id = ? AND status = ?)
+	`
+
+	if _, err := q.Exec(query, orderID, redemptionRedeemed); err != nil {
+		return err
+	}
+
+	query = `
+		UPDATE discount_redemptions
+		SET status = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE order_id = ? AND status != ?
+	`
+
+	_, err := q.Exec(query, redemptionReleased, orderID, redemptionReleased)
+
+	return err
+}
@@ -7,8 +7,19 @@ import (
 )
 
 var (
-	ErrNotFound      = errors.New("not found")
-	ErrAlreadyExists = errors.New("already exists")
+	ErrNotFound       = errors.New("not found")
+	ErrAlreadyExists  = errors.New("already exists")
+	ErrOutOfStock     = errors.New("out of stock")
+	ErrCartCompleted  = errors.New("cart is completed")
+	ErrDiscountUsedUp = errors.New("discount usage limit reached")
+
+	ErrInvalidStatusTransition = errors.New("invalid status transition")
+	ErrNotRefundable           = errors.New("order is not refundable")
+	ErrRefundExceedsPayment    = errors.New("refund exceeds the paid amount")
+	ErrInvalidCursor           = errors.New("invalid cursor")
+	ErrLastOwner               = errors.New("the last owner can't be removed")
+	ErrTwoFactorEnabled        = errors.New("two-factor authentication is already enabled")
+	ErrPriceMissing            = errors.New("price is missing in the currency")
 )
 
 func IsNoRowsError(err error) bool {
@@ -23,3 +34,12 @@ func IsDuplicateError(err error) bool {
 
 	return false
 }
+
+func IsForeignKeyError(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey
+	}
+
+	return false
+}
@@ -0,0 +1,192 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// Invitation lets someone create an admin account with the given role. It
+// is used once, with a token only the hash of which is stored.
+type Invitation struct {
+	ID         int64      `db:"id" json:"id"`
+	Email      string     `db:"email" json:"email"`
+	Name       *string    `db:"name" json:"name"`
+	Role       string     `db:"role" json:"role"`
+	InvitedBy  *int64     `db:"invited_by" json:"invited_by"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+	ExpiresAt  time.Time  `db:"expires_at" json:"expires_at"`
+	AcceptedAt *time.Time `db:"accepted_at" json:"accepted_at"`
+}
+
+// pendingInvitation is the condition for the invitation aliased as i being
+// neither accepted nor expired.
+const pendingInvitation = "i.accepted_at IS NULL AND i.expires_at > CURRENT_TIMESTAMP"
+
+const invitationColumns = "i.id, i.email, i.name, i.role, i.invited_by, i.created_at, i.expires_at, i.accepted_at"
+
+func scanInvitation(row interface{ Scan(...interface{}) error }) (*Invitation, error) {
+	var inv Invitation
+
+	err := row.Scan(
+		&inv.ID,
+		&inv.Email,
+		&inv.Name,
+		&inv.Role,
+		&inv.InvitedBy,
+		&inv.CreatedAt,
+		&inv.ExpiresAt,
+		&inv.AcceptedAt,
+	)
+
+	if err != nil && IsNoRowsError(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &inv, nil
+}
+
+// CreateInvitation invites the email for ttl. ErrAlreadyExists is returned
+// if there is a user with the email, deactivated or not. Earlier pending
+// invitations of the email stop working.
+func (s Storage) CreateInvitation(inv Invitation, tokenHash string, ttl time.Duration) (*Invitation, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE email = ?)`, inv.Email).Scan(&exists); err != nil {
+		return nil, err
+	} else if exists {
+		return nil, ErrAlreadyExists
+	}
+
+	if _, err := tx.Exec(`DELETE FROM user_invitations WHERE email = ? AND accepted_at IS NULL`, inv.Email); err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO user_invitations (email, name, role, invited_by, token_hash, expires_at)
+		VALUES (?, ?, ?, ?, ?, datetime('now', ?))
+	`
+
+	res, err := tx.Exec(query, inv.Email, inv.Name, inv.Role, inv.InvitedBy, tokenHash, ttlModifier(ttl))
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := scanInvitation(tx.QueryRow("SELECT "+invitationColumns+" FROM user_invitations i WHERE i.id = ?", id))
+	if err != nil {
+		return nil, err
+	}
+
+	return created, tx.Commit()
+}
+
+// ListInvitations returns the pending invitations, newest first.
+func (s Storage) ListInvitations() ([]Invitation, error) {
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM user_invitations i
+		WHERE %s
+		ORDER BY i.id DESC
+	`, invitationColumns, pendingInvitation)
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	invitations := make([]Invitation, 0)
+
+	for rows.Next() {
+		inv, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		invitations = append(invitations, *inv)
+	}
+
+	return invitations, rows.Err()
+}
+
+// DeleteInvitation withdraws a pending invitation.
+func (s Storage) DeleteInvitation(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM user_invitations WHERE id = ? AND accepted_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// AcceptInvitation creates the user of a pending invitation with the email
+// and role it was sent for, the password and profile come from u.
+// ErrNotFound is returned for an unknown, used or expired token.
+func (s Storage) AcceptInvitation(tokenHash string, u User) (*User, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM user_invitations i
+		WHERE i.token_hash = ? AND %s
+	`, invitationColumns, pendingInvitation)
+
+	inv, err := scanInvitation(tx.QueryRow(query, tokenHash))
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Name == nil {
+		u.Name = inv.Name
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO users (email, name, role, avatar_url, password)
+		VALUES (?, ?, ?, ?, ?)
+	`, inv.Email, u.Name, inv.Role, u.AvatarURL, u.Password)
+
+	if err != nil && IsDuplicateError(err) {
+		return nil, ErrAlreadyExists
+	} else if err != nil {
+		return nil, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`UPDATE user_invitations SET accepted_at = CURRENT_TIMESTAMP WHERE id = ?`, inv.ID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return s.GetUserByID(id)
+}
@@ -1,31 +1,52 @@
 package db
 
-import "time"
+import (
+	"fmt"
+	"strings"
+	"time"
+)
 
 type LineItem struct {
 	ID        int64      `db:"id" json:"id"`
 	CartID    *int64     `db:"cart_id" json:"cart_id"`
 	OrderID   *int64     `db:"order_id" json:"order_id"`
 	VariantID int64      `db:"variant_id" json:"variant_id"`
+	ProductID int64      `db:"product_id" json:"product_id"`
 	Quantity  int        `db:"quantity" json:"quantity"`
 	CreatedAt time.Time  `db:"created_at" json:"created_at"`
 	UpdatedAt time.Time  `db:"updated_at" json:"updated_at"`
 	DeletedAt *time.Time `db:"deleted_at" json:"deleted_at"`
 
-	VariantName string `db:"variant_name" json:"variant_name"`
-	Price       int    `db:"price" json:"price"`
-	SalePrice   *int   `db:"sale_price" json:"sale_price"`
-	ProductName string `db:"product_name" json:"product_name"`
-	ImageURL    string `db:"image_url" json:"image_url"`
+	// for cart items these follow the current catalog, order items keep
+	// what the customer saw at checkout
+	VariantName  string `db:"variant_name" json:"variant_name"`
+	Price        int    `db:"price" json:"price"`
+	SalePrice    *int   `db:"sale_price" json:"sale_price"`
+	CurrencyCode string `db:"currency_code" json:"currency_code"`
+	ProductName  string `db:"product_name" json:"product_name"`
+	ImageURL     string `db:"image_url" json:"image_url"`
 }
 
+// salePrice is what the customer pays for one item.
+func (li LineItem) salePrice() int {
+	if li.SalePrice != nil && *li.SalePrice < li.Price {
+		return *li.SalePrice
+	}
+
+	return li.Price
+}
+
+// SaveLineItem adds an item to an open cart if enough stock is available.
 func (s Storage) SaveLineItem(li LineItem) error {
-	query := `
+	query := fmt.Sprintf(`
 		INSERT INTO line_items (cart_id, order_id, variant_id, quantity)
-		VALUES (?, ?, ?, ?)
-	`
+		SELECT c.id, ?, pv.id, ?
+		FROM product_variants pv
+		JOIN cart c ON c.id = ? AND %s
+		WHERE pv.id = ? AND pv.deleted_at IS NULL AND %s >= ?
+	`, openCart("c"), availableStock)
 
-	_, err := s.db.Exec(query, li.CartID, li.OrderID, li.VariantID, li.Quantity)
+	res, err := s.db.Exec(query, li.OrderID, li.Quantity, li.CartID, li.VariantID, li.Quantity)
 
 	if err != nil && IsDuplicateError(err) {
 		return ErrAlreadyExists
@@ -33,37 +54,214 @@ func (s Storage) SaveLineItem(li LineItem) error {
 		return err
 	}
 
-	return nil
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n > 0 {
+		return nil
+	}
+
+	if li.CartID != nil {
+		if err := s.closedCartError(*li.CartID); err != nil {
+			return err
+		}
+	}
+
+	return ErrOutOfStock
 }
 
-func (s Storage) UpdateLineItemsOrderID(cartID, orderID int64) error {
-	query := `
+// UpdateLineItemsOrderID moves the cart items to the order and snapshots
+// their price in the order currency, names in the given locale and image, so
+// the order doesn't change when the product is repriced or renamed.
+// ErrPriceMissing is returned if an item has no price in the order currency,
+// in which case no item is moved.
+func (s Storage) UpdateLineItemsOrderID(cartID, orderID int64, locale string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM line_items WHERE cart_id = ?", cartID).Scan(&count); err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf(`
 		UPDATE line_items
-		SET order_id = ?
-		WHERE cart_id = ?
-	`
+		SET order_id = o.id,
+			price = vp.price,
+			sale_price = %s,
+			currency_code = o.currency_code,
+			product_name = COALESCE(pt.name, p.name),
+			variant_name = pv.name,
+			image_url = p.cover_image_url,
+			updated_at = CURRENT_TIMESTAMP
+		FROM orders o
+		JOIN product_variants pv
+		JOIN products p ON p.id = pv.product_id
+		LEFT JOIN variant_prices vp ON vp.variant_id = pv.id AND vp.currency_code = o.currency_code
+		LEFT JOIN product_translations pt ON pt.product_id = p.id AND pt.language = ?
+		WHERE o.id = ? AND line_items.cart_id = ? AND pv.id = line_items.variant_id
+	`, activeSalePrice("line_items.variant_id", "o.currency_code"))
 
-	_, err := s.db.Exec(query, orderID, cartID)
-	return err
+	res, err := tx.Exec(query, locale, orderID, cartID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if int(n) != count {
+		return fmt.Errorf("moved %d of %d items of cart %d to order %d", n, count, cartID, orderID)
+	}
+
+	var missing int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM line_items WHERE order_id = ? AND price IS NULL", orderID).Scan(&missing); err != nil {
+		return err
+	} else if missing > 0 {
+		return ErrPriceMissing
+	}
+
+	return tx.Commit()
+}
+
+func (s Storage) getOrderItems(orderID int64) ([]LineItem, error) {
+	items, err := s.listOrderItems([]int64{orderID})
+	if err != nil {
+		return nil, err
+	}
+
+	return items[orderID], nil
 }
 
-func (s Storage) UpdateLineItemQuantity(li int64, quantity int) error {
-	query := `
+// listOrderItems loads the items of several orders at once, by order ID.
+func (s Storage) listOrderItems(orderIDs []int64) (map[int64][]LineItem, error) {
+	items := make(map[int64][]LineItem, len(orderIDs))
+	if len(orderIDs) == 0 {
+		return items, nil
+	}
+
+	args := make([]interface{}, len(orderIDs))
+	for i, id := range orderIDs {
+		args[i] = id
+	}
+
+	query := fmt.Sprintf(`
+		SELECT id,
+			   cart_id,
+			   order_id,
+			   variant_id,
+			   COALESCE((SELECT product_id FROM product_variants WHERE id = variant_id), 0),
+			   quantity,
+			   created_at,
+			   updated_at,
+			   deleted_at,
+			   variant_name,
+			   product_name,
+			   image_url,
+			   price,
+			   sale_price,
+			   currency_code
+		FROM line_items
+		WHERE order_id IN (%s)
+		ORDER BY id
+	`, strings.TrimSuffix(strings.Repeat("?, ", len(orderIDs)), ", "))
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var item LineItem
+		if err := rows.Scan(
+			&item.ID,
+			&item.CartID,
+			&item.OrderID,
+			&item.VariantID,
+			&item.ProductID,
+			&item.Quantity,
+			&item.CreatedAt,
+			&item.UpdatedAt,
+			&item.DeletedAt,
+			&item.VariantName,
+			&item.ProductName,
+			&item.ImageURL,
+			&item.Price,
+			&item.SalePrice,
+			&item.CurrencyCode,
+		); err != nil {
+			return nil, err
+		}
+
+		items[*item.OrderID] = append(items[*item.OrderID], item)
+	}
+
+	return items, rows.Err()
+}
+
+func (s Storage) UpdateLineItemQuantity(cartID, li int64, quantity int) error {
+	query := fmt.Sprintf(`
 		UPDATE line_items
-		SET quantity = ?
-		WHERE id = ?
-	`
+		SET quantity = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND cart_id = ?
+		  AND EXISTS (SELECT 1 FROM cart c WHERE c.id = line_items.cart_id AND %s)
+		  AND (
+			SELECT %s
+			FROM product_variants pv
+			WHERE pv.id = line_items.variant_id
+		  ) >= ?
+	`, openCart("c"), availableStock)
+
+	res, err := s.db.Exec(query, quantity, li, cartID, quantity)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n > 0 {
+		return nil
+	}
 
-	_, err := s.db.Exec(query, quantity, li)
-	return err
+	if err := s.closedCartError(cartID); err != nil {
+		return err
+	}
+
+	var exists bool
+	if err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM line_items WHERE id = ? AND cart_id = ?)", li, cartID).Scan(&exists); err != nil {
+		return err
+	} else if !exists {
+		return ErrNotFound
+	}
+
+	return ErrOutOfStock
 }
 
-func (s Storage) RemoveLineItem(li int64) error {
-	query := `
+func (s Storage) RemoveLineItem(cartID, li int64) error {
+	query := fmt.Sprintf(`
 		DELETE FROM line_items
-		WHERE id = ?
-	`
+		WHERE id = ? AND cart_id = ?
+		  AND EXISTS (SELECT 1 FROM cart c WHERE c.id = line_items.cart_id AND %s)
+	`, openCart("c"))
+
+	res, err := s.db.Exec(query, li, cartID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n > 0 {
+		return nil
+	}
+
+	if err := s.closedCartError(cartID); err != nil {
+		return err
+	}
 
-	_, err := s.db.Exec(query, li)
-	return err
+	return ErrNotFound
 }
@@ -1,7 +1,24 @@
 package db
 
-func (s Storage) Migrate() error {
-	createTableQuery := `
+import (
+	"fmt"
+	"time"
+)
+
+// Migration is a single forward-only schema change. Once a migration has
+// shipped it must never be edited or reordered, append a new one instead.
+type Migration struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at"`
+	query     string
+}
+
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial_schema",
+		query: `
 		CREATE TABLE IF NOT EXISTS currencies (
 		    code TEXT PRIMARY KEY,
 		    name TEXT,
@@ -210,11 +227,596 @@ func (s Storage) Migrate() error {
 			FOREIGN KEY (product_id) REFERENCES products (id),
 			FOREIGN KEY (category_id) REFERENCES product_categories (id)
 		);
- 	`
+	`,
+	},
+	{
+		Version: 2,
+		Name:    "shipping_methods",
+		query: `
+		ALTER TABLE regions ADD COLUMN is_default BOOLEAN DEFAULT FALSE;
+
+		ALTER TABLE cart ADD COLUMN shipping_method_id INTEGER REFERENCES shipping_methods (id);
+
+		CREATE TABLE shipping_method_prices (
+			shipping_method_id INTEGER,
+			id INTEGER PRIMARY KEY,
+			price INTEGER,
+			currency_code TEXT,
+			FOREIGN KEY (shipping_method_id) REFERENCES shipping_methods (id),
+			FOREIGN KEY (currency_code) REFERENCES currencies (code),
+			UNIQUE(shipping_method_id, currency_code)
+		);
+
+		INSERT INTO regions (id, name, currency_code, is_default) VALUES (1, 'CIS', 'BYN', FALSE) ON CONFLICT DO NOTHING;
+		INSERT INTO regions (id, name, currency_code, is_default) VALUES (2, 'International', 'USD', TRUE) ON CONFLICT DO NOTHING;
+
+		INSERT INTO countries (display_name, iso_code, region_id) VALUES
+			('Belarus', 'BY', 1),
+			('Russia', 'RU', 1),
+			('Kazakhstan', 'KZ', 1),
+			('Armenia', 'AM', 1),
+			('Kyrgyzstan', 'KG', 1),
+			('Uzbekistan', 'UZ', 1)
+		ON CONFLICT DO NOTHING;
+
+		INSERT INTO shipping_methods (id, name, price, region_id) VALUES (1, 'CDEK', 25, 1) ON CONFLICT DO NOTHING;
+		INSERT INTO shipping_methods (id, name, price, region_id) VALUES (2, 'International express', 10, 2) ON CONFLICT DO NOTHING;
+
+		INSERT INTO shipping_method_prices (shipping_method_id, price, currency_code) VALUES
+			(1, 25, 'BYN'),
+			(1, 10, 'USD'),
+			(2, 25, 'BYN'),
+			(2, 10, 'USD')
+		ON CONFLICT DO NOTHING;
+	`,
+	},
+	{
+		Version: 3,
+		Name:    "stock_reservations",
+		query: `
+		CREATE TABLE stock_reservations (
+			id INTEGER PRIMARY KEY,
+			order_id INTEGER NOT NULL,
+			variant_id INTEGER NOT NULL,
+			quantity INTEGER NOT NULL,
+			status TEXT NOT NULL DEFAULT 'reserved',
+			expires_at TIMESTAMP NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (order_id) REFERENCES orders (id),
+			FOREIGN KEY (variant_id) REFERENCES product_variants (id)
+		);
+
+		CREATE INDEX stock_reservations_variant_idx ON stock_reservations (variant_id, status, expires_at);
+		CREATE INDEX stock_reservations_order_idx ON stock_reservations (order_id);
+	`,
+	},
+	{
+		Version: 4,
+		Name:    "catalog_admin",
+		query: `
+		ALTER TABLE product_variants ADD COLUMN deleted_at TIMESTAMP;
+
+		DELETE FROM product_translations
+		WHERE id NOT IN (SELECT MAX(id) FROM product_translations GROUP BY product_id, language);
+
+		CREATE UNIQUE INDEX product_translations_language_idx ON product_translations (product_id, language);
+	`,
+	},
+	{
+		Version: 5,
+		Name:    "order_status_history",
+		query: `
+		CREATE TABLE order_status_history (
+			id INTEGER PRIMARY KEY,
+			order_id INTEGER NOT NULL,
+			from_status TEXT,
+			to_status TEXT NOT NULL,
+			user_id INTEGER,
+			note TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (order_id) REFERENCES orders (id),
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		);
+
+		CREATE INDEX order_status_history_order_idx ON order_status_history (order_id);
+	`,
+	},
+	{
+		Version: 6,
+		Name:    "payment_events",
+		query: `
+		CREATE TABLE payment_events (
+			id INTEGER PRIMARY KEY,
+			provider TEXT NOT NULL,
+			transaction_id TEXT NOT NULL,
+			order_id INTEGER,
+			status TEXT,
+			payment_status TEXT,
+			amount INTEGER,
+			currency_code TEXT,
+			raw_body TEXT,
+			result TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (order_id) REFERENCES orders (id)
+		);
+
+		CREATE INDEX payment_events_transaction_idx ON payment_events (provider, transaction_id);
+		CREATE INDEX payment_events_order_idx ON payment_events (order_id);
+	`,
+	},
+	{
+		Version: 7,
+		Name:    "refunds",
+		query: `
+		CREATE TABLE refunds (
+			id INTEGER PRIMARY KEY,
+			order_id INTEGER NOT NULL,
+			provider TEXT NOT NULL,
+			transaction_id TEXT,
+			provider_refund_id TEXT,
+			amount INTEGER NOT NULL,
+			currency_code TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending',
+			reason TEXT,
+			user_id INTEGER,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (order_id) REFERENCES orders (id),
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		);
+
+		CREATE INDEX refunds_order_idx ON refunds (order_id);
+		CREATE UNIQUE INDEX refunds_provider_refund_idx ON refunds (provider, provider_refund_id);
+	`,
+	},
+	{
+		Version: 8,
+		Name:    "cart_completed_at",
+		query: `
+		ALTER TABLE cart ADD COLUMN completed_at TIMESTAMP;
+
+		UPDATE cart SET completed_at = (SELECT MIN(o.created_at) FROM orders o WHERE o.cart_id = cart.id)
+		WHERE EXISTS (SELECT 1 FROM orders o WHERE o.cart_id = cart.id);
+
+		CREATE INDEX orders_cart_idx ON orders (cart_id);
+	`,
+	},
+	{
+		Version: 9,
+		Name:    "line_item_snapshot",
+		query: `
+		ALTER TABLE line_items ADD COLUMN price INTEGER;
+		ALTER TABLE line_items ADD COLUMN sale_price INTEGER;
+		ALTER TABLE line_items ADD COLUMN currency_code TEXT;
+		ALTER TABLE line_items ADD COLUMN product_name TEXT;
+		ALTER TABLE line_items ADD COLUMN variant_name TEXT;
+		ALTER TABLE line_items ADD COLUMN image_url TEXT;
+
+		-- best effort for orders placed before the snapshot, the sale price they were sold at is lost
+		UPDATE line_items
+		SET currency_code = o.currency_code,
+			price = COALESCE((SELECT vp.price FROM variant_prices vp WHERE vp.variant_id = line_items.variant_id AND vp.currency_code = o.currency_code), 0),
+			product_name = p.name,
+			variant_name = pv.name,
+			image_url = p.cover_image_url
+		FROM orders o, product_variants pv, products p
+		WHERE o.id = line_items.order_id AND pv.id = line_items.variant_id AND p.id = pv.product_id;
+	`,
+	},
+	{
+		Version: 10,
+		Name:    "discount_redemptions",
+		query: `
+		ALTER TABLE orders ADD COLUMN discount_amount INTEGER NOT NULL DEFAULT 0;
+
+		CREATE TABLE discount_redemptions (
+			id INTEGER PRIMARY KEY,
+			discount_id INTEGER NOT NULL,
+			order_id INTEGER NOT NULL,
+			status TEXT NOT NULL DEFAULT 'reserved',
+			expires_at TIMESTAMP NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (discount_id) REFERENCES discounts (id),
+			FOREIGN KEY (order_id) REFERENCES orders (id)
+		);
+
+		CREATE UNIQUE INDEX discount_redemptions_order_idx ON discount_redemptions (order_id);
+		CREATE INDEX discount_redemptions_discount_idx ON discount_redemptions (discount_id, status, expires_at);
+	`,
+	},
+	{
+		Version: 11,
+		Name:    "discount_rules",
+		query: `
+		ALTER TABLE discounts ADD COLUMN min_subtotal INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE discounts ADD COLUMN once_per_customer BOOLEAN NOT NULL DEFAULT FALSE;
+
+		CREATE TABLE discount_amounts (
+			id INTEGER PRIMARY KEY,
+			discount_id INTEGER NOT NULL,
+			currency_code TEXT NOT NULL,
+			value INTEGER NOT NULL,
+			min_subtotal INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY (discount_id) REFERENCES discounts (id),
+			UNIQUE(discount_id, currency_code)
+		);
+
+		CREATE TABLE discount_products (
+			discount_id INTEGER NOT NULL,
+			product_id INTEGER NOT NULL,
+			FOREIGN KEY (discount_id) REFERENCES discounts (id),
+			FOREIGN KEY (product_id) REFERENCES products (id),
+			UNIQUE(discount_id, product_id)
+		);
+
+		CREATE TABLE discount_categories (
+			discount_id INTEGER NOT NULL,
+			category_id INTEGER NOT NULL,
+			FOREIGN KEY (discount_id) REFERENCES discounts (id),
+			FOREIGN KEY (category_id) REFERENCES product_categories (id),
+			UNIQUE(discount_id, category_id)
+		);
+	`,
+	},
+	{
+		Version: 12,
+		Name:    "discount_code_nocase",
+		query: `
+		CREATE UNIQUE INDEX discounts_code_nocase_idx ON discounts (UPPER(code));
+	`,
+	},
+	{
+		Version: 13,
+		Name:    "category_admin",
+		query: `
+		ALTER TABLE product_categories ADD COLUMN handle TEXT;
+		ALTER TABLE product_categories ADD COLUMN position INTEGER NOT NULL DEFAULT 0;
+
+		UPDATE product_categories SET handle = LOWER(REPLACE(TRIM(name), ' ', '-')) || '-' || id WHERE handle IS NULL;
+
+		CREATE UNIQUE INDEX product_categories_handle_idx ON product_categories (handle);
+		CREATE INDEX product_category_products_category_idx ON product_category_products (category_id);
+
+		CREATE TABLE category_translations (
+			id INTEGER PRIMARY KEY,
+			category_id INTEGER NOT NULL,
+			language TEXT NOT NULL,
+			name TEXT NOT NULL,
+			FOREIGN KEY (category_id) REFERENCES product_categories (id),
+			UNIQUE(category_id, language)
+		);
+	`,
+	},
+	{
+		Version: 14,
+		Name:    "product_search",
+		query: `
+		CREATE VIRTUAL TABLE product_search USING fts5(
+			product_id UNINDEXED,
+			language UNINDEXED,
+			name,
+			description,
+			materials,
+			tokenize = 'unicode61 remove_diacritics 2'
+		);
+
+		INSERT INTO product_search (product_id, language, name, description, materials)
+		SELECT id, '', name, description, materials FROM products;
+
+		INSERT INTO product_search (product_id, language, name, description, materials)
+		SELECT product_id, language, name, description, materials FROM product_translations;
+
+		CREATE TRIGGER products_search_insert AFTER INSERT ON products BEGIN
+			INSERT INTO product_search (product_id, language, name, description, materials)
+			VALUES (new.id, '', new.name, new.description, new.materials);
+		END;
+
+		CREATE TRIGGER products_search_update AFTER UPDATE OF name, description, materials ON products BEGIN
+			DELETE FROM product_search WHERE product_id = old.id AND language = '';
+			INSERT INTO product_search (product_id, language, name, description, materials)
+			VALUES (new.id, '', new.name, new.description, new.materials);
+		END;
+
+		CREATE TRIGGER products_search_delete AFTER DELETE ON products BEGIN
+			DELETE FROM product_search WHERE product_id = old.id;
+		END;
+
+		CREATE TRIGGER product_translations_search_insert AFTER INSERT ON product_translations BEGIN
+			INSERT INTO product_search (product_id, language, name, description, materials)
+			VALUES (new.product_id, new.language, new.name, new.description, new.materials);
+		END;
+
+		CREATE TRIGGER product_translations_search_update AFTER UPDATE ON product_translations BEGIN
+			DELETE FROM product_search WHERE product_id = old.product_id AND language = old.language;
+			INSERT INTO product_search (product_id, language, name, description, materials)
+			VALUES (new.product_id, new.language, new.name, new.description, new.materials);
+		END;
+
+		CREATE TRIGGER product_translations_search_delete AFTER DELETE ON product_translations BEGIN
+			DELETE FROM product_search WHERE product_id = old.product_id AND language = old.language;
+		END;
+	`,
+	},
+	{
+		Version: 15,
+		Name:    "admin_list_indexes",
+		query: `
+		CREATE INDEX orders_customer_idx ON orders (customer_id);
+		CREATE INDEX orders_status_idx ON orders (status);
+		CREATE INDEX orders_payment_status_idx ON orders (payment_status);
+	`,
+	},
+	{
+		Version: 16,
+		Name:    "user_roles",
+		query: `
+		-- every admin used to have full access: the first one becomes the
+		-- owner, the others managers, who can do everything but manage users
+		UPDATE users SET role = 'manager' WHERE role NOT IN ('owner', 'manager', 'fulfillment', 'viewer');
+		UPDATE users SET role = 'owner'
+		WHERE id = (SELECT MIN(id) FROM users WHERE deleted_at IS NULL)
+		  AND NOT EXISTS (SELECT 1 FROM users WHERE role = 'owner');
+	`,
+	},
+	{
+		Version: 17,
+		Name:    "admin_sessions",
+		query: `
+		CREATE TABLE admin_sessions (
+			id INTEGER PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			ip TEXT NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			last_used_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		);
+
+		CREATE INDEX admin_sessions_user_idx ON admin_sessions (user_id);
+	`,
+	},
+	{
+		Version: 18,
+		Name:    "user_invitations_password_resets",
+		query: `
+		CREATE TABLE user_invitations (
+			id INTEGER PRIMARY KEY,
+			email TEXT NOT NULL,
+			name TEXT,
+			role TEXT NOT NULL,
+			invited_by INTEGER,
+			token_hash TEXT NOT NULL UNIQUE,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP NOT NULL,
+			accepted_at TIMESTAMP,
+			FOREIGN KEY (invited_by) REFERENCES users (id)
+		);
+
+		CREATE INDEX user_invitations_email_idx ON user_invitations (email);
+
+		CREATE TABLE password_resets (
+			id INTEGER PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP NOT NULL,
+			used_at TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		);
+
+		CREATE INDEX password_resets_user_idx ON password_resets (user_id);
+	`,
+	},
+	{
+		Version: 19,
+		Name:    "auth_events",
+		query: `
+		CREATE TABLE auth_events (
+			id INTEGER PRIMARY KEY,
+			user_id INTEGER,
+			email TEXT NOT NULL,
+			event TEXT NOT NULL,
+			ip TEXT NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		);
+
+		CREATE INDEX auth_events_email_idx ON auth_events (email, event, created_at);
+		CREATE INDEX auth_events_ip_idx ON auth_events (ip, event, created_at);
+	`,
+	},
+	{
+		Version: 20,
+		Name:    "two_factor",
+		query: `
+		ALTER TABLE users ADD COLUMN totp_secret TEXT;
+		ALTER TABLE users ADD COLUMN totp_enabled_at TIMESTAMP;
+		ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+
+		CREATE TABLE recovery_codes (
+			id INTEGER PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			code_hash TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			used_at TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users (id),
+			UNIQUE (user_id, code_hash)
+		);
+
+		CREATE TABLE sign_in_challenges (
+			id INTEGER PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP NOT NULL,
+			completed_at TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		);
+
+		CREATE TABLE admin_settings (
+			id INTEGER PRIMARY KEY CHECK (id = 1),
+			two_factor_required BOOLEAN NOT NULL DEFAULT FALSE
+		);
+
+		INSERT INTO admin_settings (id) VALUES (1);
+	`,
+	},
+	{
+		Version: 21,
+		Name:    "order_payments",
+		query: `
+		CREATE TABLE order_payments (
+			id INTEGER PRIMARY KEY,
+			order_id INTEGER NOT NULL,
+			provider TEXT NOT NULL,
+			payment_id TEXT,
+			redirect_url TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (order_id) REFERENCES orders (id),
+			UNIQUE (provider, payment_id)
+		);
+
+		CREATE INDEX order_payments_order_idx ON order_payments (order_id, created_at);
+		CREATE INDEX order_payments_payment_idx ON order_payments (payment_id);
+
+		INSERT INTO order_payments (order_id, provider, payment_id, created_at)
+		SELECT id, payment_provider, payment_id, created_at
+		FROM orders
+		WHERE payment_id IS NOT NULL;
+	`,
+	},
+}
+
+func (s Storage) createMigrationsTable() error {
+	query := `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+	`
+
+	_, err := s.db.Exec(query)
+
+	return err
+}
+
+func (s Storage) appliedMigrations() (map[int]time.Time, error) {
+	rows, err := s.db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// ListMigrations returns every known migration with AppliedAt set for the
+// ones already recorded in schema_migrations.
+func (s Storage) ListMigrations() ([]Migration, error) {
+	if err := s.createMigrationsTable(); err != nil {
+		return nil, err
+	}
+
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]Migration, 0, len(migrations))
+
+	for i, m := range migrations {
+		if i > 0 && m.Version <= migrations[i-1].Version {
+			return nil, fmt.Errorf("migration %d is out of order", m.Version)
+		}
+
+		if at, ok := applied[m.Version]; ok {
+			m.AppliedAt = &at
+		}
+
+		res = append(res, m)
+	}
+
+	return res, nil
+}
+
+// PendingMigrations returns the migrations that have not been applied yet
+// without running them.
+func (s Storage) PendingMigrations() ([]Migration, error) {
+	all, err := s.ListMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]Migration, 0)
+
+	for _, m := range all {
+		if m.AppliedAt == nil {
+			pending = append(pending, m)
+		}
+	}
+
+	return pending, nil
+}
+
+// Migrate applies pending migrations in version order, each one in its own
+// transaction, and returns the migrations that were applied.
+func (s Storage) Migrate() ([]Migration, error) {
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make([]Migration, 0, len(pending))
+
+	for _, m := range pending {
+		if err := s.applyMigration(m); err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+
+		now := time.Now()
+		m.AppliedAt = &now
+		applied = append(applied, m)
+	}
+
+	return applied, nil
+}
+
+func (s Storage) applyMigration(m Migration) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.query); err != nil {
+		return err
+	}
 
-	if _, err := s.db.Exec(createTableQuery); err != nil {
+	if _, err := tx.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name); err != nil {
 		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
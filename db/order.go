@@ -35,17 +35,18 @@ func (o Object) Value() (driver.Value, error) {
 type PaymentStatus string
 
 const (
-	PaymentPending    PaymentStatus = "pending"
-	PaymentProcessing PaymentStatus = "processing"
-	PaymentPaid       PaymentStatus = "paid"
-	PaymentFailed     PaymentStatus = "failed"
-	PaymentCanceled   PaymentStatus = "canceled"
-	PaymentRefunded   PaymentStatus = "refunded"
+	PaymentPending           PaymentStatus = "pending"
+	PaymentProcessing        PaymentStatus = "processing"
+	PaymentPaid              PaymentStatus = "paid"
+	PaymentFailed            PaymentStatus = "failed"
+	PaymentCanceled          PaymentStatus = "canceled"
+	PaymentRefunded          PaymentStatus = "refunded"
+	PaymentPartiallyRefunded PaymentStatus = "partially_refunded"
 )
 
 var ValidPaymentStatuses = []PaymentStatus{
 	PaymentPending, PaymentProcessing, PaymentPaid, PaymentFailed, PaymentCanceled,
-	PaymentRefunded,
+	PaymentRefunded, PaymentPartiallyRefunded,
 }
 
 func (status PaymentStatus) IsValid() error {
@@ -57,6 +58,28 @@ func (status PaymentStatus) IsValid() error {
 	return errors.New("invalid payment status")
 }
 
+// PaymentTransitions lists the payment statuses an order may move to from
+// each status. Anything else, e.g. a late "incomplete" callback for a paid
+// order, is a regression and is refused.
+var PaymentTransitions = map[PaymentStatus][]PaymentStatus{
+	PaymentPending:           {PaymentProcessing, PaymentPaid, PaymentFailed, PaymentCanceled},
+	PaymentProcessing:        {PaymentPaid, PaymentFailed, PaymentCanceled},
+	PaymentFailed:            {PaymentPaid},
+	PaymentCanceled:          {PaymentPaid},
+	PaymentPaid:              {PaymentPartiallyRefunded, PaymentRefunded},
+	PaymentPartiallyRefunded: {PaymentRefunded},
+	PaymentRefunded:          {},
+}
+
+func (status PaymentStatus) CanTransitionTo(next PaymentStatus) bool {
+	for _, v := range PaymentTransitions[status] {
+		if v == next {
+			return true
+		}
+	}
+	return false
+}
+
 type OrderStatus string
 
 const (
@@ -90,24 +113,56 @@ func (status OrderStatus) IsValid() error {
 	return errors.New("invalid order status")
 }
 
+// OrderTransitions lists the statuses an order may move to from each status.
+// Made-to-order dresses go through production and assembly; stock items can
+// skip straight to ready.
+var OrderTransitions = map[OrderStatus][]OrderStatus{
+	OrderNew:           {OrderApproved, OrderWaiting, OrderProduction, OrderReady, OrderOutOfStock, OrderCancelled},
+	OrderApproved:      {OrderWaiting, OrderProduction, OrderReady, OrderCancelled},
+	OrderWaiting:       {OrderApproved, OrderProduction, OrderCancelled},
+	OrderProduction:    {OrderWaiting, OrderAssembled, OrderCancelled},
+	OrderAssembled:     {OrderProduction, OrderReady},
+	OrderReady:         {OrderShipping, OrderReadyToPickup},
+	OrderShipping:      {OrderShipped, OrderReturned},
+	OrderShipped:       {OrderCompleted, OrderReturned},
+	OrderReadyToPickup: {OrderCompleted, OrderCancelled},
+	OrderCompleted:     {OrderReturned},
+	OrderReturned:      {OrderRefunded},
+	OrderOutOfStock:    {OrderWaiting, OrderProduction, OrderCancelled, OrderRefunded},
+	OrderCancelled:     {OrderRefunded},
+	OrderRefunded:      {},
+}
+
+func (status OrderStatus) CanTransitionTo(next OrderStatus) bool {
+	for _, v := range OrderTransitions[status] {
+		if v == next {
+			return true
+		}
+	}
+	return false
+}
+
 type Order struct {
-	ID              int64         `db:"id" json:"id"`
-	CustomerID      int64         `db:"customer_id" json:"customer_id"`
-	CartID          int64         `db:"cart_id" json:"cart_id"`
-	Status          OrderStatus   `db:"status" json:"status"`
-	PaymentStatus   PaymentStatus `db:"payment_status" json:"payment_status"`
-	Total           int           `db:"total" json:"total"`
-	Subtotal        int           `db:"subtotal" json:"subtotal"`
-	DiscountID      *int64        `db:"discount_id" json:"discount_id"`
-	CurrencyCode    string        `db:"currency_code" json:"currency_code"`
-	Metadata        Object        `db:"metadata" json:"metadata"`
-	CreatedAt       time.Time     `db:"created_at" json:"created_at"`
-	UpdatedAt       time.Time     `db:"updated_at" json:"updated_at"`
-	DeletedAt       *time.Time    `db:"deleted_at" json:"deleted_at"`
-	PaymentID       *string       `db:"payment_id" json:"payment_id"`
-	PaymentProvider string        `db:"payment_provider" json:"payment_provider"`
-	Customer        *Customer     `json:"customer"`
-	Items           []LineItem    `json:"items"`
+	ID               int64           `db:"id" json:"id"`
+	CustomerID       int64           `db:"customer_id" json:"customer_id"`
+	CartID           int64           `db:"cart_id" json:"cart_id"`
+	Status           OrderStatus     `db:"status" json:"status"`
+	PaymentStatus    PaymentStatus   `db:"payment_status" json:"payment_status"`
+	Total            int             `db:"total" json:"total"`
+	Subtotal         int             `db:"subtotal" json:"subtotal"`
+	DiscountID       *int64          `db:"discount_id" json:"discount_id"`
+	DiscountAmount   int             `db:"discount_amount" json:"discount_amount"`
+	CurrencyCode     string          `db:"currency_code" json:"currency_code"`
+	Metadata         Object          `db:"metadata" json:"metadata"`
+	CreatedAt        time.Time       `db:"created_at" json:"created_at"`
+	UpdatedAt        time.Time       `db:"updated_at" json:"updated_at"`
+	DeletedAt        *time.Time      `db:"deleted_at" json:"deleted_at"`
+	PaymentID        *string         `db:"payment_id" json:"payment_id"`
+	PaymentProvider  string          `db:"payment_provider" json:"payment_provider"`
+	Customer         *Customer       `json:"customer"`
+	Items            []LineItem      `json:"items"`
+	ShippingMethodID *int64          `db:"shipping_method_id" json:"shipping_method_id"`
+	ShippingMethod   *ShippingMethod `json:"shipping_method"`
 }
 
 func (o *Order) ToString() string {
@@ -123,8 +178,11 @@ func (o *Order) ToString() string {
 }
 
 type GetOrderQuery struct {
-	ID        *int64
+	ID *int64
+	// PaymentID finds the order by any of the payments started for it.
 	PaymentID *string
+	// CartID finds the latest order placed from the cart.
+	CartID *int64
 }
 
 func (s Storage) GetOrder(params GetOrderQuery) (*Order, error) {
@@ -135,6 +193,7 @@ func (s Storage) GetOrder(params GetOrderQuery) (*Order, error) {
 			   o.customer_id,
 			   o.cart_id,
 			   o.discount_id,
+			   o.discount_amount,
 			   o.status,
 			   o.payment_status,
 			   o.total,
@@ -145,7 +204,8 @@ func (s Storage) GetOrder(params GetOrderQuery) (*Order, error) {
 			   o.currency_code,
 			   o.metadata,
 			   o.payment_id,
-			   o.payment_provider
+			   o.payment_provider,
+			   o.shipping_method_id
 		FROM orders o`
 
 	var args []interface{}
@@ -153,10 +213,13 @@ func (s Storage) GetOrder(params GetOrderQuery) (*Order, error) {
 		query += " WHERE o.id = ?"
 		args = append(args, *params.ID)
 	} else if params.PaymentID != nil {
-		query += " WHERE o.payment_id = ?"
-		args = append(args, *params.PaymentID)
+		query += " WHERE o.payment_id = ? OR o.id = (SELECT order_id FROM order_payments WHERE payment_id = ? LIMIT 1)"
+		args = append(args, *params.PaymentID, *params.PaymentID)
+	} else if params.CartID != nil {
+		query += " WHERE o.cart_id = ? ORDER BY o.id DESC LIMIT 1"
+		args = append(args, *params.CartID)
 	} else {
-		return nil, errors.New("either ID or PaymentID must be provided")
+		return nil, errors.New("either ID, PaymentID or CartID must be provided")
 	}
 
 	row := s.db.QueryRow(query, args...)
@@ -166,6 +229,7 @@ func (s Storage) GetOrder(params GetOrderQuery) (*Order, error) {
 		&order.CustomerID,
 		&order.CartID,
 		&order.DiscountID,
+		&order.DiscountAmount,
 		&order.Status,
 		&order.PaymentStatus,
 		&order.Total,
@@ -177,6 +241,7 @@ func (s Storage) GetOrder(params GetOrderQuery) (*Order, error) {
 		&order.Metadata,
 		&order.PaymentID,
 		&order.PaymentProvider,
+		&order.ShippingMethodID,
 	)
 
 	if err != nil && IsNoRowsError(err) {
@@ -191,25 +256,27 @@ func (s Storage) GetOrder(params GetOrderQuery) (*Order, error) {
 		return nil, err
 	}
 
-	itemsParams := LineItemQuery{
-		OrderID:  order.ID,
-		Currency: order.CurrencyCode,
-		Locale:   "en",
-	}
-
-	order.Items, err = s.GetLineItems(itemsParams)
+	order.Items, err = s.getOrderItems(order.ID)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if order.ShippingMethodID != nil {
+		order.ShippingMethod, err = s.GetShippingMethod(*order.ShippingMethodID, order.CurrencyCode)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return order, nil
 }
 
 func (s Storage) CreateOrder(o Order) (*Order, error) {
 	query := `
-		INSERT INTO orders (customer_id, cart_id, status, payment_status, total, subtotal, discount_id, currency_code, metadata, payment_id, payment_provider)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+		INSERT INTO orders (customer_id, cart_id, status, payment_status, total, subtotal, discount_id, discount_amount, currency_code, metadata, payment_id, payment_provider, shipping_method_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
 	`
 
 	res, err := s.db.Exec(query,
@@ -220,10 +287,12 @@ func (s Storage) CreateOrder(o Order) (*Order, error) {
 		o.Total,
 		o.Subtotal,
 		o.DiscountID,
+		o.DiscountAmount,
 		o.CurrencyCode,
 		o.Metadata,
 		o.PaymentID,
 		o.PaymentProvider,
+		o.ShippingMethodID,
 	)
 
 	if err != nil {
@@ -254,14 +323,112 @@ func (s Storage) UpdateOrder(o *Order) (*Order, error) {
 	return s.GetOrder(GetOrderQuery{ID: &o.ID})
 }
 
-func (s Storage) ListOrders() ([]Order, error) {
-	orders := make([]Order, 0)
+// UndoCheckout takes back an order whose payment couldn't be started: the
+// order is cancelled, which releases its reservations, its items go back to
+// the cart and the cart is reopened in the currency it had before. The order
+// is kept, so that its ID isn't reused while the provider may still know it.
+// ErrNotFound is returned if the order doesn't exist or a payment was
+// already recorded for it.
+func (s Storage) UndoCheckout(orderID int64, cartCurrency string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+		SELECT cart_id
+		FROM orders o
+		WHERE id = ? AND payment_status = ?
+		  AND NOT EXISTS (SELECT 1 FROM payment_events WHERE order_id = o.id)
+		  AND NOT EXISTS (SELECT 1 FROM order_payments WHERE order_id = o.id)
+	`
+
+	var cartID int64
+	err = tx.QueryRow(query, orderID, PaymentPending).Scan(&cartID)
+
+	if IsNoRowsError(err) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	note := "the payment couldn't be started, the items went back to the cart"
+	if err := updateOrderStatus(tx, orderID, OrderCancelled, nil, &note); err != nil {
+		return err
+	}
+
+	query = `
+		UPDATE orders
+		SET payment_status = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+
+	if _, err := tx.Exec(query, PaymentCanceled, orderID); err != nil {
+		return err
+	}
+
+	query = `
+		UPDATE line_items
+		SET order_id = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE order_id = ?
+	`
+
+	if _, err := tx.Exec(query, orderID); err != nil {
+		return err
+	}
+
+	query = `
+		UPDATE cart
+		SET completed_at = NULL, currency_code = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+
+	if _, err := tx.Exec(query, cartCurrency, cartID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ListOrders returns a page of the orders, newest first, with their
+// customers and items. Orders are filtered by status, payment status,
+// provider, creation time and customer email.
+func (s Storage) ListOrders(q ListQuery) (*Page[Order], error) {
+	from := "orders o JOIN customers c ON c.id = o.customer_id"
+
+	var f filter
+	if q.Status != "" {
+		f.add("o.status = ?", q.Status)
+	}
+
+	if q.PaymentStatus != "" {
+		f.add("o.payment_status = ?", q.PaymentStatus)
+	}
+
+	if q.Provider != "" {
+		f.add("o.payment_provider = ?", q.Provider)
+	}
+
+	f.created("o.created_at", q)
+	f.email("c.email", q)
+
+	total, err := s.count(from, f)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.after("o.id", q.Cursor); err != nil {
+		return nil, err
+	}
 
 	query := `
 		SELECT o.id,
 			   o.customer_id,
 			   o.cart_id,
 			   o.discount_id,
+			   o.discount_amount,
 			   o.status,
 			   o.payment_status,
 			   o.total,
@@ -272,24 +439,40 @@ func (s Storage) ListOrders() ([]Order, error) {
 			   o.currency_code,
 			   o.metadata,
 			   o.payment_id,
-			   o.payment_provider
-		FROM orders o
-		ORDER BY o.created_at DESC;
+			   o.payment_provider,
+			   o.shipping_method_id,
+			   c.id,
+			   c.name,
+			   c.email,
+			   c.phone,
+			   c.country,
+			   c.address,
+			   c.zip,
+			   c.created_at,
+			   c.updated_at,
+			   c.deleted_at
+		FROM ` + from + f.where() + `
+		ORDER BY o.id DESC
+		LIMIT ?
 	`
 
-	rows, err := s.db.Query(query)
+	rows, err := s.db.Query(query, append(f.args, q.PageLimit()+1)...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	orders := make([]Order, 0)
+
 	for rows.Next() {
-		order := new(Order)
+		var order Order
+		customer := new(Customer)
 		err := rows.Scan(
 			&order.ID,
 			&order.CustomerID,
 			&order.CartID,
 			&order.DiscountID,
+			&order.DiscountAmount,
 			&order.Status,
 			&order.PaymentStatus,
 			&order.Total,
@@ -301,32 +484,46 @@ func (s Storage) ListOrders() ([]Order, error) {
 			&order.Metadata,
 			&order.PaymentID,
 			&order.PaymentProvider,
+			&order.ShippingMethodID,
+			&customer.ID,
+			&customer.Name,
+			&customer.Email,
+			&customer.Phone,
+			&customer.Country,
+			&customer.Address,
+			&customer.ZIP,
+			&customer.CreatedAt,
+			&customer.UpdatedAt,
+			&customer.DeletedAt,
 		)
 
 		if err != nil {
 			return nil, err
 		}
 
-		order.Customer, err = s.GetCustomerByID(order.CustomerID)
+		order.Customer = customer
+		orders = append(orders, order)
+	}
 
-		if err != nil {
-			return nil, err
-		}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-		itemsParams := LineItemQuery{
-			OrderID:  order.ID,
-			Currency: order.CurrencyCode,
-			Locale:   "en",
-		}
+	page := newPage(orders, q.PageLimit(), total, func(o Order) int64 { return o.ID })
 
-		order.Items, err = s.GetLineItems(itemsParams)
+	orderIDs := make([]int64, len(page.Items))
+	for i, o := range page.Items {
+		orderIDs[i] = o.ID
+	}
 
-		if err != nil {
-			return nil, err
-		}
+	items, err := s.listOrderItems(orderIDs)
+	if err != nil {
+		return nil, err
+	}
 
-		orders = append(orders, *order)
+	for i := range page.Items {
+		page.Items[i].Items = items[page.Items[i].ID]
 	}
 
-	return orders, nil
+	return page, nil
 }
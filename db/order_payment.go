@@ -0,0 +1,100 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// PaymentLinkTTL is how long a payment started at checkout is handed out
+// again when the cart is checked out once more, well within the time the
+// providers keep it open, e.g. 3 hours for PayPal orders.
+const PaymentLinkTTL = time.Hour
+
+// OrderPayment is a payment started with the provider for an order. An order
+// may have several when the customer came back after the earlier ones
+// expired, any of them can still be paid.
+type OrderPayment struct {
+	ID       int64  `db:"id" json:"id"`
+	OrderID  int64  `db:"order_id" json:"order_id"`
+	Provider string `db:"provider" json:"provider"`
+	// PaymentID is the provider's reference, nil if the provider only
+	// assigns one once the customer pays.
+	PaymentID   *string   `db:"payment_id" json:"payment_id"`
+	RedirectURL string    `db:"redirect_url" json:"redirect_url"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+}
+
+// AddOrderPayment records a payment started for an unpaid order and makes
+// it the order's current one. ErrNotFound is returned if the order doesn't
+// exist or its payment has moved on.
+func (s Storage) AddOrderPayment(p OrderPayment) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+		UPDATE orders
+		SET payment_id = COALESCE(?, payment_id), updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND payment_status = ?
+	`
+
+	res, err := tx.Exec(query, p.PaymentID, p.OrderID, PaymentPending)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	query = `
+		INSERT INTO order_payments (order_id, provider, payment_id, redirect_url)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (provider, payment_id) DO NOTHING
+	`
+
+	if _, err := tx.Exec(query, p.OrderID, p.Provider, p.PaymentID, p.RedirectURL); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetOpenOrderPayment returns the latest payment of the order with the
+// provider started less than PaymentLinkTTL ago, ErrNotFound if there is
+// none.
+func (s Storage) GetOpenOrderPayment(orderID int64, provider string) (*OrderPayment, error) {
+	var p OrderPayment
+
+	query := `
+		SELECT id, order_id, provider, payment_id, redirect_url, created_at
+		FROM order_payments
+		WHERE order_id = ? AND provider = ? AND created_at > datetime('now', ?)
+		ORDER BY id DESC
+		LIMIT 1
+	`
+
+	since := fmt.Sprintf("-%d seconds", int(PaymentLinkTTL.Seconds()))
+
+	err := s.db.QueryRow(query, orderID, provider, since).Scan(
+		&p.ID,
+		&p.OrderID,
+		&p.Provider,
+		&p.PaymentID,
+		&p.RedirectURL,
+		&p.CreatedAt,
+	)
+
+	if err != nil && IsNoRowsError(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
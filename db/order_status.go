@@ -0,0 +1,123 @@
+package db
+
+import "time"
+
+type OrderStatusChange struct {
+	ID         int64        `db:"id" json:"id"`
+	OrderID    int64        `db:"order_id" json:"order_id"`
+	FromStatus *OrderStatus `db:"from_status" json:"from_status"`
+	ToStatus   OrderStatus  `db:"to_status" json:"to_status"`
+	UserID     *int64       `db:"user_id" json:"user_id"`
+	UserName   *string      `db:"user_name" json:"user_name"`
+	UserEmail  *string      `db:"user_email" json:"user_email"`
+	Note       *string      `db:"note" json:"note"`
+	CreatedAt  time.Time    `db:"created_at" json:"created_at"`
+}
+
+// UpdateOrderStatus moves an order to a new status if OrderTransitions allows
+// it and records the change in order_status_history. userID is nil for
+// changes made by the system.
+func (s Storage) UpdateOrderStatus(orderID int64, status OrderStatus, userID *int64, note *string) error {
+	if err := status.IsValid(); err != nil {
+		return ErrInvalidStatusTransition
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := updateOrderStatus(tx, orderID, status, userID, note); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func updateOrderStatus(q querier, orderID int64, status OrderStatus, userID *int64, note *string) error {
+	var current OrderStatus
+	err := q.QueryRow("SELECT status FROM orders WHERE id = ?", orderID).Scan(&current)
+
+	if IsNoRowsError(err) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if !current.CanTransitionTo(status) {
+		return ErrInvalidStatusTransition
+	}
+
+	if _, err := q.Exec("UPDATE orders SET status = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", status, orderID); err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO order_status_history (order_id, from_status, to_status, user_id, note)
+		VALUES (?, ?, ?, ?, ?)
+	`
+
+	if _, err := q.Exec(query, orderID, current, status, userID, note); err != nil {
+		return err
+	}
+
+	if status == OrderCancelled || status == OrderRefunded {
+		if err := releaseOrderStock(q, orderID); err != nil {
+			return err
+		}
+
+		return releaseOrderDiscount(q, orderID)
+	}
+
+	return nil
+}
+
+func (s Storage) ListOrderStatusHistory(orderID int64) ([]OrderStatusChange, error) {
+	query := `
+		SELECT h.id,
+			   h.order_id,
+			   h.from_status,
+			   h.to_status,
+			   h.user_id,
+			   u.name,
+			   u.email,
+			   h.note,
+			   h.created_at
+		FROM order_status_history h
+		LEFT JOIN users u ON h.user_id = u.id
+		WHERE h.order_id = ?
+		ORDER BY h.created_at, h.id
+	`
+
+	rows, err := s.db.Query(query, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	history := make([]OrderStatusChange, 0)
+
+	for rows.Next() {
+		var h OrderStatusChange
+		if err := rows.Scan(
+			&h.ID,
+			&h.OrderID,
+			&h.FromStatus,
+			&h.ToStatus,
+			&h.UserID,
+			&h.UserName,
+			&h.UserEmail,
+			&h.Note,
+			&h.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		history = append(history, h)
+	}
+
+	return history, nil
+}
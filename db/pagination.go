@@ -0,0 +1,147 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 100
+)
+
+// ListQuery is the paging and filtering shared by the admin lists. Every
+// list applies the filters that make sense for it and ignores the rest.
+type ListQuery struct {
+	// Limit is DefaultPageLimit if not set. Cursor is the NextCursor of the
+	// previous page.
+	Limit  int
+	Cursor string
+	// Status is the order status for orders, "active" or "inactive" for
+	// discounts, "published" or "draft" for products and the event for auth
+	// events.
+	Status        string
+	PaymentStatus string
+	Provider      string
+	// CreatedFrom and CreatedTo bound the creation time, To is exclusive.
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	// Email matches part of the customer's or the user's email.
+	Email string
+}
+
+// PageLimit is the number of rows on a page.
+func (q ListQuery) PageLimit() int {
+	if q.Limit <= 0 {
+		return DefaultPageLimit
+	}
+
+	return min(q.Limit, MaxPageLimit)
+}
+
+// Page is a page of a list, newest first unless the list says otherwise.
+type Page[T any] struct {
+	Items []T `json:"items"`
+	// NextCursor is empty on the last page.
+	NextCursor string `json:"next_cursor"`
+	// Total is the number of matching rows on all pages.
+	Total int `json:"total"`
+}
+
+// idCursor is where a page of a list ordered by ID ends.
+type idCursor struct {
+	ID int64 `json:"id"`
+}
+
+func encodeCursor(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(cursor string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || json.Unmarshal(b, v) != nil {
+		return ErrInvalidCursor
+	}
+
+	return nil
+}
+
+// newPage makes a page out of the rows of a list ordered by ID. One more row
+// than the limit is fetched to tell if there is a next page.
+func newPage[T any](items []T, limit, total int, id func(T) int64) *Page[T] {
+	page := &Page[T]{Items: items, Total: total}
+
+	if len(items) > limit {
+		page.Items = items[:limit]
+		page.NextCursor = encodeCursor(idCursor{ID: id(items[limit-1])})
+	}
+
+	return page
+}
+
+// filter collects the conditions of a list query and their arguments.
+type filter struct {
+	conds []string
+	args  []interface{}
+}
+
+func (f *filter) add(cond string, args ...interface{}) {
+	f.conds = append(f.conds, cond)
+	f.args = append(f.args, args...)
+}
+
+func (f filter) where() string {
+	if len(f.conds) == 0 {
+		return ""
+	}
+
+	return " WHERE " + strings.Join(f.conds, " AND ")
+}
+
+// created adds the ListQuery creation time range on the column.
+func (f *filter) created(column string, q ListQuery) {
+	if q.CreatedFrom != nil {
+		f.add(fmt.Sprintf("datetime(%s) >= datetime(?)", column), q.CreatedFrom.UTC().Format(time.DateTime))
+	}
+
+	if q.CreatedTo != nil {
+		f.add(fmt.Sprintf("datetime(%s) < datetime(?)", column), q.CreatedTo.UTC().Format(time.DateTime))
+	}
+}
+
+// email adds a case-insensitive match of part of the ListQuery email.
+func (f *filter) email(column string, q ListQuery) {
+	if q.Email != "" {
+		f.add(fmt.Sprintf("instr(LOWER(%s), LOWER(?)) > 0", column), q.Email)
+	}
+}
+
+// after narrows a list ordered by the ID column descending down to the rows
+// after the cursor.
+func (f *filter) after(idColumn, cursor string) error {
+	if cursor == "" {
+		return nil
+	}
+
+	var c idCursor
+	if err := decodeCursor(cursor, &c); err != nil || c.ID == 0 {
+		return ErrInvalidCursor
+	}
+
+	f.add(idColumn+" < ?", c.ID)
+
+	return nil
+}
+
+// count returns the number of rows the filter matches, from is the FROM
+// clause of the list query.
+func (s Storage) count(from string, f filter) (int, error) {
+	var total int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM "+from+f.where(), f.args...).Scan(&total)
+
+	return total, err
+}
@@ -0,0 +1,192 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	PaymentEventApplied        = "applied"
+	PaymentEventDuplicate      = "duplicate"
+	PaymentEventUnchanged      = "unchanged"
+	PaymentEventRegression     = "regression"
+	PaymentEventAmountMismatch = "amount_mismatch"
+	PaymentEventOrderNotFound  = "order_not_found"
+	// PaymentEventOutOfStock is a payment applied to an order whose stock was
+	// released and sold meanwhile. The order needs a refund or a restock.
+	PaymentEventOutOfStock = "out_of_stock"
+)
+
+// PaymentEvent is a single notification received from a payment provider.
+// Amount is in minor units (cents, kopecks) as sent by the provider.
+type PaymentEvent struct {
+	ID            int64         `db:"id" json:"id"`
+	Provider      string        `db:"provider" json:"provider"`
+	TransactionID string        `db:"transaction_id" json:"transaction_id"`
+	OrderID       *int64        `db:"order_id" json:"order_id"`
+	Status        string        `db:"status" json:"status"`
+	PaymentStatus PaymentStatus `db:"payment_status" json:"payment_status"`
+	PaymentID     *string       `db:"-" json:"-"`
+	Amount        int           `db:"amount" json:"amount"`
+	CurrencyCode  string        `db:"currency_code" json:"currency_code"`
+	RawBody       string        `db:"raw_body" json:"raw_body"`
+	Result        string        `db:"result" json:"result"`
+	CreatedAt     time.Time     `db:"created_at" json:"created_at"`
+}
+
+// ProcessPaymentEvent stores the event and, in the same transaction, applies
+// its payment status to the order and commits or releases the reserved stock
+// and discount redemption. A payment whose stock is gone is applied with the
+// PaymentEventOutOfStock result.
+// Replays of an applied transaction, payment status regressions and paid
+// amounts or currencies that don't match the order are recorded but not
+// applied. Refunds are applied through the refunds table. The returned event
+// carries the result of processing.
+func (s Storage) ProcessPaymentEvent(e PaymentEvent) (*PaymentEvent, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	var order struct {
+		status   PaymentStatus
+		total    int
+		currency string
+	}
+
+	if e.OrderID != nil {
+		err = tx.QueryRow("SELECT payment_status, total, currency_code FROM orders WHERE id = ?", *e.OrderID).Scan(
+			&order.status,
+			&order.total,
+			&order.currency,
+		)
+
+		if IsNoRowsError(err) {
+			e.Result = PaymentEventOrderNotFound
+			e.OrderID = nil
+		} else if err != nil {
+			return nil, err
+		}
+	} else {
+		e.Result = PaymentEventOrderNotFound
+	}
+
+	// refunds are tracked per refund, an order may be refunded in parts
+	if e.Result == "" && e.PaymentStatus == PaymentRefunded {
+		if e.Result, err = applyRefundEvent(tx, e, order.status); err != nil {
+			return nil, err
+		}
+	}
+
+	if e.Result == "" {
+		var duplicate bool
+		query := `
+			SELECT EXISTS(
+				SELECT 1 FROM payment_events
+				WHERE provider = ? AND transaction_id = ? AND payment_status = ? AND result = ?
+			)
+		`
+
+		if err := tx.QueryRow(query, e.Provider, e.TransactionID, e.PaymentStatus, PaymentEventApplied).Scan(&duplicate); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case duplicate:
+			e.Result = PaymentEventDuplicate
+		case order.status == e.PaymentStatus:
+			e.Result = PaymentEventUnchanged
+		case !order.status.CanTransitionTo(e.PaymentStatus):
+			e.Result = PaymentEventRegression
+		case e.PaymentStatus == PaymentPaid && (e.Amount != order.total*100 || e.CurrencyCode != order.currency):
+			e.Result = PaymentEventAmountMismatch
+		default:
+			e.Result = PaymentEventApplied
+		}
+	}
+
+	if e.Result == PaymentEventApplied && e.PaymentStatus != PaymentRefunded {
+		query := `
+			UPDATE orders
+			SET payment_status = ?, payment_id = COALESCE(?, payment_id), updated_at = CURRENT_TIMESTAMP
+			WHERE id = ?
+		`
+
+		if _, err := tx.Exec(query, e.PaymentStatus, e.PaymentID, *e.OrderID); err != nil {
+			return nil, err
+		}
+
+		switch e.PaymentStatus {
+		case PaymentPaid:
+			err = commitOrderStock(tx, *e.OrderID)
+			if errors.Is(err, ErrOutOfStock) {
+				// the order is kept paid, orders that can't be out of stock,
+				// e.g. cancelled ones, are flagged by the event only
+				e.Result = PaymentEventOutOfStock
+				note := "paid after its stock was released, not enough is left"
+				if err = updateOrderStatus(tx, *e.OrderID, OrderOutOfStock, nil, &note); errors.Is(err, ErrInvalidStatusTransition) {
+					err = nil
+				}
+			}
+
+			if err == nil {
+				err = redeemOrderDiscount(tx, *e.OrderID)
+			}
+		case PaymentFailed, PaymentCanceled:
+			if err = releaseOrderStock(tx, *e.OrderID); err == nil {
+				err = releaseOrderDiscount(tx, *e.OrderID)
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	query := `
+		INSERT INTO payment_events (provider, transaction_id, order_id, status, payment_status, amount, currency_code, raw_body, result)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	res, err := tx.Exec(query, e.Provider, e.TransactionID, e.OrderID, e.Status, e.PaymentStatus, e.Amount, e.CurrencyCode, e.RawBody, e.Result)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.ID, err = res.LastInsertId(); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	e.CreatedAt = time.Now()
+
+	return &e, nil
+}
+
+// GetOrderIDByTransaction finds the order a provider transaction, e.g. a
+// PayPal capture, was recorded against.
+func (s Storage) GetOrderIDByTransaction(provider, transactionID string) (int64, error) {
+	query := `
+		SELECT order_id
+		FROM payment_events
+		WHERE provider = ? AND transaction_id = ? AND order_id IS NOT NULL
+		ORDER BY id DESC
+		LIMIT 1
+	`
+
+	var orderID int64
+	err := s.db.QueryRow(query, provider, transactionID).Scan(&orderID)
+
+	if IsNoRowsError(err) {
+		return 0, ErrNotFound
+	} else if err != nil {
+		return 0, err
+	}
+
+	return orderID, nil
+}
@@ -32,6 +32,22 @@ func (as ArrayString) Value() (driver.Value, error) {
 	return strings.Join(as, ";"), nil
 }
 
+// activeSalePrice returns a scalar subquery selecting the sale price that
+// applies right now to the given variant and currency. When several sale
+// windows overlap the one that started last wins, ties go to the lower price.
+func activeSalePrice(variantID, currencyCode string) string {
+	return fmt.Sprintf(`(
+		SELECT s.sale_price
+		FROM sale_prices s
+		WHERE s.variant_id = %s
+		  AND s.currency_code = %s
+		  AND (s.starts_at IS NULL OR datetime(s.starts_at) <= CURRENT_TIMESTAMP)
+		  AND (s.ends_at IS NULL OR datetime(s.ends_at) > CURRENT_TIMESTAMP)
+		ORDER BY datetime(s.starts_at) DESC, s.sale_price
+		LIMIT 1
+	)`, variantID, currencyCode)
+}
+
 type Prices struct {
 	CurrencyCode   string `json:"currency_code"`
 	CurrencySymbol string `json:"currency_symbol"`
@@ -53,6 +69,9 @@ type Product struct {
 	CreatedAt   time.Time        `json:"created_at"`
 	UpdatedAt   time.Time        `json:"updated_at"`
 	DeletedAt   *time.Time       `json:"deleted_at"`
+	Categories  []Category       `json:"categories"`
+
+	Translations []ProductTranslation `json:"translations,omitempty"`
 }
 
 type ProductVariant struct {
@@ -62,9 +81,18 @@ type ProductVariant struct {
 	Prices    []Prices `json:"prices"`
 }
 
+func setSaleFlags(variants []ProductVariant) {
+	for i := range variants {
+		for j := range variants[i].Prices {
+			p := &variants[i].Prices[j]
+			p.IsOnSale = p.SalePrice != nil && *p.SalePrice < p.Price
+		}
+	}
+}
+
 func listProductQuery() string {
 
-	return `
+	return fmt.Sprintf(`
 		SELECT p.id,
 			   p.handle,
 			   COALESCE(pt.name, p.name)               AS name,
@@ -80,44 +108,249 @@ func listProductQuery() string {
 					   json_object(
 							   'id', pv.id,
 							   'name', pv.name,
-							   'available', pv.available,
+							   'available', MAX(%s, 0),
 							   'prices', (SELECT json_group_array(
 														 json_object(
 																 'currency_code', vp.currency_code,
 																 'currency_symbol', c.symbol,
 																 'price', vp.price,
-																 'sale_price', sp.sale_price
+																 'sale_price', %s
 														 )
 												 )
 										  FROM variant_prices vp
 												   JOIN currencies c ON vp.currency_code = c.code
-												   LEFT JOIN sale_prices sp
-															 ON vp.variant_id = sp.variant_id AND c.code = sp.currency_code
 										  WHERE vp.variant_id = pv.id
 										  GROUP BY vp.variant_id)
 					   )
-			   )                                       AS variants
+			   ) FILTER (WHERE pv.id IS NOT NULL)      AS variants,
+			   (SELECT json_group_array(
+							   json_object('id', pc.id, 'handle', pc.handle, 'name', pc.name, 'position', pc.position)
+					   )
+				FROM (SELECT c.id, c.handle, COALESCE(ct.name, c.name) AS name, c.position
+					  FROM product_category_products cp
+							   JOIN product_categories c ON c.id = cp.category_id AND c.deleted_at IS NULL
+							   LEFT JOIN category_translations ct ON ct.category_id = c.id AND ct.language = ?
+					  WHERE cp.product_id = p.id
+					  ORDER BY c.position, c.id) pc)  AS categories
 		FROM products p
-				 LEFT JOIN product_variants pv ON p.id = pv.product_id
+				 LEFT JOIN product_variants pv ON p.id = pv.product_id AND pv.deleted_at IS NULL
 				 LEFT JOIN product_translations pt ON p.id = pt.product_id AND pt.language = ?
-`
+`, availableStock, activeSalePrice("vp.variant_id", "vp.currency_code"))
 }
 
+const (
+	ProductPublished = "published"
+	ProductDraft     = "draft"
+)
+
+const (
+	SortNewest    = "newest"
+	SortPriceAsc  = "price_asc"
+	SortPriceDesc = "price_desc"
+)
+
 type ListProductsQuery struct {
 	Locale      string
 	IsPublished bool
+	// Status is ProductPublished or ProductDraft for the admin panel.
+	Status      string
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	// Category is the handle of a category to list the products of.
+	Category string
+	// Search is matched against the names, descriptions and materials of
+	// the products in every language.
+	Search string
+	// Currency the prices are filtered and sorted in, by default the one
+	// of the locale. Products without a price in it are left out.
+	Currency string
+	// MinPrice and MaxPrice bound the lowest price of the product's
+	// variants, sale prices included.
+	MinPrice *int
+	MaxPrice *int
+	// InStock leaves out products without an available variant, or without
+	// an available variant of the size if Size is set.
+	InStock bool
+	Size    string
+	// Sort is one of the Sort constants, products are listed in the order
+	// they were added if empty.
+	Sort string
+	// Cursor is the NextCursor of the previous page. Limit 0 lists all.
+	Cursor string
+	Limit  int
 }
 
-func (s Storage) ListProducts(params ListProductsQuery) ([]Product, error) {
-	query := listProductQuery()
+// productCursor is where a page ends: the sort key and ID of its last
+// product.
+type productCursor struct {
+	ID        int64  `json:"id"`
+	Price     int    `json:"price,omitempty"`
+	CreatedAt string `json:"created_at,omitempty"`
+}
+
+// inCategory is the condition for the product aliased as p being in the
+// category whose handle is bound to the placeholder.
+const inCategory = `
+	EXISTS (
+		SELECT 1
+		FROM product_category_products cp
+		JOIN product_categories c ON c.id = cp.category_id
+		WHERE cp.product_id = p.id AND c.handle = ? AND c.deleted_at IS NULL
+	)`
+
+// productPrices selects the lowest price of every product in the currency
+// bound to the placeholder, taking sale prices into account.
+func productPrices() string {
+	return fmt.Sprintf(`
+		SELECT v.product_id, MIN(CASE WHEN sp.sale_price < sp.price THEN sp.sale_price ELSE sp.price END) AS price
+		FROM product_variants v
+		JOIN (
+			SELECT vp.variant_id, vp.price, %s AS sale_price
+			FROM variant_prices vp
+			WHERE vp.currency_code = ?
+		) sp ON sp.variant_id = v.id
+		WHERE v.deleted_at IS NULL
+		GROUP BY v.product_id
+	`, activeSalePrice("vp.variant_id", "vp.currency_code"))
+}
 
-	if params.IsPublished {
-		query += " WHERE p.is_published = TRUE"
+// searchQuery turns what a customer typed into an FTS5 query matching
+// products that contain every word, also as a prefix.
+func searchQuery(search string) string {
+	var terms []string
+	for _, word := range strings.Fields(search) {
+		word = strings.ReplaceAll(word, `"`, "")
+		if word != "" {
+			terms = append(terms, fmt.Sprintf(`"%s"*`, word))
+		}
 	}
 
-	query += fmt.Sprintf(" GROUP BY p.id")
+	return strings.Join(terms, " ")
+}
+
+func (s Storage) ListProducts(params ListProductsQuery) (*Page[Product], error) {
+	query := listProductQuery() + " WHERE p.deleted_at IS NULL"
+
+	// the locale is bound twice, for the categories and the product names
+	args := []interface{}{params.Locale, params.Locale}
+
+	if params.IsPublished || params.Status == ProductPublished {
+		query += " AND p.is_published = TRUE"
+	} else if params.Status == ProductDraft {
+		query += " AND p.is_published = FALSE"
+	}
+
+	if params.CreatedFrom != nil {
+		query += " AND datetime(p.created_at) >= datetime(?)"
+		args = append(args, params.CreatedFrom.UTC().Format(time.DateTime))
+	}
+
+	if params.CreatedTo != nil {
+		query += " AND datetime(p.created_at) < datetime(?)"
+		args = append(args, params.CreatedTo.UTC().Format(time.DateTime))
+	}
+
+	if params.Category != "" {
+		query += " AND " + inCategory
+		args = append(args, params.Category)
+	}
+
+	if search := searchQuery(params.Search); search != "" {
+		query += " AND p.id IN (SELECT product_id FROM product_search WHERE product_search MATCH ?)"
+		args = append(args, search)
+	}
+
+	if params.InStock || params.Size != "" {
+		cond := "pv.product_id = p.id AND pv.deleted_at IS NULL"
+		if params.InStock {
+			cond += fmt.Sprintf(" AND %s > 0", availableStock)
+		}
 
-	rows, err := s.db.Query(query, params.Locale)
+		if params.Size != "" {
+			cond += " AND UPPER(pv.name) = UPPER(?)"
+			args = append(args, params.Size)
+		}
+
+		query += fmt.Sprintf(" AND EXISTS (SELECT 1 FROM product_variants pv WHERE %s)", cond)
+	}
+
+	query += " GROUP BY p.id"
+
+	currency := params.Currency
+	if currency == "" {
+		currency = currencyFromLocale(params.Locale)
+	}
+
+	query = fmt.Sprintf(`
+		SELECT b.*, pr.price, datetime(b.created_at)
+		FROM (%s) b
+		LEFT JOIN (%s) pr ON pr.product_id = b.id
+		WHERE TRUE
+	`, query, productPrices())
+
+	args = append(args, currency)
+
+	sortByPrice := params.Sort == SortPriceAsc || params.Sort == SortPriceDesc
+
+	if params.Currency != "" || params.MinPrice != nil || params.MaxPrice != nil || sortByPrice {
+		query += " AND pr.price IS NOT NULL"
+	}
+
+	if params.MinPrice != nil {
+		query += " AND pr.price >= ?"
+		args = append(args, *params.MinPrice)
+	}
+
+	if params.MaxPrice != nil {
+		query += " AND pr.price <= ?"
+		args = append(args, *params.MaxPrice)
+	}
+
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM ("+query+")", args...).Scan(&total); err != nil {
+		return nil, err
+	}
+
+	if params.Cursor != "" {
+		var c productCursor
+		if err := decodeCursor(params.Cursor, &c); err != nil || c.ID == 0 {
+			return nil, ErrInvalidCursor
+		}
+
+		switch params.Sort {
+		case SortNewest:
+			query += " AND (datetime(b.created_at) < ? OR (datetime(b.created_at) = ? AND b.id < ?))"
+			args = append(args, c.CreatedAt, c.CreatedAt, c.ID)
+		case SortPriceAsc:
+			query += " AND (pr.price > ? OR (pr.price = ? AND b.id > ?))"
+			args = append(args, c.Price, c.Price, c.ID)
+		case SortPriceDesc:
+			query += " AND (pr.price < ? OR (pr.price = ? AND b.id < ?))"
+			args = append(args, c.Price, c.Price, c.ID)
+		default:
+			query += " AND b.id > ?"
+			args = append(args, c.ID)
+		}
+	}
+
+	switch params.Sort {
+	case SortNewest:
+		query += " ORDER BY datetime(b.created_at) DESC, b.id DESC"
+	case SortPriceAsc:
+		query += " ORDER BY pr.price, b.id"
+	case SortPriceDesc:
+		query += " ORDER BY pr.price DESC, b.id DESC"
+	default:
+		query += " ORDER BY b.id"
+	}
+
+	// one more product tells if there is a next page
+	if params.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, params.Limit+1)
+	}
+
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -126,13 +359,17 @@ func (s Storage) ListProducts(params ListProductsQuery) ([]Product, error) {
 
 	products := make([]Product, 0)
 
+	var cursors []productCursor
+
 	for rows.Next() {
 		var id int64
-		var handle, name, description, materials, imageUrl, variantsJSON string
+		var handle, name, description, materials, imageUrl, variantsJSON, categoriesJSON string
 		var isPublished bool
 		var createdAt, updatedAt time.Time
 		var deletedAt *time.Time
 		var imageUrls ArrayString
+		var price *int
+		var sortCreatedAt string
 
 		if err := rows.Scan(
 			&id,
@@ -147,15 +384,34 @@ func (s Storage) ListProducts(params ListProductsQuery) ([]Product, error) {
 			&updatedAt,
 			&deletedAt,
 			&variantsJSON,
+			&categoriesJSON,
+			&price,
+			&sortCreatedAt,
 		); err != nil {
 			return nil, err
 		}
 
+		cursor := productCursor{ID: id}
+		if params.Sort == SortNewest {
+			cursor.CreatedAt = sortCreatedAt
+		} else if price != nil && (params.Sort == SortPriceAsc || params.Sort == SortPriceDesc) {
+			cursor.Price = *price
+		}
+
+		cursors = append(cursors, cursor)
+
 		var variants []ProductVariant
 		if err := json.Unmarshal([]byte(variantsJSON), &variants); err != nil {
 			return nil, err
 		}
 
+		var categories []Category
+		if err := json.Unmarshal([]byte(categoriesJSON), &categories); err != nil {
+			return nil, err
+		}
+
+		setSaleFlags(variants)
+
 		product := Product{
 			ID:          id,
 			Handle:      handle,
@@ -169,37 +425,55 @@ func (s Storage) ListProducts(params ListProductsQuery) ([]Product, error) {
 			CreatedAt:   createdAt,
 			UpdatedAt:   updatedAt,
 			DeletedAt:   deletedAt,
+			Categories:  categories,
 		}
 
 		products = append(products, product)
 	}
 
-	return products, nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	list := &Page[Product]{Items: products, Total: total}
+
+	if params.Limit > 0 && len(products) > params.Limit {
+		list.Items = products[:params.Limit]
+		list.NextCursor = encodeCursor(cursors[params.Limit-1])
+	}
+
+	return list, nil
 }
 
 type GetProductQuery struct {
 	Handle string
 	ID     int64
 	Locale string
+	// IncludeUnpublished is used by the admin panel to load drafts.
+	IncludeUnpublished bool
 }
 
 func (s Storage) GetProduct(q GetProductQuery) (*Product, error) {
-	query := listProductQuery()
+	query := listProductQuery() + " WHERE p.deleted_at IS NULL"
 
-	args := []interface{}{q.Locale}
+	args := []interface{}{q.Locale, q.Locale}
 
 	if q.Handle != "" {
-		query += " WHERE p.handle = ? AND p.is_published = TRUE"
+		query += " AND p.handle = ?"
 		args = append(args, q.Handle)
 	} else {
-		query += " WHERE p.id = ? AND p.is_published = TRUE"
+		query += " AND p.id = ?"
 		args = append(args, q.ID)
 	}
 
+	if !q.IncludeUnpublished {
+		query += " AND p.is_published = TRUE"
+	}
+
 	query = fmt.Sprintf("%s GROUP BY p.id", query)
 
 	var product Product
-	var variantsJSON string
+	var variantsJSON, categoriesJSON string
 	var imageUrls ArrayString
 
 	if err := s.db.QueryRow(query, args...).Scan(
@@ -215,6 +489,7 @@ func (s Storage) GetProduct(q GetProductQuery) (*Product, error) {
 		&product.UpdatedAt,
 		&product.DeletedAt,
 		&variantsJSON,
+		&categoriesJSON,
 	); err != nil && IsNoRowsError(err) {
 		return nil, ErrNotFound
 	} else if err != nil {
@@ -226,8 +501,104 @@ func (s Storage) GetProduct(q GetProductQuery) (*Product, error) {
 		return nil, err
 	}
 
+	setSaleFlags(variants)
+
+	if err := json.Unmarshal([]byte(categoriesJSON), &product.Categories); err != nil {
+		return nil, err
+	}
+
 	product.Variants = variants
 	product.Images = imageUrls
 
 	return &product, nil
 }
+
+func (s Storage) CreateProduct(p Product) (*Product, error) {
+	query := `
+		INSERT INTO products (handle, name, description, materials, cover_image_url, image_urls, is_published)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+
+	res, err := s.db.Exec(query, p.Handle, p.Name, p.Description, p.Materials, p.Image, ArrayString(p.Images), p.IsPublished)
+
+	if err != nil && IsDuplicateError(err) {
+		return nil, ErrAlreadyExists
+	} else if err != nil {
+		return nil, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetProduct(GetProductQuery{ID: id, IncludeUnpublished: true})
+}
+
+func (s Storage) UpdateProduct(p Product) (*Product, error) {
+	query := `
+		UPDATE products
+		SET handle = ?, name = ?, description = ?, materials = ?, cover_image_url = ?, image_urls = ?, is_published = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND deleted_at IS NULL
+	`
+
+	res, err := s.db.Exec(query, p.Handle, p.Name, p.Description, p.Materials, p.Image, ArrayString(p.Images), p.IsPublished, p.ID)
+
+	if err != nil && IsDuplicateError(err) {
+		return nil, ErrAlreadyExists
+	} else if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrNotFound
+	}
+
+	return s.GetProduct(GetProductQuery{ID: p.ID, IncludeUnpublished: true})
+}
+
+func (s Storage) SetProductPublished(id int64, published bool) error {
+	query := `
+		UPDATE products
+		SET is_published = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND deleted_at IS NULL
+	`
+
+	res, err := s.db.Exec(query, published, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// DeleteProduct soft-deletes a product and unpublishes it. The handle is kept,
+// so it can't be reused by a new product.
+func (s Storage) DeleteProduct(id int64) error {
+	query := `
+		UPDATE products
+		SET deleted_at = CURRENT_TIMESTAMP, is_published = FALSE, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND deleted_at IS NULL
+	`
+
+	res, err := s.db.Exec(query, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,383 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	RefundPending   = "pending"
+	RefundSucceeded = "succeeded"
+	RefundFailed    = "failed"
+)
+
+// Refund is money returned to the customer for an order, either issued from
+// the admin panel or reported by the provider. Amount is in minor units, like
+// payment events.
+type Refund struct {
+	ID               int64     `db:"id" json:"id"`
+	OrderID          int64     `db:"order_id" json:"order_id"`
+	Provider         string    `db:"provider" json:"provider"`
+	TransactionID    *string   `db:"transaction_id" json:"transaction_id"`
+	ProviderRefundID *string   `db:"provider_refund_id" json:"provider_refund_id"`
+	Amount           int       `db:"amount" json:"amount"`
+	CurrencyCode     string    `db:"currency_code" json:"currency_code"`
+	Status           string    `db:"status" json:"status"`
+	Reason           *string   `db:"reason" json:"reason"`
+	UserID           *int64    `db:"user_id" json:"user_id"`
+	CreatedAt        time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt        time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// paidTransaction selects the provider transaction that paid the order.
+const paidTransaction = `
+	SELECT transaction_id
+	FROM payment_events
+	WHERE order_id = ? AND payment_status = 'paid' AND result = 'applied'
+	ORDER BY id DESC
+	LIMIT 1
+`
+
+// CreateRefund records a pending refund of the transaction that paid the
+// order. A zero amount refunds whatever has not been refunded yet. Pending
+// refunds count against the paid amount, so refunds issued at the same time
+// can't exceed it.
+func (s Storage) CreateRefund(orderID int64, amount int, reason *string, userID *int64) (*Refund, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	var order struct {
+		status   PaymentStatus
+		provider string
+		total    int
+		currency string
+	}
+
+	err = tx.QueryRow("SELECT payment_status, payment_provider, total, currency_code FROM orders WHERE id = ?", orderID).Scan(
+		&order.status,
+		&order.provider,
+		&order.total,
+		&order.currency,
+	)
+
+	if IsNoRowsError(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if order.status != PaymentPaid && order.status != PaymentPartiallyRefunded {
+		return nil, ErrNotRefundable
+	}
+
+	var transactionID string
+	err = tx.QueryRow(paidTransaction, orderID).Scan(&transactionID)
+
+	if IsNoRowsError(err) {
+		// marked as paid by hand, there is nothing to refund through the provider
+		return nil, ErrNotRefundable
+	} else if err != nil {
+		return nil, err
+	}
+
+	var refunded int
+	query := "SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE order_id = ? AND status IN (?, ?)"
+
+	if err := tx.QueryRow(query, orderID, RefundPending, RefundSucceeded).Scan(&refunded); err != nil {
+		return nil, err
+	}
+
+	remaining := order.total*100 - refunded
+
+	if amount == 0 {
+		amount = remaining
+	}
+
+	if amount <= 0 || amount > remaining {
+		return nil, ErrRefundExceedsPayment
+	}
+
+	query = `
+		INSERT INTO refunds (order_id, provider, transaction_id, amount, currency_code, status, reason, user_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	res, err := tx.Exec(query, orderID, order.provider, transactionID, amount, order.currency, RefundPending, reason, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return s.GetRefund(id)
+}
+
+// CompleteRefund marks a refund as succeeded and moves the order payment
+// status to partially_refunded or refunded. A fully refunded order is moved
+// to the refunded status too when OrderTransitions allows it, e.g. once it
+// was cancelled or returned.
+func (s Storage) CompleteRefund(id int64, providerRefundID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := completeRefund(tx, id, providerRefundID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func completeRefund(q querier, id int64, providerRefundID string) error {
+	var orderID int64
+	var status string
+	var userID *int64
+	var reason *string
+
+	err := q.QueryRow("SELECT order_id, status, user_id, reason FROM refunds WHERE id = ?", id).Scan(
+		&orderID,
+		&status,
+		&userID,
+		&reason,
+	)
+
+	if IsNoRowsError(err) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE refunds
+		SET status = ?, provider_refund_id = COALESCE(NULLIF(?, ''), provider_refund_id), updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+
+	if _, err := q.Exec(query, RefundSucceeded, providerRefundID, id); err != nil {
+		return err
+	}
+
+	// already completed by the provider webhook
+	if status == RefundSucceeded {
+		return nil
+	}
+
+	return applyRefunds(q, orderID, userID, reason)
+}
+
+// applyRefunds sets the order payment status from the sum of its succeeded
+// refunds.
+func applyRefunds(q querier, orderID int64, userID *int64, note *string) error {
+	var total, refunded int
+
+	query := `
+		SELECT o.total * 100,
+			   COALESCE((SELECT SUM(r.amount) FROM refunds r WHERE r.order_id = o.id AND r.status = ?), 0)
+		FROM orders o
+		WHERE o.id = ?
+	`
+
+	if err := q.QueryRow(query, RefundSucceeded, orderID).Scan(&total, &refunded); err != nil {
+		return err
+	}
+
+	status := PaymentPartiallyRefunded
+	if refunded >= total {
+		status = PaymentRefunded
+	}
+
+	if _, err := q.Exec("UPDATE orders SET payment_status = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", status, orderID); err != nil {
+		return err
+	}
+
+	if status != PaymentRefunded {
+		return nil
+	}
+
+	if err := releaseOrderDiscount(q, orderID); err != nil {
+		return err
+	}
+
+	if err := updateOrderStatus(q, orderID, OrderRefunded, userID, note); err != nil && !errors.Is(err, ErrInvalidStatusTransition) {
+		return err
+	}
+
+	return nil
+}
+
+// FailRefund marks a refund the provider declined, so its amount can be
+// refunded again.
+func (s Storage) FailRefund(id int64) error {
+	query := `
+		UPDATE refunds
+		SET status = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND status = ?
+	`
+
+	res, err := s.db.Exec(query, RefundFailed, id, RefundPending)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// SetRefundProviderID stores the provider's ID of a refund that is still
+// being processed, the provider webhook completes it later.
+func (s Storage) SetRefundProviderID(id int64, providerRefundID string) error {
+	query := `
+		UPDATE refunds
+		SET provider_refund_id = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+
+	res, err := s.db.Exec(query, providerRefundID, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// applyRefundEvent records a refund reported by the provider webhook. Refunds
+// issued from the admin panel are matched by their provider ID, or by amount
+// if the webhook arrives before the refund API call returned. Anything else
+// was refunded from the provider dashboard and is recorded as a new refund.
+func applyRefundEvent(q querier, e PaymentEvent, status PaymentStatus) (string, error) {
+	var id int64
+	var refundStatus string
+
+	query := `
+		SELECT id, status
+		FROM refunds
+		WHERE order_id = ? AND provider = ?
+		  AND (provider_refund_id = ? OR (provider_refund_id IS NULL AND status = ? AND amount = ?))
+		ORDER BY provider_refund_id IS NULL, id
+		LIMIT 1
+	`
+
+	err := q.QueryRow(query, *e.OrderID, e.Provider, e.TransactionID, RefundPending, e.Amount).Scan(&id, &refundStatus)
+
+	if err == nil && refundStatus == RefundSucceeded {
+		return PaymentEventDuplicate, nil
+	} else if err == nil {
+		return PaymentEventApplied, completeRefund(q, id, e.TransactionID)
+	} else if !IsNoRowsError(err) {
+		return "", err
+	}
+
+	if status != PaymentPaid && status != PaymentPartiallyRefunded {
+		return PaymentEventRegression, nil
+	}
+
+	query = `
+		INSERT INTO refunds (order_id, provider, transaction_id, provider_refund_id, amount, currency_code, status)
+		VALUES (?, ?, (` + paidTransaction + `), ?, ?, ?, ?)
+	`
+
+	if _, err := q.Exec(query, *e.OrderID, e.Provider, *e.OrderID, e.TransactionID, e.Amount, e.CurrencyCode, RefundSucceeded); err != nil {
+		return "", err
+	}
+
+	return PaymentEventApplied, applyRefunds(q, *e.OrderID, nil, nil)
+}
+
+func (s Storage) GetRefund(id int64) (*Refund, error) {
+	query := `
+		SELECT id, order_id, provider, transaction_id, provider_refund_id, amount, currency_code, status, reason, user_id, created_at, updated_at
+		FROM refunds
+		WHERE id = ?
+	`
+
+	var r Refund
+	err := s.db.QueryRow(query, id).Scan(
+		&r.ID,
+		&r.OrderID,
+		&r.Provider,
+		&r.TransactionID,
+		&r.ProviderRefundID,
+		&r.Amount,
+		&r.CurrencyCode,
+		&r.Status,
+		&r.Reason,
+		&r.UserID,
+		&r.CreatedAt,
+		&r.UpdatedAt,
+	)
+
+	if IsNoRowsError(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+func (s Storage) ListOrderRefunds(orderID int64) ([]Refund, error) {
+	query := `
+		SELECT id, order_id, provider, transaction_id, provider_refund_id, amount, currency_code, status, reason, user_id, created_at, updated_at
+		FROM refunds
+		WHERE order_id = ?
+		ORDER BY created_at, id
+	`
+
+	rows, err := s.db.Query(query, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	refunds := make([]Refund, 0)
+
+	for rows.Next() {
+		var r Refund
+		if err := rows.Scan(
+			&r.ID,
+			&r.OrderID,
+			&r.Provider,
+			&r.TransactionID,
+			&r.ProviderRefundID,
+			&r.Amount,
+			&r.CurrencyCode,
+			&r.Status,
+			&r.Reason,
+			&r.UserID,
+			&r.CreatedAt,
+			&r.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		refunds = append(refunds, r)
+	}
+
+	return refunds, nil
+}
@@ -0,0 +1,216 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// Session is an admin user's sign-in on one device. It is kept alive by a
+// refresh token, only the hash of which is stored.
+type Session struct {
+	ID         int64      `db:"id" json:"id"`
+	UserID     int64      `db:"user_id" json:"user_id"`
+	IP         string     `db:"ip" json:"ip"`
+	UserAgent  string     `db:"user_agent" json:"user_agent"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+	LastUsedAt time.Time  `db:"last_used_at" json:"last_used_at"`
+	ExpiresAt  time.Time  `db:"expires_at" json:"expires_at"`
+	RevokedAt  *time.Time `db:"revoked_at" json:"revoked_at"`
+}
+
+// activeSession is the condition for the session aliased as s being neither
+// revoked nor expired.
+const activeSession = "s.revoked_at IS NULL AND s.expires_at > CURRENT_TIMESTAMP"
+
+func ttlModifier(ttl time.Duration) string {
+	return fmt.Sprintf("+%d seconds", int(ttl.Seconds()))
+}
+
+func (s Storage) getSession(query string, args ...interface{}) (*Session, error) {
+	var session Session
+
+	err := s.db.QueryRow(query, args...).Scan(
+		&session.ID,
+		&session.UserID,
+		&session.IP,
+		&session.UserAgent,
+		&session.CreatedAt,
+		&session.LastUsedAt,
+		&session.ExpiresAt,
+		&session.RevokedAt,
+	)
+
+	if err != nil && IsNoRowsError(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+const sessionColumns = "s.id, s.user_id, s.ip, s.user_agent, s.created_at, s.last_used_at, s.expires_at, s.revoked_at"
+
+// CreateSession starts a session for the user that lasts ttl unless it's
+// refreshed.
+func (s Storage) CreateSession(userID int64, tokenHash, ip, userAgent string, ttl time.Duration) (*Session, error) {
+	query := `
+		INSERT INTO admin_sessions (user_id, token_hash, ip, user_agent, last_used_at, expires_at)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP, datetime('now', ?))
+	`
+
+	res, err := s.db.Exec(query, userID, tokenHash, ip, userAgent, ttlModifier(ttl))
+	if err != nil && IsForeignKeyError(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.getSession("SELECT "+sessionColumns+" FROM admin_sessions s WHERE s.id = ?", id)
+}
+
+// RefreshSession swaps the refresh token of an active session for a new one
+// and extends the session by ttl, so a refresh token works only once.
+// ErrNotFound is returned if the token isn't the one of an active session.
+func (s Storage) RefreshSession(tokenHash, newTokenHash, ip, userAgent string, ttl time.Duration) (*Session, error) {
+	query := fmt.Sprintf(`
+		UPDATE admin_sessions AS s
+		SET token_hash = ?, ip = ?, user_agent = ?, last_used_at = CURRENT_TIMESTAMP, expires_at = datetime('now', ?)
+		WHERE s.token_hash = ? AND %s
+	`, activeSession)
+
+	res, err := s.db.Exec(query, newTokenHash, ip, userAgent, ttlModifier(ttl), tokenHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrNotFound
+	}
+
+	return s.getSession("SELECT "+sessionColumns+" FROM admin_sessions s WHERE s.token_hash = ?", newTokenHash)
+}
+
+// GetActiveSessionRole returns the current role of the user if the session
+// is neither revoked nor expired and the user isn't deactivated, ErrNotFound
+// otherwise.
+func (s Storage) GetActiveSessionRole(userID, id int64) (string, error) {
+	query := fmt.Sprintf(`
+		SELECT u.role
+		FROM admin_sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.id = ? AND s.user_id = ? AND u.deleted_at IS NULL AND %s
+	`, activeSession)
+
+	var role string
+	err := s.db.QueryRow(query, id, userID).Scan(&role)
+
+	if err != nil && IsNoRowsError(err) {
+		return "", ErrNotFound
+	} else if err != nil {
+		return "", err
+	}
+
+	return role, nil
+}
+
+// ListUserSessions returns the active sessions of the user, the most
+// recently used first.
+func (s Storage) ListUserSessions(userID int64) ([]Session, error) {
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM admin_sessions s
+		WHERE s.user_id = ? AND %s
+		ORDER BY s.last_used_at DESC, s.id DESC
+	`, sessionColumns, activeSession)
+
+	rows, err := s.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	sessions := make([]Session, 0)
+
+	for rows.Next() {
+		var session Session
+		if err := rows.Scan(
+			&session.ID,
+			&session.UserID,
+			&session.IP,
+			&session.UserAgent,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.ExpiresAt,
+			&session.RevokedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// RevokeSession ends one session of the user.
+func (s Storage) RevokeSession(userID, id int64) error {
+	query := `
+		UPDATE admin_sessions
+		SET revoked_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND user_id = ? AND revoked_at IS NULL
+	`
+
+	res, err := s.db.Exec(query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// RevokeSessionByToken ends the session the refresh token belongs to, if
+// any.
+func (s Storage) RevokeSessionByToken(tokenHash string) error {
+	query := `
+		UPDATE admin_sessions
+		SET revoked_at = CURRENT_TIMESTAMP
+		WHERE token_hash = ? AND revoked_at IS NULL
+	`
+
+	_, err := s.db.Exec(query, tokenHash)
+
+	return err
+}
+
+// RevokeUserSessions ends every session of the user but the one with the
+// exceptID, 0 ends them all.
+func (s Storage) RevokeUserSessions(userID, exceptID int64) error {
+	return revokeUserSessions(s.db, userID, exceptID)
+}
+
+func revokeUserSessions(q querier, userID, exceptID int64) error {
+	query := `
+		UPDATE admin_sessions
+		SET revoked_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND id != ? AND revoked_at IS NULL
+	`
+
+	_, err := q.Exec(query, userID, exceptID)
+
+	return err
+}
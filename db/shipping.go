@@ -0,0 +1,111 @@
+package db
+
+type ShippingMethod struct {
+	ID           int64  `db:"id" json:"id"`
+	Name         string `db:"name" json:"name"`
+	RegionID     int64  `db:"region_id" json:"region_id"`
+	Price        int    `db:"price" json:"price"`
+	CurrencyCode string `db:"currency_code" json:"currency_code"`
+}
+
+type ShippingMethodQuery struct {
+	// Country is an ISO 3166 alpha-2 code. Countries that are not mapped to a
+	// region, or a nil country, fall back to the default region.
+	Country  *string
+	Currency string
+}
+
+func (s Storage) ListShippingMethods(params ShippingMethodQuery) ([]ShippingMethod, error) {
+	query := `
+		SELECT sm.id,
+			   sm.name,
+			   sm.region_id,
+			   smp.price,
+			   smp.currency_code
+		FROM shipping_methods sm
+		JOIN shipping_method_prices smp ON sm.id = smp.shipping_method_id AND smp.currency_code = ?
+		JOIN regions r ON sm.region_id = r.id AND r.deleted_at IS NULL
+		WHERE sm.deleted_at IS NULL
+		  AND r.id = COALESCE(
+			(SELECT c.region_id FROM countries c WHERE UPPER(c.iso_code) = UPPER(?) AND c.deleted_at IS NULL),
+			(SELECT d.id FROM regions d WHERE d.is_default = TRUE AND d.deleted_at IS NULL ORDER BY d.id LIMIT 1)
+		  )
+		ORDER BY smp.price, sm.id
+	`
+
+	rows, err := s.db.Query(query, params.Currency, params.Country)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	methods := make([]ShippingMethod, 0)
+
+	for rows.Next() {
+		var m ShippingMethod
+		if err := rows.Scan(
+			&m.ID,
+			&m.Name,
+			&m.RegionID,
+			&m.Price,
+			&m.CurrencyCode,
+		); err != nil {
+			return nil, err
+		}
+
+		methods = append(methods, m)
+	}
+
+	return methods, nil
+}
+
+func (s Storage) GetShippingMethod(id int64, currency string) (*ShippingMethod, error) {
+	var m ShippingMethod
+
+	query := `
+		SELECT sm.id,
+			   sm.name,
+			   sm.region_id,
+			   COALESCE(smp.price, sm.price),
+			   COALESCE(smp.currency_code, ?)
+		FROM shipping_methods sm
+		LEFT JOIN shipping_method_prices smp ON sm.id = smp.shipping_method_id AND smp.currency_code = ?
+		WHERE sm.id = ?
+	`
+
+	err := s.db.QueryRow(query, currency, currency, id).Scan(
+		&m.ID,
+		&m.Name,
+		&m.RegionID,
+		&m.Price,
+		&m.CurrencyCode,
+	)
+
+	if IsNoRowsError(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// cartShippingCountry prefers the country the customer entered at checkout
+// over the one detected from the request.
+func cartShippingCountry(cart *Cart) *string {
+	if cart.Customer != nil && cart.Customer.Country != nil && *cart.Customer.Country != "" {
+		return cart.Customer.Country
+	}
+
+	return cart.Context.Country
+}
+
+// ListCartShippingMethods returns the shipping methods available for the
+// cart's destination country, priced in the cart currency.
+func (s Storage) ListCartShippingMethods(cart *Cart) ([]ShippingMethod, error) {
+	return s.ListShippingMethods(ShippingMethodQuery{
+		Country:  cartShippingCountry(cart),
+		Currency: cart.CurrencyCode,
+	})
+}
@@ -0,0 +1,267 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// StockReservationTTL is how long stock stays reserved for an unpaid order.
+// Expired reservations no longer count against availability. If the payment
+// succeeds after all, the stock is only committed when enough of it is left,
+// otherwise the order is out of stock.
+const StockReservationTTL = time.Hour
+
+const (
+	reservationReserved  = "reserved"
+	reservationCommitted = "committed"
+	reservationReleased  = "released"
+)
+
+// availableStock is the SQL expression for the sellable quantity of the
+// variant aliased as pv: stock on hand minus active reservations.
+const availableStock = `
+	(pv.available - COALESCE((
+		SELECT SUM(r.quantity)
+		FROM stock_reservations r
+		WHERE r.variant_id = pv.id AND r.status = 'reserved' AND r.expires_at > CURRENT_TIMESTAMP
+	), 0))`
+
+// HasActiveOrderStock tells if the stock of the order is reserved and the
+// reservation hasn't expired or been released.
+func (s Storage) HasActiveOrderStock(orderID int64) (bool, error) {
+	return hasActiveOrderStock(s.db, orderID)
+}
+
+func hasActiveOrderStock(q querier, orderID int64) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM stock_reservations
+			WHERE order_id = ? AND status = ? AND expires_at > CURRENT_TIMESTAMP
+		)
+	`
+
+	var active bool
+	err := q.QueryRow(query, orderID, reservationReserved).Scan(&active)
+
+	return active, err
+}
+
+// ReserveOrderStock reserves stock for every line item of the order. Either
+// all items are reserved or none, in which case ErrOutOfStock is returned.
+// Released or expired reservations of the order are replaced, an order with
+// active ones is left as it is.
+func (s Storage) ReserveOrderStock(orderID int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if active, err := hasActiveOrderStock(tx, orderID); err != nil {
+		return err
+	} else if active {
+		return nil
+	}
+
+	// a payment commits every reservation of the order, the stale ones must
+	// not be counted twice
+	if _, err := tx.Exec("DELETE FROM stock_reservations WHERE order_id = ? AND status IN (?, ?)", orderID, reservationReserved, reservationReleased); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT variant_id, quantity FROM line_items WHERE order_id = ?", orderID)
+	if err != nil {
+		return err
+	}
+
+	type reservation struct {
+		variantID int64
+		quantity  int
+	}
+
+	var reservations []reservation
+	for rows.Next() {
+		var r reservation
+		if err := rows.Scan(&r.variantID, &r.quantity); err != nil {
+			rows.Close()
+			return err
+		}
+
+		reservations = append(reservations, r)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf(`
+		INSERT INTO stock_reservations (order_id, variant_id, quantity, status, expires_at)
+		SELECT ?, pv.id, ?, ?, datetime('now', ?)
+		FROM product_variants pv
+		WHERE pv.id = ? AND %s >= ?
+	`, availableStock)
+
+	ttl := fmt.Sprintf("+%d seconds", int(StockReservationTTL.Seconds()))
+
+	for _, r := range reservations {
+		res, err := tx.Exec(query, orderID, r.quantity, reservationReserved, ttl, r.variantID, r.quantity)
+		if err != nil {
+			return err
+		}
+
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrOutOfStock
+		}
+	}
+
+	return tx.Commit()
+}
+
+// CommitOrderStock decrements product_variants.available by the quantities
+// reserved for a paid order. It is safe to call more than once.
+// ErrOutOfStock is returned, and nothing is committed, if the stock of a
+// released or expired reservation was taken by other orders meanwhile.
+func (s Storage) CommitOrderStock(orderID int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := commitOrderStock(tx, orderID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func commitOrderStock(q querier, orderID int64) error {
+	// the stock other orders hold must stay theirs, an active reservation of
+	// this order is always covered
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM stock_reservations r
+			JOIN product_variants pv ON pv.id = r.variant_id
+			WHERE r.order_id = ? AND r.status IN (?, ?)
+			GROUP BY r.variant_id
+			HAVING SUM(r.quantity) > pv.available - COALESCE((
+				SELECT SUM(o.quantity)
+				FROM stock_reservations o
+				WHERE o.variant_id = r.variant_id AND o.order_id != r.order_id AND o.status = ? AND o.expires_at > CURRENT_TIMESTAMP
+			), 0)
+		)
+	`
+
+	var short bool
+	if err := q.QueryRow(query, orderID, reservationReserved, reservationReleased, reservationReserved).Scan(&short); err != nil {
+		return err
+	} else if short {
+		return ErrOutOfStock
+	}
+
+	query = `
+		UPDATE product_variants
+		SET available = available - (
+			SELECT SUM(r.quantity)
+			FROM stock_reservations r
+			WHERE r.variant_id = product_variants.id AND r.order_id = ? AND r.status IN (?, ?)
+		)
+		WHERE id IN (
+			SELECT r.variant_id
+			FROM stock_reservations r
+			WHERE r.order_id = ? AND r.status IN (?, ?)
+		)
+	`
+
+	if _, err := q.Exec(query,
+		orderID, reservationReserved, reservationReleased,
+		orderID, reservationReserved, reservationReleased,
+	); err != nil {
+		return err
+	}
+
+	_, err := q.Exec(
+		"UPDATE stock_reservations SET status = ?, updated_at = CURRENT_TIMESTAMP WHERE order_id = ? AND status IN (?, ?)",
+		reservationCommitted, orderID, reservationReserved, reservationReleased,
+	)
+
+	return err
+}
+
+// ReleaseOrderStock returns the stock of an order whose payment failed or
+// expired, or that was cancelled or refunded.
+func (s Storage) ReleaseOrderStock(orderID int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := releaseOrderStock(tx, orderID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ReleaseOrderReservations gives the stock and discount reserved for an
+// unpaid order back, e.g. when its payment couldn't be started.
+func (s Storage) ReleaseOrderReservations(orderID int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := releaseOrderStock(tx, orderID); err != nil {
+		return err
+	}
+
+	if err := releaseOrderDiscount(tx, orderID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// releaseOrderStock drops the reservations of the order. Stock already
+// committed for a paid order is put back to product_variants.available.
+func releaseOrderStock(q querier, orderID int64) error {
+	query := `
+		UPDATE product_variants
+		SET available = available + (
+			SELECT SUM(r.quantity)
+			FROM stock_reservations r
+			WHERE r.variant_id = product_variants.id AND r.order_id = ? AND r.status = ?
+		)
+		WHERE id IN (
+			SELECT r.variant_id
+			FROM stock_reservations r
+			WHERE r.order_id = ? AND r.status = ?
+		)
+	`
+
+	if _, err := q.Exec(query, orderID, reservationCommitted, orderID, reservationCommitted); err != nil {
+		return err
+	}
+
+	query = `
+		UPDATE stock_reservations
+		SET status = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE order_id = ? AND status IN (?, ?)
+	`
+
+	_, err := q.Exec(query, reservationReleased, orderID, reservationReserved, reservationCommitted)
+
+	return err
+}
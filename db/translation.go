@@ -0,0 +1,99 @@
+package db
+
+type ProductTranslation struct {
+	ID          int64  `db:"id" json:"id"`
+	ProductID   int64  `db:"product_id" json:"product_id"`
+	Language    string `db:"language" json:"language"`
+	Name        string `db:"name" json:"name"`
+	Description string `db:"description" json:"description"`
+	Materials   string `db:"materials" json:"materials"`
+}
+
+func (s Storage) ListProductTranslations(productID int64) ([]ProductTranslation, error) {
+	query := `
+		SELECT id, product_id, language, COALESCE(name, ''), COALESCE(description, ''), COALESCE(materials, '')
+		FROM product_translations
+		WHERE product_id = ?
+		ORDER BY language
+	`
+
+	rows, err := s.db.Query(query, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	translations := make([]ProductTranslation, 0)
+
+	for rows.Next() {
+		var t ProductTranslation
+		if err := rows.Scan(
+			&t.ID,
+			&t.ProductID,
+			&t.Language,
+			&t.Name,
+			&t.Description,
+			&t.Materials,
+		); err != nil {
+			return nil, err
+		}
+
+		translations = append(translations, t)
+	}
+
+	return translations, nil
+}
+
+// SaveProductTranslation creates or replaces the translation of a product
+// for a language. Empty description and materials fall back to the product's
+// own values on the storefront.
+func (s Storage) SaveProductTranslation(t ProductTranslation) (*ProductTranslation, error) {
+	query := `
+		INSERT INTO product_translations (product_id, language, name, description, materials)
+		SELECT p.id, ?, ?, NULLIF(?, ''), NULLIF(?, '')
+		FROM products p
+		WHERE p.id = ? AND p.deleted_at IS NULL
+		ON CONFLICT (product_id, language) DO UPDATE
+		SET name = excluded.name, description = excluded.description, materials = excluded.materials
+	`
+
+	res, err := s.db.Exec(query, t.Language, t.Name, t.Description, t.Materials, t.ProductID)
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrNotFound
+	}
+
+	translations, err := s.ListProductTranslations(t.ProductID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tr := range translations {
+		if tr.Language == t.Language {
+			return &tr, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (s Storage) DeleteProductTranslation(productID int64, language string) error {
+	res, err := s.db.Exec("DELETE FROM product_translations WHERE product_id = ? AND language = ?", productID, language)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,325 @@
+package db
+
+import (
+	"time"
+)
+
+// TOTP is the authenticator app secret of a user. It is pending until the
+// user confirms it with a code, which sets EnabledAt. The secret is kept as
+// is because codes are computed from it.
+type TOTP struct {
+	Secret    string     `db:"totp_secret"`
+	EnabledAt *time.Time `db:"totp_enabled_at"`
+	// LastStep is the time step of the last code used, codes of that step
+	// and earlier are rejected so that a code works only once.
+	LastStep int64 `db:"totp_last_step"`
+}
+
+// GetUserTOTP returns the authenticator app secret of the user, ErrNotFound
+// if the user hasn't set one up.
+func (s Storage) GetUserTOTP(userID int64) (*TOTP, error) {
+	var t TOTP
+	var secret *string
+
+	err := s.db.QueryRow(`SELECT totp_secret, totp_enabled_at, totp_last_step FROM users WHERE id = ?`, userID).Scan(
+		&secret,
+		&t.EnabledAt,
+		&t.LastStep,
+	)
+
+	if err != nil && IsNoRowsError(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	} else if secret == nil {
+		return nil, ErrNotFound
+	}
+
+	t.Secret = *secret
+
+	return &t, nil
+}
+
+// SetUserTOTPSecret stores a pending authenticator app secret for the user,
+// replacing an earlier pending one. ErrTwoFactorEnabled is returned if the
+// user already has two-factor authentication on.
+func (s Storage) SetUserTOTPSecret(userID int64, secret string) error {
+	query := `
+		UPDATE users
+		SET totp_secret = ?, totp_last_step = 0, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND totp_enabled_at IS NULL
+	`
+
+	res, err := s.db.Exec(query, secret, userID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrTwoFactorEnabled
+	}
+
+	return nil
+}
+
+// EnableUserTOTP turns two-factor authentication on with the pending secret
+// of the user, confirmed by a code of the step. It stores the recovery codes
+// and ends the user's other sessions, signed in without the second factor.
+// ErrNotFound is returned if there is no pending secret.
+func (s Storage) EnableUserTOTP(userID, step int64, recoveryCodeHashes []string, sessionID int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users
+		SET totp_enabled_at = CURRENT_TIMESTAMP, totp_last_step = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND totp_secret IS NOT NULL AND totp_enabled_at IS NULL
+	`
+
+	res, err := tx.Exec(query, step, userID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	if err := replaceRecoveryCodes(tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+
+	if err := revokeUserSessions(tx, userID, sessionID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DisableUserTOTP turns two-factor authentication off for the user and
+// drops the recovery codes.
+func (s Storage) DisableUserTOTP(userID int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users
+		SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+
+	res, err := tx.Exec(query, userID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep marks the time step of a code as used. ErrNotFound is returned
+// if a code of the step or a later one was already used.
+func (s Storage) UseTOTPStep(userID, step int64) error {
+	res, err := s.db.Exec(`UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?`, step, userID, step)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// ReplaceRecoveryCodes swaps the recovery codes of the user for new ones.
+func (s Storage) ReplaceRecoveryCodes(userID int64, codeHashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(tx, userID, codeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(q querier, userID int64, codeHashes []string) error {
+	if _, err := q.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+
+	for _, hash := range codeHashes {
+		if _, err := q.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)`, userID, hash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UseRecoveryCode spends a recovery code of the user. ErrNotFound is
+// returned for an unknown or used code.
+func (s Storage) UseRecoveryCode(userID int64, codeHash string) error {
+	query := `
+		UPDATE recovery_codes
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+	`
+
+	res, err := s.db.Exec(query, userID, codeHash)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// CountRecoveryCodes returns the number of unused recovery codes of the
+// user.
+func (s Storage) CountRecoveryCodes(userID int64) (int, error) {
+	var count int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL`, userID).Scan(&count)
+
+	return count, err
+}
+
+// IsTwoFactorRequired tells if every admin user must sign in with two-factor
+// authentication.
+func (s Storage) IsTwoFactorRequired() (bool, error) {
+	var required bool
+	err := s.db.QueryRow(`SELECT two_factor_required FROM admin_settings WHERE id = 1`).Scan(&required)
+
+	return required, err
+}
+
+// SetTwoFactorRequired changes whether every admin user must use two-factor
+// authentication. Requiring it ends the sessions of the users without it,
+// who set it up when they sign in again.
+func (s Storage) SetTwoFactorRequired(required bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE admin_settings SET two_factor_required = ? WHERE id = 1`, required); err != nil {
+		return err
+	}
+
+	if required {
+		query := `
+			UPDATE admin_sessions
+			SET revoked_at = CURRENT_TIMESTAMP
+			WHERE revoked_at IS NULL AND user_id IN (SELECT id FROM users WHERE totp_enabled_at IS NULL)
+		`
+
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// SignInChallenge is a sign-in with the right password that waits for the
+// second factor. It is identified by a token only the hash of which is
+// stored.
+type SignInChallenge struct {
+	ID     int64 `db:"id"`
+	UserID int64 `db:"user_id"`
+	// Attempts is the number of wrong codes entered for the challenge.
+	Attempts  int       `db:"attempts"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// CreateSignInChallenge starts a challenge for the user that lasts ttl.
+func (s Storage) CreateSignInChallenge(userID int64, tokenHash string, ttl time.Duration) error {
+	query := `
+		INSERT INTO sign_in_challenges (user_id, token_hash, expires_at)
+		VALUES (?, ?, datetime('now', ?))
+	`
+
+	_, err := s.db.Exec(query, userID, tokenHash, ttlModifier(ttl))
+
+	return err
+}
+
+// GetSignInChallenge returns the pending challenge of the token, ErrNotFound
+// if it's unknown, completed or expired.
+func (s Storage) GetSignInChallenge(tokenHash string) (*SignInChallenge, error) {
+	var ch SignInChallenge
+
+	query := `
+		SELECT id, user_id, attempts, expires_at
+		FROM sign_in_challenges
+		WHERE token_hash = ? AND completed_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+	`
+
+	err := s.db.QueryRow(query, tokenHash).Scan(&ch.ID, &ch.UserID, &ch.Attempts, &ch.ExpiresAt)
+	if err != nil && IsNoRowsError(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &ch, nil
+}
+
+// FailSignInChallenge counts a wrong code entered for the challenge.
+func (s Storage) FailSignInChallenge(id int64) error {
+	_, err := s.db.Exec(`UPDATE sign_in_challenges SET attempts = attempts + 1 WHERE id = ?`, id)
+
+	return err
+}
+
+// CompleteSignInChallenge marks the challenge as passed, so its token can't
+// be used again. ErrNotFound is returned if it was completed already.
+func (s Storage) CompleteSignInChallenge(id int64) error {
+	res, err := s.db.Exec(`UPDATE sign_in_challenges SET completed_at = CURRENT_TIMESTAMP WHERE id = ? AND completed_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package db
+
+type VariantPrice struct {
+	VariantID    int64  `db:"variant_id" json:"variant_id"`
+	CurrencyCode string `db:"currency_code" json:"currency_code"`
+	Price        int    `db:"price" json:"price"`
+}
+
+func (s Storage) GetProductVariant(productID, variantID int64) (*ProductVariant, error) {
+	product, err := s.GetProduct(GetProductQuery{ID: productID, IncludeUnpublished: true})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range product.Variants {
+		if v.ID == variantID {
+			return &v, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (s Storage) CreateProductVariant(productID int64, v ProductVariant) (*ProductVariant, error) {
+	query := `
+		INSERT INTO product_variants (product_id, name, available)
+		SELECT p.id, ?, ?
+		FROM products p
+		WHERE p.id = ? AND p.deleted_at IS NULL
+	`
+
+	res, err := s.db.Exec(query, v.Name, v.Available, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrNotFound
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetProductVariant(productID, id)
+}
+
+func (s Storage) UpdateProductVariant(productID int64, v ProductVariant) (*ProductVariant, error) {
+	query := `
+		UPDATE product_variants
+		SET name = ?, available = ?
+		WHERE id = ? AND product_id = ? AND deleted_at IS NULL
+	`
+
+	res, err := s.db.Exec(query, v.Name, v.Available, v.ID, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrNotFound
+	}
+
+	return s.GetProductVariant(productID, v.ID)
+}
+
+// DeleteProductVariant soft-deletes a variant. Line items and orders keep
+// referencing it, but it can no longer be added to a cart.
+func (s Storage) DeleteProductVariant(productID, variantID int64) error {
+	query := `
+		UPDATE product_variants
+		SET deleted_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND product_id = ? AND deleted_at IS NULL
+	`
+
+	res, err := s.db.Exec(query, variantID, productID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// SaveVariantPrice creates or replaces the price of a variant in a currency.
+func (s Storage) SaveVariantPrice(productID int64, price VariantPrice) error {
+	query := `
+		INSERT INTO variant_prices (variant_id, price, currency_code)
+		SELECT pv.id, ?, c.code
+		FROM product_variants pv
+		JOIN currencies c ON c.code = ?
+		WHERE pv.id = ? AND pv.product_id = ? AND pv.deleted_at IS NULL
+		ON CONFLICT (variant_id, currency_code) DO UPDATE SET price = excluded.price
+	`
+
+	res, err := s.db.Exec(query, price.Price, price.CurrencyCode, price.VariantID, productID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s Storage) DeleteVariantPrice(productID, variantID int64, currencyCode string) error {
+	query := `
+		DELETE FROM variant_prices
+		WHERE currency_code = ? AND variant_id IN (
+			SELECT id FROM product_variants WHERE id = ? AND product_id = ?
+		)
+	`
+
+	res, err := s.db.Exec(query, currencyCode, variantID, productID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
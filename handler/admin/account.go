@@ -0,0 +1,315 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"log"
+	"math/rand"
+	"net/http"
+	"rednit/db"
+	"rednit/terrors"
+	"strconv"
+	"time"
+)
+
+const (
+	invitationTTL    = 72 * time.Hour
+	passwordResetTTL = time.Hour
+)
+
+func randomAvatarURL() string {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return fmt.Sprintf("https://assets.clanplatform.com/avatar%d.svg", r.Intn(10)+1)
+}
+
+// invite stores the invitation and sends its link to the invited email.
+func (a Admin) invite(inv db.Invitation) (*db.Invitation, error) {
+	token, tokenHash, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	created, err := a.s.CreateInvitation(inv, tokenHash, invitationTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	message := fmt.Sprintf("You are invited to manage the shop as %s. Create your account within %d hours:\n%s/invitation?token=%s",
+		created.Role, int(invitationTTL.Hours()), a.cfg.AdminURL, token)
+
+	if err := a.notifier.Notify(created.Email, "Your invitation", message); err != nil {
+		// nobody got the link, the invitation would only block the email
+		if err := a.s.DeleteInvitation(created.ID); err != nil {
+			log.Printf("failed to delete invitation %d: %v", created.ID, err)
+		}
+
+		return nil, err
+	}
+
+	return created, nil
+}
+
+// InviteOwner invites the first owner of the shop, who can then invite
+// everyone else.
+func (a Admin) InviteOwner(email string) error {
+	_, err := a.invite(db.Invitation{Email: email, Role: db.RoleOwner})
+	return err
+}
+
+type InvitationRequest struct {
+	Email string  `json:"email" validate:"required,email"`
+	Name  *string `json:"name" validate:"omitempty,max=255"`
+	Role  string  `json:"role" validate:"required,oneof=owner manager fulfillment viewer"`
+}
+
+func (a Admin) InviteUser(c echo.Context) error {
+	var req InvitationRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	uid := getUserID(c)
+
+	invitation, err := a.invite(db.Invitation{
+		Email:     req.Email,
+		Name:      req.Name,
+		Role:      req.Role,
+		InvitedBy: &uid,
+	})
+
+	if err != nil && errors.Is(err, db.ErrAlreadyExists) {
+		return terrors.Conflict(err, "user with this email already exists")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to send invitation")
+	}
+
+	return c.JSON(http.StatusCreated, invitation)
+}
+
+func (a Admin) ListInvitations(c echo.Context) error {
+	invitations, err := a.s.ListInvitations()
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to list invitations")
+	}
+
+	return c.JSON(http.StatusOK, invitations)
+}
+
+func (a Admin) DeleteInvitation(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		return terrors.BadRequest(errors.New("invalid invitation id"), "invalid invitation id")
+	}
+
+	if err := a.s.DeleteInvitation(id); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "invitation not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to delete invitation")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+type AcceptInvitationRequest struct {
+	Token    string  `json:"token" validate:"required"`
+	Password string  `json:"password" validate:"required,min=8,max=72"`
+	Name     *string `json:"name" validate:"omitempty,max=255"`
+}
+
+// AcceptInvitation creates the account of an invited user, who then signs
+// in as usual.
+func (a Admin) AcceptInvitation(c echo.Context) error {
+	var req AcceptInvitationRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	hashedPassword, err := HashPassword(req.Password)
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to hash password")
+	}
+
+	user, err := a.s.AcceptInvitation(hashToken(req.Token), db.User{
+		Password:  hashedPassword,
+		Name:      req.Name,
+		AvatarURL: randomAvatarURL(),
+	})
+
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.BadRequest(err, "invitation is invalid or expired")
+	} else if err != nil && errors.Is(err, db.ErrAlreadyExists) {
+		return terrors.Conflict(err, "user with this email already exists")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to accept invitation")
+	}
+
+	return c.JSON(http.StatusCreated, user)
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required,min=8,max=72"`
+}
+
+// ChangePassword sets a new password for the signed-in user, who is signed
+// out on the other devices.
+func (a Admin) ChangePassword(c echo.Context) error {
+	var req ChangePasswordRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	claims := getClaims(c)
+
+	user, err := a.s.GetUserByID(claims.UID)
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to get user")
+	}
+
+	if err := CheckPassword(user.Password, req.CurrentPassword); err != nil {
+		return terrors.BadRequest(err, "current password is wrong")
+	}
+
+	hashedPassword, err := HashPassword(req.NewPassword)
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to hash password")
+	}
+
+	if err := a.s.UpdateUserPassword(user.ID, hashedPassword, claims.SessionID); err != nil {
+		return terrors.InternalServerError(err, "failed to change password")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+type PasswordResetRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// RequestPasswordReset sends a password reset link to the user with the
+// email. It answers the same whether there is such a user or not.
+func (a Admin) RequestPasswordReset(c echo.Context) error {
+	var req PasswordResetRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	// reset links are throttled, so that they can't be used to flood a
+	// mailbox or probe for accounts
+	if err := a.checkPasswordResetThrottle(c, req.Email); err != nil {
+		return err
+	}
+
+	token, tokenHash, err := newToken()
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to generate token")
+	}
+
+	user, err := a.s.CreatePasswordReset(req.Email, tokenHash, passwordResetTTL)
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		if err := a.recordSignIn(c, req.Email, 0, db.AuthPasswordResetRequested); err != nil {
+			return err
+		}
+
+		return c.NoContent(http.StatusNoContent)
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to reset password")
+	}
+
+	if err := a.recordSignIn(c, req.Email, user.ID, db.AuthPasswordResetRequested); err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("Someone asked to reset your password. If it was you, set a new one within %d minutes:\n%s/reset-password?token=%s",
+		int(passwordResetTTL.Minutes()), a.cfg.AdminURL, token)
+
+	if err := a.notifier.Notify(user.Email, "Reset your password", message); err != nil {
+		return terrors.InternalServerError(err, "failed to send password reset link")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,min=8,max=72"`
+}
+
+// ResetPassword sets a new password with the token of a reset link and
+// signs the user out everywhere.
+func (a Admin) ResetPassword(c echo.Context) error {
+	var req ResetPasswordRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	hashedPassword, err := HashPassword(req.Password)
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to hash password")
+	}
+
+	if err := a.s.ResetPassword(hashToken(req.Token), hashedPassword); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.BadRequest(err, "reset link is invalid or expired")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to reset password")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (a Admin) setUserActive(c echo.Context, active bool) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		return terrors.BadRequest(errors.New("invalid user id"), "invalid user id")
+	}
+
+	if !active && id == getUserID(c) {
+		return terrors.BadRequest(errors.New("can't deactivate yourself"), "you can't deactivate yourself")
+	}
+
+	if err := a.s.SetUserActive(id, active); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "user not found")
+	} else if err != nil && errors.Is(err, db.ErrLastOwner) {
+		return terrors.Conflict(err, "the last owner can't be deactivated")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to update user")
+	}
+
+	user, err := a.s.GetUserByID(id)
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to get user")
+	}
+
+	return c.JSON(http.StatusOK, user)
+}
+
+// DeactivateUser stops the user from signing in and ends the user's
+// sessions. The account and its history are kept.
+func (a Admin) DeactivateUser(c echo.Context) error {
+	return a.setUserActive(c, false)
+}
+
+func (a Admin) ActivateUser(c echo.Context) error {
+	return a.setUserActive(c, true)
+}
@@ -1,29 +1,35 @@
 package admin
 
 import (
-	"fmt"
+	"errors"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
 	"golang.org/x/crypto/bcrypt"
-	"math/rand"
 	"net/http"
 	"rednit/db"
 	"rednit/terrors"
+	"strconv"
 	"time"
 )
 
 type JWTClaims struct {
 	jwt.RegisteredClaims
-	UID    int64 `json:"uid"`
-	ChatID int64 `json:"chat_id"`
+	UID    int64  `json:"uid"`
+	ChatID int64  `json:"chat_id"`
+	Role   string `json:"role"`
+	// SessionID is the session the token was issued for, the token is
+	// rejected once it's revoked.
+	SessionID int64 `json:"sid"`
 }
 
-func generateJWT(secret string, uid int64) (string, error) {
+func generateJWT(secret string, lifetime time.Duration, user *db.User, sessionID int64) (string, error) {
 	claims := &JWTClaims{
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(lifetime)),
 		},
-		UID: uid,
+		UID:       user.ID,
+		Role:      user.Role,
+		SessionID: sessionID,
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
@@ -36,6 +42,71 @@ func generateJWT(secret string, uid int64) (string, error) {
 	return t, nil
 }
 
+// parseJWT verifies the token with the current secret, then with the
+// previous one for tokens signed before the secret was rotated.
+func (a Admin) parseJWT(t string) (*jwt.Token, error) {
+	secrets := []string{a.cfg.Auth.JWTSecret}
+	if a.cfg.Auth.JWTPreviousSecret != "" {
+		secrets = append(secrets, a.cfg.Auth.JWTPreviousSecret)
+	}
+
+	var err error
+	for _, secret := range secrets {
+		var token *jwt.Token
+		token, err = jwt.ParseWithClaims(t, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
+			return []byte(secret), nil
+		}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+
+		if err == nil && token.Valid {
+			return token, nil
+		} else if err != nil && !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+			return nil, err
+		}
+	}
+
+	return nil, err
+}
+
+// authCookie is an HttpOnly cookie carrying a token, or removing it if the
+// token is empty.
+func (a Admin) authCookie(name, token string, lifetime time.Duration) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    token,
+		Domain:   a.cfg.Auth.CookieDomain,
+		Path:     "/",
+		MaxAge:   int(lifetime.Seconds()),
+		Secure:   a.cfg.Auth.CookieSecure,
+		HttpOnly: true,
+		SameSite: a.cfg.Auth.SameSite(),
+	}
+
+	if token == "" {
+		cookie.MaxAge = -1
+	}
+
+	return cookie
+}
+
+// setSessionCookies sets the access token of the session and its refresh
+// token.
+func (a Admin) setSessionCookies(c echo.Context, user *db.User, session *db.Session, refreshToken string) error {
+	token, err := generateJWT(a.cfg.Auth.JWTSecret, a.cfg.Auth.TokenLifetime, user, session.ID)
+	if err != nil {
+		return terrors.InternalServerError(err, "Failed to generate JWT")
+	}
+
+	c.SetCookie(a.authCookie(a.cfg.Auth.CookieName, token, a.cfg.Auth.TokenLifetime))
+	c.SetCookie(a.authCookie(a.cfg.Auth.RefreshCookieName, refreshToken, a.cfg.Auth.SessionLifetime))
+
+	return nil
+}
+
+func (a Admin) clearSessionCookies(c echo.Context) {
+	c.SetCookie(a.authCookie(a.cfg.Auth.CookieName, "", 0))
+	c.SetCookie(a.authCookie(a.cfg.Auth.RefreshCookieName, "", 0))
+}
+
 func CheckPassword(hashedPassword, password string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
 }
@@ -45,6 +116,9 @@ type LoginRequest struct {
 	Password string `json:"password" validate:"required"`
 }
 
+// LoginUser checks the password and starts a session, or a challenge for the
+// second factor if the user has two-factor authentication on or is required
+// to set it up.
 func (a Admin) LoginUser(c echo.Context) error {
 	var req LoginRequest
 	if err := c.Bind(&req); err != nil {
@@ -55,80 +129,79 @@ func (a Admin) LoginUser(c echo.Context) error {
 		return terrors.BadRequest(err, "Invalid request")
 	}
 
+	if err := a.checkSignInThrottle(c, req.Email); err != nil {
+		return err
+	}
+
 	user, err := a.s.GetUserByEmail(req.Email)
-	if err != nil {
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		if err := a.recordSignIn(c, req.Email, 0, db.AuthSignInFailed); err != nil {
+			return err
+		}
+
 		return terrors.Unauthorized(err, "Unauthorized")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "Failed to get user")
 	}
 
 	if err = CheckPassword(user.Password, req.Password); err != nil {
+		if err := a.recordSignIn(c, req.Email, user.ID, db.AuthSignInFailed); err != nil {
+			return err
+		}
+
 		return terrors.Unauthorized(err, "Unauthorized")
 	}
 
-	token, err := generateJWT("your_secret_key", user.ID)
-	if err != nil {
-		return terrors.InternalServerError(err, "Failed to generate JWT")
-	}
+	if user.DeletedAt != nil {
+		if err := a.recordSignIn(c, req.Email, user.ID, db.AuthSignInFailed); err != nil {
+			return err
+		}
 
-	// Set JWT in HttpOnly cookie
-	cookie := new(http.Cookie)
-	cookie.Name = "clan_cookie"
-	cookie.Value = token
-	cookie.Secure = true
-	cookie.SameSite = http.SameSiteNoneMode
-	cookie.Path = "/"
-	cookie.MaxAge = 86400
-	cookie.HttpOnly = true
+		return terrors.Unauthorized(errors.New("user is deactivated"), "account is deactivated")
+	}
 
-	c.SetCookie(cookie)
+	required, err := a.s.IsTwoFactorRequired()
+	if err != nil {
+		return terrors.InternalServerError(err, "Failed to get settings")
+	}
 
-	return c.JSON(http.StatusOK, user)
-}
+	if user.TwoFactorEnabled || required {
+		return a.challengeSignIn(c, user)
+	}
 
-func HashPassword(password string) (string, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return "", err
+	if err := a.startSession(c, user); err != nil {
+		return err
 	}
-	return string(hashedPassword), nil
-}
 
-type CreateUserRequest struct {
-	Email    string  `json:"email" validate:"required,email"`
-	Password string  `json:"password" validate:"required"`
-	Name     *string `json:"name"`
+	return c.JSON(http.StatusOK, user)
 }
 
-func (a Admin) CreateUser(c echo.Context) error {
-	var req CreateUserRequest
-	if err := c.Bind(&req); err != nil {
-		return terrors.BadRequest(err, "Invalid request")
+// startSession records the successful sign-in of the user and sets the
+// cookies of a new session.
+func (a Admin) startSession(c echo.Context, user *db.User) error {
+	if err := a.recordSignIn(c, user.Email, user.ID, db.AuthSignInSucceeded); err != nil {
+		return err
 	}
 
-	if err := c.Validate(req); err != nil {
-		return terrors.BadRequest(err, "Invalid request")
+	refreshToken, tokenHash, err := newToken()
+	if err != nil {
+		return terrors.InternalServerError(err, "Failed to generate refresh token")
 	}
 
-	hashedPassword, err := HashPassword(req.Password)
+	session, err := a.s.CreateSession(user.ID, tokenHash, c.RealIP(), c.Request().UserAgent(), a.cfg.Auth.SessionLifetime)
 	if err != nil {
-		return terrors.InternalServerError(err, "Failed to hash password")
+		return terrors.InternalServerError(err, "Failed to create session")
 	}
 
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	avatarURL := fmt.Sprintf("https://assets.clanplatform.com/avatar%d.svg", r.Intn(10)+1)
-
-	user := db.User{
-		Email:     req.Email,
-		Password:  hashedPassword,
-		Name:      req.Name,
-		AvatarURL: avatarURL,
-	}
+	return a.setSessionCookies(c, user, session, refreshToken)
+}
 
-	res, err := a.s.CreateUser(user)
+func HashPassword(password string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		return terrors.InternalServerError(err, "Failed to create user")
+		return "", err
 	}
-
-	return c.JSON(http.StatusCreated, res)
+	return string(hashedPassword), nil
 }
 
 func (a Admin) GetUserMe(c echo.Context) error {
@@ -143,10 +216,54 @@ func (a Admin) GetUserMe(c echo.Context) error {
 }
 
 func (a Admin) ListUsers(c echo.Context) error {
-	users, err := a.s.ListUsers()
+	q, err := bindListQuery(c)
 	if err != nil {
-		return terrors.InternalServerError(err, "failed to list customers")
+		return err
+	}
+
+	users, err := a.s.ListUsers(q)
+	if err != nil && errors.Is(err, db.ErrInvalidCursor) {
+		return terrors.BadRequest(err, "invalid cursor")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to list users")
 	}
 
 	return c.JSON(http.StatusOK, users)
 }
+
+type UpdateUserRoleRequest struct {
+	Role string `json:"role" validate:"required,oneof=owner manager fulfillment viewer"`
+}
+
+// UpdateUserRole changes the role of an admin user. The change applies from
+// the user's next request.
+func (a Admin) UpdateUserRole(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		return terrors.BadRequest(errors.New("invalid user id"), "invalid user id")
+	}
+
+	var req UpdateUserRoleRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	if err := a.s.UpdateUserRole(id, req.Role); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "user not found")
+	} else if err != nil && errors.Is(err, db.ErrLastOwner) {
+		return terrors.Conflict(err, "the last owner can't be demoted")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to update user role")
+	}
+
+	user, err := a.s.GetUserByID(id)
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to get user")
+	}
+
+	return c.JSON(http.StatusOK, user)
+}
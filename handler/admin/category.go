@@ -0,0 +1,206 @@
+package admin
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"rednit/db"
+	"rednit/terrors"
+	"strconv"
+)
+
+func categoryIDParam(c echo.Context) (int64, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		return 0, terrors.BadRequest(errors.New("invalid category id"), "invalid category id")
+	}
+
+	return id, nil
+}
+
+func (a Admin) ListCategories(c echo.Context) error {
+	categories, err := a.s.ListCategories("")
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to list categories")
+	}
+
+	return c.JSON(http.StatusOK, categories)
+}
+
+func (a Admin) GetCategory(c echo.Context) error {
+	id, err := categoryIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	category, err := a.s.GetCategory(id)
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "category not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to get category")
+	}
+
+	return c.JSON(http.StatusOK, category)
+}
+
+type CategoryRequest struct {
+	Handle   string `json:"handle" validate:"required,max=255"`
+	Name     string `json:"name" validate:"required,max=255"`
+	Position int    `json:"position"`
+}
+
+func (r CategoryRequest) toCategory() db.Category {
+	return db.Category{
+		Handle:   r.Handle,
+		Name:     r.Name,
+		Position: r.Position,
+	}
+}
+
+func (a Admin) CreateCategory(c echo.Context) error {
+	var req CategoryRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	category, err := a.s.CreateCategory(req.toCategory())
+	if err != nil && errors.Is(err, db.ErrAlreadyExists) {
+		return terrors.Conflict(err, "category with this handle or name already exists")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to create category")
+	}
+
+	return c.JSON(http.StatusCreated, category)
+}
+
+func (a Admin) UpdateCategory(c echo.Context) error {
+	id, err := categoryIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	var req CategoryRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	cat := req.toCategory()
+	cat.ID = id
+
+	category, err := a.s.UpdateCategory(cat)
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "category not found")
+	} else if err != nil && errors.Is(err, db.ErrAlreadyExists) {
+		return terrors.Conflict(err, "category with this handle or name already exists")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to update category")
+	}
+
+	return c.JSON(http.StatusOK, category)
+}
+
+func (a Admin) DeleteCategory(c echo.Context) error {
+	id, err := categoryIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	if err := a.s.DeleteCategory(id); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "category not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to delete category")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+type CategoryTranslationRequest struct {
+	Language string `param:"language" json:"-" validate:"required,len=2,lowercase"`
+	Name     string `json:"name" validate:"required,max=255"`
+}
+
+func (a Admin) SaveCategoryTranslation(c echo.Context) error {
+	categoryID, err := categoryIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	var req CategoryTranslationRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	translation, err := a.s.SaveCategoryTranslation(db.CategoryTranslation{
+		CategoryID: categoryID,
+		Language:   req.Language,
+		Name:       req.Name,
+	})
+
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "category not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to save category translation")
+	}
+
+	return c.JSON(http.StatusOK, translation)
+}
+
+func (a Admin) DeleteCategoryTranslation(c echo.Context) error {
+	categoryID, err := categoryIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	if err := a.s.DeleteCategoryTranslation(categoryID, c.Param("language")); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "translation not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to delete category translation")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+type ProductCategoriesRequest struct {
+	CategoryIDs []int64 `json:"category_ids" validate:"unique,dive,required"`
+}
+
+func (a Admin) SetProductCategories(c echo.Context) error {
+	productID, err := productIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	var req ProductCategoriesRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	if err := a.s.SetProductCategories(productID, req.CategoryIDs); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "product or category not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to set product categories")
+	}
+
+	product, err := a.s.GetProduct(db.GetProductQuery{ID: productID, IncludeUnpublished: true})
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to get product")
+	}
+
+	return c.JSON(http.StatusOK, product)
+}
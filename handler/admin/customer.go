@@ -1,14 +1,23 @@
 package admin
 
 import (
+	"errors"
 	"github.com/labstack/echo/v4"
 	"net/http"
+	"rednit/db"
 	"rednit/terrors"
 )
 
 func (a Admin) ListCustomers(c echo.Context) error {
-	customers, err := a.s.ListCustomers()
+	q, err := bindListQuery(c)
 	if err != nil {
+		return err
+	}
+
+	customers, err := a.s.ListCustomers(q)
+	if err != nil && errors.Is(err, db.ErrInvalidCursor) {
+		return terrors.BadRequest(err, "invalid cursor")
+	} else if err != nil {
 		return terrors.InternalServerError(err, "failed to list customers")
 	}
 
@@ -1,16 +1,296 @@
 package admin
 
 import (
+	"encoding/csv"
+	"errors"
+	"fmt"
 	"github.com/labstack/echo/v4"
 	"net/http"
+	"rednit/db"
 	"rednit/terrors"
+	"strconv"
+	"time"
 )
 
 func (a Admin) ListDiscounts(c echo.Context) error {
-	customers, err := a.s.ListDiscounts()
+	q, err := bindListQuery(c, db.DiscountStatusActive, db.DiscountStatusInactive)
 	if err != nil {
-		return terrors.InternalServerError(err, "failed to list customers")
+		return err
 	}
 
-	return c.JSON(http.StatusOK, customers)
+	discounts, err := a.s.ListDiscounts(q)
+	if err != nil && errors.Is(err, db.ErrInvalidCursor) {
+		return terrors.BadRequest(err, "invalid cursor")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to list discounts")
+	}
+
+	return c.JSON(http.StatusOK, discounts)
+}
+
+func discountIDParam(c echo.Context) (int64, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		return 0, terrors.BadRequest(errors.New("invalid discount id"), "invalid discount id")
+	}
+
+	return id, nil
+}
+
+func (a Admin) GetDiscount(c echo.Context) error {
+	id, err := discountIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	discount, err := a.s.GetDiscount(db.DiscountQuery{ID: id})
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "discount not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to get discount")
+	}
+
+	return c.JSON(http.StatusOK, discount)
+}
+
+type DiscountAmountRequest struct {
+	CurrencyCode string `json:"currency_code" validate:"required,iso4217"`
+	Value        int    `json:"value" validate:"min=0"`
+	MinSubtotal  int    `json:"min_subtotal" validate:"min=0"`
+}
+
+// DiscountTermsRequest is what a discount gives and when it applies, shared
+// by single discounts and generated codes.
+type DiscountTermsRequest struct {
+	Type            string                  `json:"type" validate:"required,oneof=percentage fixed free_shipping"`
+	Value           int                     `json:"value" validate:"min=0"`
+	IsActive        bool                    `json:"is_active"`
+	StartsAt        *time.Time              `json:"starts_at"`
+	EndsAt          *time.Time              `json:"ends_at"`
+	MinSubtotal     int                     `json:"min_subtotal" validate:"min=0"`
+	OncePerCustomer bool                    `json:"once_per_customer"`
+	Amounts         []DiscountAmountRequest `json:"amounts" validate:"unique=CurrencyCode,dive"`
+	ProductIDs      []int64                 `json:"product_ids" validate:"dive,required"`
+	CategoryIDs     []int64                 `json:"category_ids" validate:"dive,required"`
+}
+
+func (r DiscountTermsRequest) validate() error {
+	if r.Type == db.DiscountPercentage && r.Value > 100 {
+		return terrors.BadRequest(errors.New("invalid discount value"), "percentage can't exceed 100")
+	}
+
+	if r.StartsAt != nil && r.EndsAt != nil && !r.EndsAt.After(*r.StartsAt) {
+		return terrors.BadRequest(errors.New("invalid discount period"), "discount must end after it starts")
+	}
+
+	return nil
+}
+
+func (r DiscountTermsRequest) toDiscount() db.Discount {
+	d := db.Discount{
+		Type:            r.Type,
+		Value:           r.Value,
+		IsActive:        r.IsActive,
+		EndsAt:          r.EndsAt,
+		MinSubtotal:     r.MinSubtotal,
+		OncePerCustomer: r.OncePerCustomer,
+		ProductIDs:      r.ProductIDs,
+		CategoryIDs:     r.CategoryIDs,
+	}
+
+	if r.StartsAt != nil {
+		d.StartsAt = *r.StartsAt
+	}
+
+	for _, amount := range r.Amounts {
+		d.Amounts = append(d.Amounts, db.DiscountAmount{
+			CurrencyCode: amount.CurrencyCode,
+			Value:        amount.Value,
+			MinSubtotal:  amount.MinSubtotal,
+		})
+	}
+
+	return d
+}
+
+type DiscountRequest struct {
+	Code       string `json:"code" validate:"required,max=64"`
+	UsageLimit int    `json:"usage_limit" validate:"min=0"`
+	DiscountTermsRequest
+}
+
+func (r DiscountRequest) toDiscount() db.Discount {
+	d := r.DiscountTermsRequest.toDiscount()
+	d.Code = r.Code
+	d.UsageLimit = r.UsageLimit
+
+	return d
+}
+
+func (a Admin) CreateDiscount(c echo.Context) error {
+	var req DiscountRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	if err := req.validate(); err != nil {
+		return err
+	}
+
+	discount, err := a.s.CreateDiscount(req.toDiscount())
+	if err != nil && errors.Is(err, db.ErrAlreadyExists) {
+		return terrors.Conflict(err, "discount with this code already exists")
+	} else if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.BadRequest(err, "product or category not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to create discount")
+	}
+
+	return c.JSON(http.StatusCreated, discount)
+}
+
+func (a Admin) UpdateDiscount(c echo.Context) error {
+	id, err := discountIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	var req DiscountRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	if err := req.validate(); err != nil {
+		return err
+	}
+
+	d := req.toDiscount()
+	d.ID = id
+
+	discount, err := a.s.UpdateDiscount(d)
+	if err != nil && errors.Is(err, db.ErrAlreadyExists) {
+		return terrors.Conflict(err, "discount with this code already exists")
+	} else if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "discount, product or category not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to update discount")
+	}
+
+	return c.JSON(http.StatusOK, discount)
+}
+
+func (a Admin) setDiscountActive(c echo.Context, active bool) error {
+	id, err := discountIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	if err := a.s.SetDiscountActive(id, active); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "discount not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to update discount")
+	}
+
+	discount, err := a.s.GetDiscount(db.DiscountQuery{ID: id})
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to get discount")
+	}
+
+	return c.JSON(http.StatusOK, discount)
+}
+
+func (a Admin) ActivateDiscount(c echo.Context) error {
+	return a.setDiscountActive(c, true)
+}
+
+func (a Admin) DeactivateDiscount(c echo.Context) error {
+	return a.setDiscountActive(c, false)
+}
+
+func (a Admin) DeleteDiscount(c echo.Context) error {
+	id, err := discountIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	if err := a.s.DeleteDiscount(id); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "discount not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to delete discount")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+type GenerateDiscountsRequest struct {
+	Prefix string `json:"prefix" validate:"required,alphanum,max=32"`
+	Count  int    `json:"count" validate:"required,min=1,max=1000"`
+	DiscountTermsRequest
+}
+
+// GenerateDiscounts creates single-use codes for a campaign and returns them
+// as a CSV file.
+func (a Admin) GenerateDiscounts(c echo.Context) error {
+	var req GenerateDiscountsRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	if err := req.validate(); err != nil {
+		return err
+	}
+
+	discounts, err := a.s.GenerateDiscounts(req.toDiscount(), req.Prefix, req.Count)
+	if err != nil && errors.Is(err, db.ErrAlreadyExists) {
+		return terrors.Conflict(err, "failed to generate unique codes")
+	} else if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.BadRequest(err, "product or category not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to generate discounts")
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "text/csv")
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", req.Prefix+".csv"))
+	c.Response().WriteHeader(http.StatusCreated)
+
+	w := csv.NewWriter(c.Response())
+	if err := w.Write([]string{"id", "code", "type", "value", "starts_at", "ends_at"}); err != nil {
+		return err
+	}
+
+	for _, d := range discounts {
+		var endsAt string
+		if d.EndsAt != nil {
+			endsAt = d.EndsAt.Format(time.RFC3339)
+		}
+
+		record := []string{
+			strconv.FormatInt(d.ID, 10),
+			d.Code,
+			d.Type,
+			strconv.Itoa(d.Value),
+			d.StartsAt.Format(time.RFC3339),
+			endsAt,
+		}
+
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+
+	return w.Error()
 }
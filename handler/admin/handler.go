@@ -3,24 +3,103 @@ package admin
 import (
 	"rednit/config"
 	"rednit/db"
+	"rednit/notification"
+	"rednit/payment"
+	"time"
 )
 
 type storage interface {
 	GetUserByID(id int64) (*db.User, error)
 	GetUserByEmail(email string) (*db.User, error)
-	CreateUser(user db.User) (*db.User, error)
-	ListCustomers() ([]db.Customer, error)
-	ListDiscounts() ([]db.Discount, error)
-	ListOrders() ([]db.Order, error)
-	ListProducts(params db.ListProductsQuery) ([]db.Product, error)
-	ListUsers() ([]db.User, error)
+	ListCustomers(q db.ListQuery) (*db.Page[db.Customer], error)
+	ListDiscounts(q db.ListQuery) (*db.Page[db.Discount], error)
+	GetDiscount(query db.DiscountQuery) (*db.Discount, error)
+	CreateDiscount(d db.Discount) (*db.Discount, error)
+	UpdateDiscount(d db.Discount) (*db.Discount, error)
+	SetDiscountActive(id int64, active bool) error
+	DeleteDiscount(id int64) error
+	GenerateDiscounts(d db.Discount, prefix string, count int) ([]db.Discount, error)
+	ListOrders(q db.ListQuery) (*db.Page[db.Order], error)
+	GetOrder(query db.GetOrderQuery) (*db.Order, error)
+	UpdateOrderStatus(orderID int64, status db.OrderStatus, userID *int64, note *string) error
+	ListOrderStatusHistory(orderID int64) ([]db.OrderStatusChange, error)
+	CreateRefund(orderID int64, amount int, reason *string, userID *int64) (*db.Refund, error)
+	CompleteRefund(id int64, providerRefundID string) error
+	FailRefund(id int64) error
+	SetRefundProviderID(id int64, providerRefundID string) error
+	GetRefund(id int64) (*db.Refund, error)
+	ListOrderRefunds(orderID int64) ([]db.Refund, error)
+	ListProducts(params db.ListProductsQuery) (*db.Page[db.Product], error)
+	GetProduct(query db.GetProductQuery) (*db.Product, error)
+	CreateProduct(p db.Product) (*db.Product, error)
+	UpdateProduct(p db.Product) (*db.Product, error)
+	SetProductPublished(id int64, published bool) error
+	DeleteProduct(id int64) error
+	GetProductVariant(productID, variantID int64) (*db.ProductVariant, error)
+	CreateProductVariant(productID int64, v db.ProductVariant) (*db.ProductVariant, error)
+	UpdateProductVariant(productID int64, v db.ProductVariant) (*db.ProductVariant, error)
+	DeleteProductVariant(productID, variantID int64) error
+	SaveVariantPrice(productID int64, price db.VariantPrice) error
+	DeleteVariantPrice(productID, variantID int64, currencyCode string) error
+	ListProductTranslations(productID int64) ([]db.ProductTranslation, error)
+	SaveProductTranslation(t db.ProductTranslation) (*db.ProductTranslation, error)
+	DeleteProductTranslation(productID int64, language string) error
+	ListUsers(q db.ListQuery) (*db.Page[db.User], error)
+	UpdateUserRole(id int64, role string) error
+	CreateSession(userID int64, tokenHash, ip, userAgent string, ttl time.Duration) (*db.Session, error)
+	RefreshSession(tokenHash, newTokenHash, ip, userAgent string, ttl time.Duration) (*db.Session, error)
+	GetActiveSessionRole(userID, id int64) (string, error)
+	ListUserSessions(userID int64) ([]db.Session, error)
+	RevokeSession(userID, id int64) error
+	RevokeSessionByToken(tokenHash string) error
+	RevokeUserSessions(userID, exceptID int64) error
+	UpdateUserPassword(id int64, password string, sessionID int64) error
+	CreatePasswordReset(email, tokenHash string, ttl time.Duration) (*db.User, error)
+	ResetPassword(tokenHash, password string) error
+	SetUserActive(id int64, active bool) error
+	CreateInvitation(inv db.Invitation, tokenHash string, ttl time.Duration) (*db.Invitation, error)
+	ListInvitations() ([]db.Invitation, error)
+	DeleteInvitation(id int64) error
+	AcceptInvitation(tokenHash string, u db.User) (*db.User, error)
+	CreateAuthEvent(e db.AuthEvent) error
+	ListSignInFailures(email, ip string, window time.Duration) (*db.SignInFailures, error)
+	ListPasswordResetRequests(email, ip string, window time.Duration) (*db.SignInFailures, error)
+	ListAuthEvents(q db.ListQuery) (*db.Page[db.AuthEvent], error)
+	GetUserTOTP(userID int64) (*db.TOTP, error)
+	SetUserTOTPSecret(userID int64, secret string) error
+	EnableUserTOTP(userID, step int64, recoveryCodeHashes []string, sessionID int64) error
+	DisableUserTOTP(userID int64) error
+	UseTOTPStep(userID, step int64) error
+	ReplaceRecoveryCodes(userID int64, codeHashes []string) error
+	UseRecoveryCode(userID int64, codeHash string) error
+	CountRecoveryCodes(userID int64) (int, error)
+	IsTwoFactorRequired() (bool, error)
+	SetTwoFactorRequired(required bool) error
+	CreateSignInChallenge(userID int64, tokenHash string, ttl time.Duration) error
+	GetSignInChallenge(tokenHash string) (*db.SignInChallenge, error)
+	FailSignInChallenge(id int64) error
+	CompleteSignInChallenge(id int64) error
+	ListCategories(locale string) ([]db.Category, error)
+	GetCategory(id int64) (*db.Category, error)
+	CreateCategory(c db.Category) (*db.Category, error)
+	UpdateCategory(c db.Category) (*db.Category, error)
+	DeleteCategory(id int64) error
+	SaveCategoryTranslation(t db.CategoryTranslation) (*db.CategoryTranslation, error)
+	DeleteCategoryTranslation(categoryID int64, language string) error
+	SetProductCategories(productID int64, categoryIDs []int64) error
+}
+
+type paymentProviders interface {
+	Get(name string) (payment.Provider, error)
 }
 
 type Admin struct {
-	s   storage
-	cfg config.Default
+	s        storage
+	cfg      config.Default
+	payments paymentProviders
+	notifier notification.Notifier
 }
 
-func New(s storage, cfg config.Default) Admin {
-	return Admin{s: s, cfg: cfg}
+func New(s storage, cfg config.Default, p paymentProviders, n notification.Notifier) Admin {
+	return Admin{s: s, cfg: cfg, payments: p, notifier: n}
 }
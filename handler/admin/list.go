@@ -0,0 +1,55 @@
+package admin
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"rednit/db"
+	"rednit/terrors"
+	"slices"
+	"time"
+)
+
+// ListRequest is the paging and filtering of the admin lists, see
+// db.ListQuery. Times are RFC 3339.
+type ListRequest struct {
+	Limit         int        `query:"limit" validate:"min=0,max=100"`
+	Cursor        string     `query:"cursor"`
+	Status        string     `query:"status"`
+	PaymentStatus string     `query:"payment_status"`
+	Provider      string     `query:"provider" validate:"max=64"`
+	From          *time.Time `query:"from"`
+	To            *time.Time `query:"to"`
+	Email         string     `query:"email" validate:"max=255"`
+}
+
+// bindListQuery reads the ListRequest of the request, statuses are the
+// values the status filter accepts.
+func bindListQuery(c echo.Context, statuses ...string) (db.ListQuery, error) {
+	var req ListRequest
+	if err := c.Bind(&req); err != nil {
+		return db.ListQuery{}, err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return db.ListQuery{}, err
+	}
+
+	if req.Status != "" && !slices.Contains(statuses, req.Status) {
+		return db.ListQuery{}, terrors.BadRequest(errors.New("invalid status"), "invalid status")
+	}
+
+	if req.From != nil && req.To != nil && !req.To.After(*req.From) {
+		return db.ListQuery{}, terrors.BadRequest(errors.New("invalid date range"), "to must be after from")
+	}
+
+	return db.ListQuery{
+		Limit:         req.Limit,
+		Cursor:        req.Cursor,
+		Status:        req.Status,
+		PaymentStatus: req.PaymentStatus,
+		Provider:      req.Provider,
+		CreatedFrom:   req.From,
+		CreatedTo:     req.To,
+		Email:         req.Email,
+	}, nil
+}
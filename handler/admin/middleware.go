@@ -1,41 +1,67 @@
 package admin
 
 import (
+	"errors"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
+	"rednit/db"
 	"rednit/terrors"
-	"strings"
+	"slices"
 )
 
-func getUserID(c echo.Context) int64 {
+func getClaims(c echo.Context) *JWTClaims {
 	user := c.Get("user").(*jwt.Token)
-	claims := user.Claims.(*JWTClaims)
-	return claims.UID
+	return user.Claims.(*JWTClaims)
+}
+
+func getUserID(c echo.Context) int64 {
+	return getClaims(c).UID
+}
+
+// publicPaths are the route patterns of the admin routes that don't need a
+// signed-in user.
+var publicPaths = []string{
+	"/api/admin/sign-in",
+	"/api/admin/sign-in/2fa",
+	"/api/admin/sign-in/2fa/setup",
+	"/api/admin/refresh",
+	"/api/admin/sign-out",
+	"/api/admin/invitations/accept",
+	"/api/admin/password-reset",
+	"/api/admin/password-reset/confirm",
 }
 
-func AuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+func (a Admin) AuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		// skip /sign-in and /sign-up
-		if strings.HasSuffix(c.Path(), "/sign-in") || strings.HasSuffix(c.Path(), "/sign-up") {
+		// skip the sign-in, session and account recovery routes
+		if slices.Contains(publicPaths, c.Path()) {
 			return next(c)
 		}
 
 		// Get the token from the cookie
-		cookie, err := c.Cookie("clan_cookie")
+		cookie, err := c.Cookie(a.cfg.Auth.CookieName)
 		if err != nil {
 			return terrors.Unauthorized(err, "Unauthorized")
 		}
 
 		// Validate the JWT
-		token, err := jwt.ParseWithClaims(cookie.Value, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-			return []byte("your_secret_key"), nil
-		})
-
-		if err != nil || !token.Valid {
+		token, err := a.parseJWT(cookie.Value)
+		if err != nil {
 			return terrors.Unauthorized(err, "Unauthorized")
 		}
 
+		// the role is read along with the session, so a role change applies
+		// to the next request rather than the next token
+		claims := token.Claims.(*JWTClaims)
+		role, err := a.s.GetActiveSessionRole(claims.UID, claims.SessionID)
+		if err != nil && errors.Is(err, db.ErrNotFound) {
+			return terrors.Unauthorized(errors.New("session is revoked or expired"), "Unauthorized")
+		} else if err != nil {
+			return terrors.InternalServerError(err, "failed to check session")
+		}
+
 		c.Set("user", token)
+		c.Set("role", role)
 
 		// Token is valid, proceed to the next handler
 		return next(c)
@@ -1,16 +1,93 @@
 package admin
 
 import (
+	"errors"
 	"github.com/labstack/echo/v4"
 	"net/http"
+	"rednit/db"
 	"rednit/terrors"
+	"strconv"
 )
 
 func (a Admin) ListOrders(c echo.Context) error {
-	orders, err := a.s.ListOrders()
+	statuses := make([]string, len(db.ValidOrderStatuses))
+	for i, s := range db.ValidOrderStatuses {
+		statuses[i] = string(s)
+	}
+
+	q, err := bindListQuery(c, statuses...)
 	if err != nil {
+		return err
+	}
+
+	if q.PaymentStatus != "" {
+		if err := db.PaymentStatus(q.PaymentStatus).IsValid(); err != nil {
+			return terrors.BadRequest(err, "invalid payment status")
+		}
+	}
+
+	orders, err := a.s.ListOrders(q)
+	if err != nil && errors.Is(err, db.ErrInvalidCursor) {
+		return terrors.BadRequest(err, "invalid cursor")
+	} else if err != nil {
 		return terrors.InternalServerError(err, "failed to list orders")
 	}
 
 	return c.JSON(http.StatusOK, orders)
 }
+
+type UpdateOrderStatusRequest struct {
+	Status db.OrderStatus `json:"status" validate:"required"`
+	Note   *string        `json:"note" validate:"omitempty,max=1000"`
+}
+
+func (a Admin) UpdateOrderStatus(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return terrors.BadRequest(err, "invalid order id")
+	}
+
+	var req UpdateOrderStatusRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	if err := req.Status.IsValid(); err != nil {
+		return terrors.BadRequest(err, "invalid order status")
+	}
+
+	uid := getUserID(c)
+
+	if err := a.s.UpdateOrderStatus(id, req.Status, &uid, req.Note); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "order not found")
+	} else if err != nil && errors.Is(err, db.ErrInvalidStatusTransition) {
+		return terrors.Conflict(err, "order can't be moved to this status")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to update order status")
+	}
+
+	order, err := a.s.GetOrder(db.GetOrderQuery{ID: &id})
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to get order")
+	}
+
+	return c.JSON(http.StatusOK, order)
+}
+
+func (a Admin) ListOrderStatusHistory(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return terrors.BadRequest(err, "invalid order id")
+	}
+
+	history, err := a.s.ListOrderStatusHistory(id)
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to list order status history")
+	}
+
+	return c.JSON(http.StatusOK, history)
+}
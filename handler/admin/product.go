@@ -1,18 +1,409 @@
 package admin
 
 import (
+	"errors"
 	"github.com/labstack/echo/v4"
 	"net/http"
 	"rednit/db"
 	"rednit/terrors"
+	"strconv"
 )
 
 func (a Admin) ListProducts(c echo.Context) error {
-	products, err := a.s.ListProducts(db.ListProductsQuery{})
-
+	q, err := bindListQuery(c, db.ProductPublished, db.ProductDraft)
 	if err != nil {
-		return terrors.InternalServerError(err, "failed to list customers")
+		return err
+	}
+
+	// products are paged oldest first like in the storefront
+	products, err := a.s.ListProducts(db.ListProductsQuery{
+		Status:      q.Status,
+		CreatedFrom: q.CreatedFrom,
+		CreatedTo:   q.CreatedTo,
+		Cursor:      q.Cursor,
+		Limit:       q.PageLimit(),
+	})
+
+	if err != nil && errors.Is(err, db.ErrInvalidCursor) {
+		return terrors.BadRequest(err, "invalid cursor")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to list products")
 	}
 
 	return c.JSON(http.StatusOK, products)
 }
+
+func productIDParam(c echo.Context) (int64, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		return 0, terrors.BadRequest(errors.New("invalid product id"), "invalid product id")
+	}
+
+	return id, nil
+}
+
+func variantIDParam(c echo.Context) (int64, error) {
+	id, err := strconv.ParseInt(c.Param("variant_id"), 10, 64)
+	if err != nil || id == 0 {
+		return 0, terrors.BadRequest(errors.New("invalid variant id"), "invalid variant id")
+	}
+
+	return id, nil
+}
+
+func (a Admin) GetProduct(c echo.Context) error {
+	id, err := productIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	product, err := a.s.GetProduct(db.GetProductQuery{ID: id, IncludeUnpublished: true})
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "product not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to get product")
+	}
+
+	product.Translations, err = a.s.ListProductTranslations(id)
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to list product translations")
+	}
+
+	return c.JSON(http.StatusOK, product)
+}
+
+type ProductRequest struct {
+	Handle      string   `json:"handle" validate:"required,max=255"`
+	Name        string   `json:"name" validate:"required,max=255"`
+	Description string   `json:"description"`
+	Materials   string   `json:"materials"`
+	Image       string   `json:"image"`
+	Images      []string `json:"images" validate:"dive,required"`
+	IsPublished bool     `json:"is_published"`
+}
+
+func (r ProductRequest) toProduct() db.Product {
+	return db.Product{
+		Handle:      r.Handle,
+		Name:        r.Name,
+		Description: r.Description,
+		Materials:   r.Materials,
+		Image:       r.Image,
+		Images:      r.Images,
+		IsPublished: r.IsPublished,
+	}
+}
+
+func (a Admin) CreateProduct(c echo.Context) error {
+	var req ProductRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	product, err := a.s.CreateProduct(req.toProduct())
+	if err != nil && errors.Is(err, db.ErrAlreadyExists) {
+		return terrors.Conflict(err, "product with this handle already exists")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to create product")
+	}
+
+	return c.JSON(http.StatusCreated, product)
+}
+
+func (a Admin) UpdateProduct(c echo.Context) error {
+	id, err := productIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	var req ProductRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	p := req.toProduct()
+	p.ID = id
+
+	product, err := a.s.UpdateProduct(p)
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "product not found")
+	} else if err != nil && errors.Is(err, db.ErrAlreadyExists) {
+		return terrors.Conflict(err, "product with this handle already exists")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to update product")
+	}
+
+	return c.JSON(http.StatusOK, product)
+}
+
+func (a Admin) setProductPublished(c echo.Context, published bool) error {
+	id, err := productIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	if err := a.s.SetProductPublished(id, published); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "product not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to update product")
+	}
+
+	product, err := a.s.GetProduct(db.GetProductQuery{ID: id, IncludeUnpublished: true})
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to get product")
+	}
+
+	return c.JSON(http.StatusOK, product)
+}
+
+func (a Admin) PublishProduct(c echo.Context) error {
+	return a.setProductPublished(c, true)
+}
+
+func (a Admin) UnpublishProduct(c echo.Context) error {
+	return a.setProductPublished(c, false)
+}
+
+func (a Admin) DeleteProduct(c echo.Context) error {
+	id, err := productIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	if err := a.s.DeleteProduct(id); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "product not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to delete product")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+type VariantRequest struct {
+	Name      string `json:"name" validate:"required,max=255"`
+	Available int    `json:"available" validate:"min=0"`
+}
+
+func (a Admin) CreateProductVariant(c echo.Context) error {
+	productID, err := productIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	var req VariantRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	variant, err := a.s.CreateProductVariant(productID, db.ProductVariant{
+		Name:      req.Name,
+		Available: req.Available,
+	})
+
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "product not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to create variant")
+	}
+
+	return c.JSON(http.StatusCreated, variant)
+}
+
+func (a Admin) UpdateProductVariant(c echo.Context) error {
+	productID, err := productIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	variantID, err := variantIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	var req VariantRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	variant, err := a.s.UpdateProductVariant(productID, db.ProductVariant{
+		ID:        variantID,
+		Name:      req.Name,
+		Available: req.Available,
+	})
+
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "variant not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to update variant")
+	}
+
+	return c.JSON(http.StatusOK, variant)
+}
+
+func (a Admin) DeleteProductVariant(c echo.Context) error {
+	productID, err := productIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	variantID, err := variantIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	if err := a.s.DeleteProductVariant(productID, variantID); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "variant not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to delete variant")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+type VariantPriceRequest struct {
+	CurrencyCode string `json:"currency_code" validate:"required,iso4217"`
+	Price        int    `json:"price" validate:"required,min=1"`
+}
+
+func (a Admin) SaveVariantPrice(c echo.Context) error {
+	productID, err := productIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	variantID, err := variantIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	var req VariantPriceRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	price := db.VariantPrice{
+		VariantID:    variantID,
+		CurrencyCode: req.CurrencyCode,
+		Price:        req.Price,
+	}
+
+	if err := a.s.SaveVariantPrice(productID, price); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "variant or currency not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to save variant price")
+	}
+
+	variant, err := a.s.GetProductVariant(productID, variantID)
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to get variant")
+	}
+
+	return c.JSON(http.StatusOK, variant)
+}
+
+type DeleteVariantPriceRequest struct {
+	CurrencyCode string `param:"currency" json:"-" validate:"required,iso4217"`
+}
+
+func (a Admin) DeleteVariantPrice(c echo.Context) error {
+	productID, err := productIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	variantID, err := variantIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	var req DeleteVariantPriceRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	if err := a.s.DeleteVariantPrice(productID, variantID, req.CurrencyCode); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "price not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to delete variant price")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+type TranslationRequest struct {
+	Language    string `param:"language" json:"-" validate:"required,len=2,lowercase"`
+	Name        string `json:"name" validate:"required,max=255"`
+	Description string `json:"description"`
+	Materials   string `json:"materials"`
+}
+
+func (a Admin) SaveProductTranslation(c echo.Context) error {
+	productID, err := productIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	var req TranslationRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	translation, err := a.s.SaveProductTranslation(db.ProductTranslation{
+		ProductID:   productID,
+		Language:    req.Language,
+		Name:        req.Name,
+		Description: req.Description,
+		Materials:   req.Materials,
+	})
+
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "product not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to save product translation")
+	}
+
+	return c.JSON(http.StatusOK, translation)
+}
+
+func (a Admin) DeleteProductTranslation(c echo.Context) error {
+	productID, err := productIDParam(c)
+	if err != nil {
+		return err
+	}
+
+	if err := a.s.DeleteProductTranslation(productID, c.Param("language")); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "translation not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to delete product translation")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
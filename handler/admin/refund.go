@@ -0,0 +1,129 @@
+package admin
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"log"
+	"net/http"
+	"rednit/db"
+	"rednit/payment"
+	"rednit/terrors"
+	"strconv"
+)
+
+type RefundOrderRequest struct {
+	// Amount is in minor units, whatever is left of the paid amount is
+	// refunded when it's omitted.
+	Amount int     `json:"amount" validate:"min=0"`
+	Reason *string `json:"reason" validate:"omitempty,max=255"`
+}
+
+func (a Admin) RefundOrder(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return terrors.BadRequest(err, "invalid order id")
+	}
+
+	var req RefundOrderRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	order, err := a.s.GetOrder(db.GetOrderQuery{ID: &id})
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "order not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to get order")
+	}
+
+	provider, err := a.payments.Get(order.PaymentProvider)
+	if err != nil {
+		return terrors.BadRequest(err, "unsupported payment provider")
+	}
+
+	uid := getUserID(c)
+
+	refund, err := a.s.CreateRefund(id, req.Amount, req.Reason, &uid)
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "order not found")
+	} else if err != nil && errors.Is(err, db.ErrNotRefundable) {
+		return terrors.Conflict(err, "order is not refundable")
+	} else if err != nil && errors.Is(err, db.ErrRefundExceedsPayment) {
+		return terrors.BadRequest(err, "refund exceeds the paid amount")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to create refund")
+	}
+
+	var reason string
+	if req.Reason != nil {
+		reason = *req.Reason
+	}
+
+	tx, err := provider.Refund(payment.RefundRequest{
+		TransactionID: *refund.TransactionID,
+		Amount:        refund.Amount,
+		Currency:      refund.CurrencyCode,
+		Reason:        reason,
+	})
+
+	if err != nil && (errors.Is(err, payment.ErrDeclined) || errors.Is(err, payment.ErrNotSupported)) {
+		if err := a.s.FailRefund(refund.ID); err != nil {
+			log.Printf("failed to mark refund %d as failed: %v", refund.ID, err)
+		}
+
+		if errors.Is(err, payment.ErrNotSupported) {
+			return terrors.BadRequest(err, "refunds are not supported by the payment provider")
+		}
+
+		return terrors.Conflict(err, "refund was declined by the payment provider")
+	} else if err != nil {
+		// The provider may have refunded it anyway, e.g. when the request
+		// timed out, so the refund stays pending until the webhook settles it.
+		log.Printf("refund %d of order %d is pending, the provider didn't answer: %v", refund.ID, id, err)
+
+		return c.JSON(http.StatusAccepted, refund)
+	}
+
+	switch tx.PaymentStatus {
+	case payment.StatusRefunded:
+		err = a.s.CompleteRefund(refund.ID, tx.ID)
+	case payment.StatusFailed:
+		if err := a.s.FailRefund(refund.ID); err != nil {
+			return terrors.InternalServerError(err, "failed to update refund")
+		}
+
+		return terrors.Conflict(errors.New("refund declined"), "refund was declined by the payment provider")
+	default:
+		// still processing, the provider webhook completes it
+		err = a.s.SetRefundProviderID(refund.ID, tx.ID)
+	}
+
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to update refund")
+	}
+
+	refund, err = a.s.GetRefund(refund.ID)
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to get refund")
+	}
+
+	return c.JSON(http.StatusCreated, refund)
+}
+
+func (a Admin) ListOrderRefunds(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return terrors.BadRequest(err, "invalid order id")
+	}
+
+	refunds, err := a.s.ListOrderRefunds(id)
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to list refunds")
+	}
+
+	return c.JSON(http.StatusOK, refunds)
+}
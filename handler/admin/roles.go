@@ -0,0 +1,53 @@
+package admin
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"rednit/db"
+	"rednit/terrors"
+	"slices"
+)
+
+type Permission string
+
+const (
+	// PermissionView lets a user see orders, customers, the catalog and
+	// discounts.
+	PermissionView Permission = "view"
+	// PermissionFulfill lets a user move orders through their statuses.
+	PermissionFulfill Permission = "fulfill"
+	// PermissionRefund lets a user refund orders.
+	PermissionRefund Permission = "refund"
+	// PermissionManageCatalog lets a user edit products, categories and
+	// discounts.
+	PermissionManageCatalog Permission = "manage_catalog"
+	// PermissionManageUsers lets a user add admin users and change roles.
+	PermissionManageUsers Permission = "manage_users"
+)
+
+var rolePermissions = map[string][]Permission{
+	db.RoleOwner:       {PermissionView, PermissionFulfill, PermissionRefund, PermissionManageCatalog, PermissionManageUsers},
+	db.RoleManager:     {PermissionView, PermissionFulfill, PermissionRefund, PermissionManageCatalog},
+	db.RoleFulfillment: {PermissionView, PermissionFulfill},
+	db.RoleViewer:      {PermissionView},
+}
+
+// getUserRole returns the role AuthMiddleware read from the database, not
+// the one in the token, which may be outdated.
+func getUserRole(c echo.Context) string {
+	return c.Get("role").(string)
+}
+
+// Require only lets users whose role has the permission through. It goes
+// after AuthMiddleware.
+func Require(p Permission) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !slices.Contains(rolePermissions[getUserRole(c)], p) {
+				return terrors.Forbidden(errors.New("missing permission "+string(p)), "you don't have permission to do this")
+			}
+
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package admin
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"rednit/db"
+	"rednit/terrors"
+	"strconv"
+)
+
+// newToken returns a random token for a session, an invitation or a
+// password reset, and the hash it's stored under.
+func newToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RefreshSession issues a new access token for the session of the refresh
+// token cookie, and replaces the refresh token.
+func (a Admin) RefreshSession(c echo.Context) error {
+	cookie, err := c.Cookie(a.cfg.Auth.RefreshCookieName)
+	if err != nil {
+		return terrors.Unauthorized(err, "Unauthorized")
+	}
+
+	refreshToken, tokenHash, err := newToken()
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to generate refresh token")
+	}
+
+	session, err := a.s.RefreshSession(hashToken(cookie.Value), tokenHash, c.RealIP(), c.Request().UserAgent(), a.cfg.Auth.SessionLifetime)
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		a.clearSessionCookies(c)
+		return terrors.Unauthorized(err, "Unauthorized")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to refresh session")
+	}
+
+	user, err := a.s.GetUserByID(session.UserID)
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to get user")
+	}
+
+	if user.DeletedAt != nil {
+		a.clearSessionCookies(c)
+		return terrors.Unauthorized(errors.New("user is deactivated"), "account is deactivated")
+	}
+
+	if err := a.setSessionCookies(c, user, session, refreshToken); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, user)
+}
+
+// SignOut ends the session of the refresh token cookie. It works with an
+// expired access token too.
+func (a Admin) SignOut(c echo.Context) error {
+	if cookie, err := c.Cookie(a.cfg.Auth.RefreshCookieName); err == nil {
+		if err := a.s.RevokeSessionByToken(hashToken(cookie.Value)); err != nil {
+			return terrors.InternalServerError(err, "failed to sign out")
+		}
+	}
+
+	a.clearSessionCookies(c)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// SignOutEverywhere ends all sessions of the user, this one included.
+func (a Admin) SignOutEverywhere(c echo.Context) error {
+	if err := a.s.RevokeUserSessions(getUserID(c), 0); err != nil {
+		return terrors.InternalServerError(err, "failed to sign out")
+	}
+
+	a.clearSessionCookies(c)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+type SessionResponse struct {
+	db.Session
+	Current bool `json:"current"`
+}
+
+// ListSessions returns the active sessions of the user, marking the one
+// the request is made from.
+func (a Admin) ListSessions(c echo.Context) error {
+	sessions, err := a.s.ListUserSessions(getUserID(c))
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to list sessions")
+	}
+
+	current := getClaims(c).SessionID
+
+	res := make([]SessionResponse, len(sessions))
+	for i, s := range sessions {
+		res[i] = SessionResponse{Session: s, Current: s.ID == current}
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// RevokeSession signs the user out on another device.
+func (a Admin) RevokeSession(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		return terrors.BadRequest(errors.New("invalid session id"), "invalid session id")
+	}
+
+	if err := a.s.RevokeSession(getUserID(c), id); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "session not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to revoke session")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
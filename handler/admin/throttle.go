@@ -0,0 +1,159 @@
+package admin
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"rednit/db"
+	"rednit/terrors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// signInWindow is how long a failed sign-in counts against the account
+	// and the IP address.
+	signInWindow = time.Hour
+	// signInLockout is the longest wait between failed sign-ins, and the
+	// wait once the lockout threshold is reached.
+	signInLockout = 15 * time.Minute
+)
+
+// throttle slows down sign-ins after repeated failures: free failures go
+// through, then the wait doubles with every failure starting from a second,
+// up to the lockout after lockAfter failures.
+type throttle struct {
+	free      int
+	lockAfter int
+}
+
+var (
+	accountThrottle = throttle{free: 3, lockAfter: 10}
+	// ipThrottle is looser as offices and mobile carriers share addresses.
+	ipThrottle = throttle{free: 10, lockAfter: 50}
+
+	// password reset requests are limited on their own, so that asking for
+	// links can't lock anyone out of signing in
+	resetAccountThrottle = throttle{free: 2, lockAfter: 5}
+	resetIPThrottle      = throttle{free: 5, lockAfter: 20}
+)
+
+func (t throttle) delay(failures int) time.Duration {
+	if failures >= t.lockAfter {
+		return signInLockout
+	} else if failures < t.free {
+		return 0
+	}
+
+	return min(time.Second<<(failures-t.free), signInLockout)
+}
+
+// signInWait is how long to wait before the next sign-in attempt, 0 if it
+// can be made now.
+func signInWait(f *db.SignInFailures, now time.Time) time.Duration {
+	return throttleWait(f, accountThrottle, ipThrottle, now)
+}
+
+func throttleWait(f *db.SignInFailures, account, ip throttle, now time.Time) time.Duration {
+	wait := max(
+		f.LastAccount.Add(account.delay(f.Account)).Sub(now),
+		f.LastIP.Add(ip.delay(f.IP)).Sub(now),
+	)
+
+	return max(wait, 0)
+}
+
+// retryAfter sets the Retry-After header to the wait in whole seconds.
+func retryAfter(c echo.Context, wait time.Duration) {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+}
+
+// recordSignIn stores the outcome of a sign-in attempt, userID is 0 when the
+// email is unknown.
+func (a Admin) recordSignIn(c echo.Context, email string, userID int64, event string) error {
+	e := db.AuthEvent{
+		Email:     strings.ToLower(email),
+		Event:     event,
+		IP:        c.RealIP(),
+		UserAgent: c.Request().UserAgent(),
+	}
+
+	if userID != 0 {
+		e.UserID = &userID
+	}
+
+	if err := a.s.CreateAuthEvent(e); err != nil {
+		return terrors.InternalServerError(err, "failed to record sign-in")
+	}
+
+	return nil
+}
+
+// checkSignInThrottle refuses the attempt with a Retry-After header if there
+// were too many failed sign-ins for the email or from the IP address.
+func (a Admin) checkSignInThrottle(c echo.Context, email string) error {
+	failures, err := a.s.ListSignInFailures(strings.ToLower(email), c.RealIP(), signInWindow)
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to check sign-in attempts")
+	}
+
+	wait := signInWait(failures, time.Now())
+	if wait == 0 {
+		return nil
+	}
+
+	if err := a.recordSignIn(c, email, 0, db.AuthSignInBlocked); err != nil {
+		return err
+	}
+
+	retryAfter(c, wait)
+
+	return terrors.TooManyRequests(errors.New("sign-in throttled"), "too many sign-in attempts, try again later")
+}
+
+// checkPasswordResetThrottle refuses the request with a Retry-After header
+// if too many reset links were asked for the email or from the IP address.
+func (a Admin) checkPasswordResetThrottle(c echo.Context, email string) error {
+	requests, err := a.s.ListPasswordResetRequests(strings.ToLower(email), c.RealIP(), signInWindow)
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to check password reset requests")
+	}
+
+	wait := throttleWait(requests, resetAccountThrottle, resetIPThrottle, time.Now())
+	if wait == 0 {
+		return nil
+	}
+
+	retryAfter(c, wait)
+
+	return terrors.TooManyRequests(errors.New("password reset throttled"), "too many password reset requests, try again later")
+}
+
+var authEvents = []string{
+	db.AuthSignInSucceeded,
+	db.AuthSignInFailed,
+	db.AuthSignInBlocked,
+	db.AuthTwoFactorChallenged,
+	db.AuthTwoFactorFailed,
+	db.AuthPasswordResetRequested,
+}
+
+// ListAuthEvents returns the sign-in attempts, filtered by event as the
+// status, email and time.
+func (a Admin) ListAuthEvents(c echo.Context) error {
+	q, err := bindListQuery(c, authEvents...)
+	if err != nil {
+		return err
+	}
+
+	events, err := a.s.ListAuthEvents(q)
+	if err != nil && errors.Is(err, db.ErrInvalidCursor) {
+		return terrors.BadRequest(err, "invalid cursor")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to list auth events")
+	}
+
+	return c.JSON(http.StatusOK, events)
+}
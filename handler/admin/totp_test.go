@@ -0,0 +1,132 @@
+package admin
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"rednit/db"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the HMAC-SHA1 key of the test vectors in RFC 4226 and
+// RFC 6238.
+var rfcSecret = []byte("12345678901234567890")
+
+func TestTOTPCodeRFC4226(t *testing.T) {
+	// RFC 4226 Appendix D, the HOTP values for counters 0 to 9
+	want := []string{
+		"755224", "287082", "359152", "969429", "338314",
+		"254676", "287922", "162583", "399871", "520489",
+	}
+
+	for step, code := range want {
+		if got := totpCode(rfcSecret, int64(step)); got != code {
+			t.Errorf("totpCode(%d) = %s, want %s", step, got, code)
+		}
+	}
+}
+
+func TestVerifyTOTPRFC6238(t *testing.T) {
+	// RFC 6238 Appendix B, SHA1 mode, cut to the last 6 of the 8 digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	secret := totpEncoding.EncodeToString(rfcSecret)
+
+	for _, tt := range tests {
+		step, ok := verifyTOTP(secret, tt.code, time.Unix(tt.unix, 0))
+		if !ok {
+			t.Errorf("verifyTOTP(%s) at %d failed", tt.code, tt.unix)
+		} else if step != tt.unix/totpPeriod {
+			t.Errorf("verifyTOTP(%s) at %d = step %d, want %d", tt.code, tt.unix, step, tt.unix/totpPeriod)
+		}
+	}
+}
+
+func TestVerifyTOTPSkew(t *testing.T) {
+	secret := totpEncoding.EncodeToString(rfcSecret)
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpPeriod
+
+	for offset := int64(-totpSkew - 1); offset <= totpSkew+1; offset++ {
+		code := totpCode(rfcSecret, current+offset)
+		step, ok := verifyTOTP(secret, code, now)
+
+		if want := offset >= -totpSkew && offset <= totpSkew; ok != want {
+			t.Errorf("code %d steps off: valid = %t, want %t", offset, ok, want)
+		} else if ok && step != current+offset {
+			t.Errorf("code %d steps off: step = %d, want %d", offset, step, current+offset)
+		}
+	}
+
+	if _, ok := verifyTOTP(secret, "000000", now); ok {
+		t.Error("a wrong code is valid")
+	}
+
+	code := totpCode(rfcSecret, current)
+	if _, ok := verifyTOTP(secret, code[:3]+" "+code[3:], now); !ok {
+		t.Error("a code typed with a space isn't valid")
+	}
+}
+
+func TestUseTOTPStepReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	st, err := db.ConnectDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := st.Migrate(); err != nil && strings.Contains(err.Error(), "fts5") {
+		t.Skip("the migrations need go-sqlite3 built with -tags sqlite_fts5, run make test")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { raw.Close() })
+
+	if _, err := raw.Exec(`INSERT INTO users (id, email, name, role, avatar_url, password) VALUES (1, 'a@example.com', 'Ann', 'owner', '', 'x')`); err != nil {
+		t.Fatal(err)
+	}
+
+	secret := totpEncoding.EncodeToString(rfcSecret)
+	now := time.Unix(1234567890, 0)
+
+	step, ok := verifyTOTP(secret, "005924", now)
+	if !ok {
+		t.Fatal("the code isn't valid")
+	}
+
+	if err := st.UseTOTPStep(1, step); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+
+	// the same code again, and the one before it still inside the skew
+	if err := st.UseTOTPStep(1, step); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("replayed step: err = %v, want %v", err, db.ErrNotFound)
+	}
+
+	if err := st.UseTOTPStep(1, step-1); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("earlier step: err = %v, want %v", err, db.ErrNotFound)
+	}
+
+	if err := st.UseTOTPStep(1, step+1); err != nil {
+		t.Errorf("next step: %v", err)
+	}
+}
@@ -0,0 +1,493 @@
+package admin
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"rednit/db"
+	"rednit/terrors"
+	"strconv"
+	"time"
+)
+
+const (
+	signInChallengeTTL = 5 * time.Minute
+	// signInChallengeAttempts is the number of wrong codes after which the
+	// sign-in has to start over with the password.
+	signInChallengeAttempts = 5
+)
+
+var errInvalidCode = errors.New("invalid code")
+
+// SignInChallengeResponse is the answer to a sign-in with the right password
+// of a user with two-factor authentication. The challenge goes with the code
+// to POST /sign-in/2fa. SetupRequired tells that the user has to set up an
+// authenticator app first, with POST /sign-in/2fa/setup.
+type SignInChallengeResponse struct {
+	Challenge     string `json:"challenge"`
+	SetupRequired bool   `json:"setup_required"`
+}
+
+// challengeSignIn holds back the session until the user enters the second
+// factor.
+func (a Admin) challengeSignIn(c echo.Context, user *db.User) error {
+	token, tokenHash, err := newToken()
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to generate token")
+	}
+
+	if err := a.s.CreateSignInChallenge(user.ID, tokenHash, signInChallengeTTL); err != nil {
+		return terrors.InternalServerError(err, "failed to start sign-in")
+	}
+
+	if err := a.recordSignIn(c, user.Email, user.ID, db.AuthTwoFactorChallenged); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusAccepted, SignInChallengeResponse{
+		Challenge:     token,
+		SetupRequired: !user.TwoFactorEnabled,
+	})
+}
+
+// getSignInChallenge returns the pending challenge of the token and its
+// user.
+func (a Admin) getSignInChallenge(token string) (*db.SignInChallenge, *db.User, error) {
+	challenge, err := a.s.GetSignInChallenge(hashToken(token))
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return nil, nil, terrors.Unauthorized(err, "sign-in expired, start again")
+	} else if err != nil {
+		return nil, nil, terrors.InternalServerError(err, "failed to get sign-in")
+	}
+
+	if challenge.Attempts >= signInChallengeAttempts {
+		return nil, nil, terrors.Unauthorized(errors.New("too many wrong codes"), "sign-in expired, start again")
+	}
+
+	user, err := a.s.GetUserByID(challenge.UserID)
+	if err != nil {
+		return nil, nil, terrors.InternalServerError(err, "failed to get user")
+	}
+
+	if user.DeletedAt != nil {
+		return nil, nil, terrors.Unauthorized(errors.New("user is deactivated"), "account is deactivated")
+	}
+
+	return challenge, user, nil
+}
+
+type TOTPSetupResponse struct {
+	Secret string `json:"secret"`
+	// URL is the otpauth:// URL to show as a QR code.
+	URL string `json:"url"`
+}
+
+// setupTOTP gives the user a new pending authenticator app secret.
+func (a Admin) setupTOTP(c echo.Context, user *db.User) error {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to generate secret")
+	}
+
+	if err := a.s.SetUserTOTPSecret(user.ID, secret); err != nil && errors.Is(err, db.ErrTwoFactorEnabled) {
+		return terrors.Conflict(err, "two-factor authentication is already enabled")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to set up two-factor authentication")
+	}
+
+	return c.JSON(http.StatusOK, TOTPSetupResponse{
+		Secret: secret,
+		URL:    totpURL(a.cfg.Auth.TOTPIssuer, user.Email, secret),
+	})
+}
+
+// enableTOTP turns two-factor authentication on if the code matches the
+// pending secret of the user, and returns the new recovery codes.
+// db.ErrNotFound is returned if there is no pending secret, errInvalidCode
+// if the code doesn't match.
+func (a Admin) enableTOTP(user *db.User, code string, sessionID int64) ([]string, error) {
+	totp, err := a.s.GetUserTOTP(user.ID)
+	if err != nil {
+		return nil, err
+	} else if totp.EnabledAt != nil {
+		return nil, db.ErrTwoFactorEnabled
+	}
+
+	step, ok := verifyTOTP(totp.Secret, code, time.Now())
+	if !ok {
+		return nil, errInvalidCode
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.s.EnableUserTOTP(user.ID, step, hashes, sessionID); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// checkSecondFactor tells if the code from the authenticator app, or else
+// the recovery code, is right for the user with two-factor authentication
+// on. Both work only once.
+func (a Admin) checkSecondFactor(user *db.User, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		err := a.s.UseRecoveryCode(user.ID, hashRecoveryCode(recoveryCode))
+		if err != nil && errors.Is(err, db.ErrNotFound) {
+			return false, nil
+		}
+
+		return err == nil, err
+	}
+
+	totp, err := a.s.GetUserTOTP(user.ID)
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := verifyTOTP(totp.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	if err := a.s.UseTOTPStep(user.ID, step); err != nil && errors.Is(err, db.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+type SignInChallengeRequest struct {
+	Challenge string `json:"challenge" validate:"required"`
+}
+
+// SetupSignInTOTP sets up an authenticator app during the sign-in of a user
+// who has to use two-factor authentication but hasn't set it up yet.
+func (a Admin) SetupSignInTOTP(c echo.Context) error {
+	var req SignInChallengeRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	_, user, err := a.getSignInChallenge(req.Challenge)
+	if err != nil {
+		return err
+	}
+
+	return a.setupTOTP(c, user)
+}
+
+type VerifySignInRequest struct {
+	Challenge    string `json:"challenge" validate:"required"`
+	Code         string `json:"code" validate:"required_without=RecoveryCode,omitempty,max=16"`
+	RecoveryCode string `json:"recovery_code" validate:"omitempty,max=32"`
+}
+
+type SignInResponse struct {
+	db.User
+	// RecoveryCodes are only set when the sign-in turned two-factor
+	// authentication on. They aren't shown again.
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+// VerifySignIn completes a sign-in with the code from the authenticator app
+// or a recovery code, and starts the session. For a user setting up two-factor
+// authentication, the code confirms the new secret instead.
+func (a Admin) VerifySignIn(c echo.Context) error {
+	var req VerifySignInRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	challenge, user, err := a.getSignInChallenge(req.Challenge)
+	if err != nil {
+		return err
+	}
+
+	if err := a.checkSignInThrottle(c, user.Email); err != nil {
+		return err
+	}
+
+	var recoveryCodes []string
+	ok := true
+
+	if user.TwoFactorEnabled {
+		ok, err = a.checkSecondFactor(user, req.Code, req.RecoveryCode)
+		if err != nil {
+			return terrors.InternalServerError(err, "failed to check code")
+		}
+	} else {
+		recoveryCodes, err = a.enableTOTP(user, req.Code, 0)
+		if err != nil && errors.Is(err, errInvalidCode) {
+			ok = false
+		} else if err != nil && errors.Is(err, db.ErrNotFound) {
+			return terrors.BadRequest(err, "set up two-factor authentication first")
+		} else if err != nil {
+			return terrors.InternalServerError(err, "failed to enable two-factor authentication")
+		}
+	}
+
+	if !ok {
+		if err := a.s.FailSignInChallenge(challenge.ID); err != nil {
+			return terrors.InternalServerError(err, "failed to check code")
+		}
+
+		if err := a.recordSignIn(c, user.Email, user.ID, db.AuthTwoFactorFailed); err != nil {
+			return err
+		}
+
+		return terrors.Unauthorized(errInvalidCode, "invalid code")
+	}
+
+	if err := a.s.CompleteSignInChallenge(challenge.ID); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.Unauthorized(err, "sign-in expired, start again")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to complete sign-in")
+	}
+
+	user, err = a.s.GetUserByID(user.ID)
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to get user")
+	}
+
+	if err := a.startSession(c, user); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, SignInResponse{User: *user, RecoveryCodes: recoveryCodes})
+}
+
+type TwoFactorStatusResponse struct {
+	Enabled bool `json:"enabled"`
+	// Required tells if the owners require two-factor authentication for
+	// everyone.
+	Required          bool `json:"required"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+func (a Admin) GetTwoFactorStatus(c echo.Context) error {
+	user, err := a.s.GetUserByID(getUserID(c))
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to get user")
+	}
+
+	required, err := a.s.IsTwoFactorRequired()
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to get settings")
+	}
+
+	left, err := a.s.CountRecoveryCodes(user.ID)
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to count recovery codes")
+	}
+
+	return c.JSON(http.StatusOK, TwoFactorStatusResponse{
+		Enabled:           user.TwoFactorEnabled,
+		Required:          required,
+		RecoveryCodesLeft: left,
+	})
+}
+
+// SetupTOTP starts setting up an authenticator app for the signed-in user,
+// EnableTOTP finishes it.
+func (a Admin) SetupTOTP(c echo.Context) error {
+	user, err := a.s.GetUserByID(getUserID(c))
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to get user")
+	}
+
+	return a.setupTOTP(c, user)
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code" validate:"required,max=16"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// EnableTOTP turns two-factor authentication on with a code from the app
+// set up with SetupTOTP. The user is signed out on the other devices.
+func (a Admin) EnableTOTP(c echo.Context) error {
+	var req TOTPCodeRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	claims := getClaims(c)
+
+	user, err := a.s.GetUserByID(claims.UID)
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to get user")
+	}
+
+	codes, err := a.enableTOTP(user, req.Code, claims.SessionID)
+	if err != nil && errors.Is(err, errInvalidCode) {
+		return terrors.BadRequest(err, "invalid code")
+	} else if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.BadRequest(err, "set up two-factor authentication first")
+	} else if err != nil && errors.Is(err, db.ErrTwoFactorEnabled) {
+		return terrors.Conflict(err, "two-factor authentication is already enabled")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to enable two-factor authentication")
+	}
+
+	return c.JSON(http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user, the old
+// ones stop working.
+func (a Admin) RegenerateRecoveryCodes(c echo.Context) error {
+	var req TOTPCodeRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	user, err := a.s.GetUserByID(getUserID(c))
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to get user")
+	}
+
+	if !user.TwoFactorEnabled {
+		return terrors.BadRequest(errors.New("two-factor authentication is off"), "two-factor authentication is not enabled")
+	}
+
+	if ok, err := a.checkSecondFactor(user, req.Code, ""); err != nil {
+		return terrors.InternalServerError(err, "failed to check code")
+	} else if !ok {
+		return terrors.BadRequest(errInvalidCode, "invalid code")
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to generate recovery codes")
+	}
+
+	if err := a.s.ReplaceRecoveryCodes(user.ID, hashes); err != nil {
+		return terrors.InternalServerError(err, "failed to save recovery codes")
+	}
+
+	return c.JSON(http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+type DisableTOTPRequest struct {
+	Password string `json:"password" validate:"required"`
+}
+
+// DisableTOTP turns two-factor authentication off for the signed-in user,
+// unless the owners require it.
+func (a Admin) DisableTOTP(c echo.Context) error {
+	var req DisableTOTPRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	user, err := a.s.GetUserByID(getUserID(c))
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to get user")
+	}
+
+	if err := CheckPassword(user.Password, req.Password); err != nil {
+		return terrors.BadRequest(err, "password is wrong")
+	}
+
+	if required, err := a.s.IsTwoFactorRequired(); err != nil {
+		return terrors.InternalServerError(err, "failed to get settings")
+	} else if required {
+		return terrors.Conflict(errors.New("two-factor authentication is required"), "two-factor authentication is required for everyone")
+	}
+
+	if err := a.s.DisableUserTOTP(user.ID); err != nil {
+		return terrors.InternalServerError(err, "failed to disable two-factor authentication")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ResetUserTOTP turns two-factor authentication off for a user who lost the
+// authenticator app and the recovery codes, and signs the user out
+// everywhere. If it's required, the user sets it up again when signing in.
+func (a Admin) ResetUserTOTP(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		return terrors.BadRequest(errors.New("invalid user id"), "invalid user id")
+	}
+
+	if id == getUserID(c) {
+		return terrors.BadRequest(errors.New("can't reset yourself"), "turn off your own two-factor authentication in your account")
+	}
+
+	if err := a.s.DisableUserTOTP(id); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "user not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to reset two-factor authentication")
+	}
+
+	if err := a.s.RevokeUserSessions(id, 0); err != nil {
+		return terrors.InternalServerError(err, "failed to revoke sessions")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+type TwoFactorSettingRequest struct {
+	Required bool `json:"required"`
+}
+
+// SetTwoFactorRequired makes every admin user sign in with two-factor
+// authentication, or lets them choose again. Users without it are signed out
+// and set it up when they sign in. The owner turning it on must have it
+// already.
+func (a Admin) SetTwoFactorRequired(c echo.Context) error {
+	var req TwoFactorSettingRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	if req.Required {
+		user, err := a.s.GetUserByID(getUserID(c))
+		if err != nil {
+			return terrors.InternalServerError(err, "failed to get user")
+		}
+
+		if !user.TwoFactorEnabled {
+			return terrors.Conflict(errors.New("two-factor authentication is off"), "enable two-factor authentication on your account first")
+		}
+	}
+
+	if err := a.s.SetTwoFactorRequired(req.Required); err != nil {
+		return terrors.InternalServerError(err, "failed to save settings")
+	}
+
+	return c.JSON(http.StatusOK, req)
+}
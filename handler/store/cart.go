@@ -61,7 +61,9 @@ func (h Handler) CreateCart(c echo.Context) error {
 
 	createdCart, err := h.st.CreateCart(cart, langFromContext(c))
 
-	if err != nil {
+	if err != nil && errors.Is(err, db.ErrOutOfStock) {
+		return terrors.Conflict(err, "not enough stock")
+	} else if err != nil {
 		return terrors.InternalServerError(err, "failed to create cart")
 	}
 
@@ -95,6 +97,12 @@ func (h Handler) AddItemToCart(c echo.Context) error {
 		Quantity:  item.Quantity,
 	}); err != nil && errors.Is(err, db.ErrAlreadyExists) {
 		return terrors.Conflict(err, "failed to save line item")
+	} else if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "cart not found")
+	} else if err != nil && errors.Is(err, db.ErrCartCompleted) {
+		return terrors.Conflict(err, "cart is already checked out")
+	} else if err != nil && errors.Is(err, db.ErrOutOfStock) {
+		return terrors.Conflict(err, "not enough stock")
 	} else if err != nil {
 		return terrors.InternalServerError(err, "failed to save line item")
 	}
@@ -159,19 +167,29 @@ func (h Handler) ApplyDiscount(c echo.Context) error {
 		return terrors.InternalServerError(err, "failed to get discount")
 	}
 
-	if !discount.IsValid() {
-		return terrors.BadRequest(errors.New("invalid discount"), "discount is not valid")
+	cart, err := h.st.GetCartByID(cartID, langFromContext(c))
+
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "cart not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to get cart")
 	}
 
-	if err := h.st.UpdateDiscountUsageCount(discount.ID); err != nil {
-		return terrors.InternalServerError(err, "failed to update discount usage count")
+	if reason, err := h.st.ValidateCartDiscount(*discount, *cart); err != nil {
+		return terrors.InternalServerError(err, "failed to validate discount")
+	} else if reason != "" {
+		return terrors.BadRequest(errors.New("invalid discount"), "discount is not valid").WithReason(string(reason))
 	}
 
-	if err := h.st.UpdateCartDiscount(cartID, discount.ID); err != nil {
+	if err := h.st.UpdateCartDiscount(cartID, discount.ID); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "cart not found")
+	} else if err != nil && errors.Is(err, db.ErrCartCompleted) {
+		return terrors.Conflict(err, "cart is already checked out")
+	} else if err != nil {
 		return terrors.InternalServerError(err, "failed to update cart discount")
 	}
 
-	cart, err := h.st.GetCartByID(cartID, langFromContext(c))
+	cart, err = h.st.GetCartByID(cartID, langFromContext(c))
 
 	if err != nil && errors.Is(err, db.ErrNotFound) {
 		return terrors.NotFound(err, "cart not found")
@@ -189,7 +207,11 @@ func (h Handler) DropDiscount(c echo.Context) error {
 		return terrors.BadRequest(err, "invalid cart id")
 	}
 
-	if err := h.st.DropCartDiscount(cartID); err != nil {
+	if err := h.st.DropCartDiscount(cartID); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "cart not found")
+	} else if err != nil && errors.Is(err, db.ErrCartCompleted) {
+		return terrors.Conflict(err, "cart is already checked out")
+	} else if err != nil {
 		return terrors.InternalServerError(err, "failed to drop cart discount")
 	}
 
@@ -226,7 +248,13 @@ func (h Handler) UpdateCartItem(c echo.Context) error {
 		return err
 	}
 
-	if err := h.st.UpdateLineItemQuantity(itemID, req.Quantity); err != nil {
+	if err := h.st.UpdateLineItemQuantity(cartID, itemID, req.Quantity); err != nil && errors.Is(err, db.ErrOutOfStock) {
+		return terrors.Conflict(err, "not enough stock")
+	} else if err != nil && errors.Is(err, db.ErrCartCompleted) {
+		return terrors.Conflict(err, "cart is already checked out")
+	} else if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "item not found")
+	} else if err != nil {
 		return terrors.InternalServerError(err, "failed to update item quantity")
 	}
 
@@ -250,7 +278,11 @@ func (h Handler) RemoveCartItem(c echo.Context) error {
 		return terrors.BadRequest(errors.New("invalid cart or item id"), "invalid cart or item id")
 	}
 
-	if err := h.st.RemoveLineItem(itemID); err != nil {
+	if err := h.st.RemoveLineItem(cartID, itemID); err != nil && errors.Is(err, db.ErrCartCompleted) {
+		return terrors.Conflict(err, "cart is already checked out")
+	} else if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "item not found")
+	} else if err != nil {
 		return terrors.InternalServerError(err, "failed to remove item")
 	}
 
@@ -292,7 +324,11 @@ func (h Handler) SaveCartCustomer(c echo.Context) error {
 		return terrors.InternalServerError(err, "failed to get customer")
 	}
 
-	if err := h.st.UpdateCartCustomer(cartID, customer.ID); err != nil {
+	if err := h.st.UpdateCartCustomer(cartID, customer.ID); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "cart not found")
+	} else if err != nil && errors.Is(err, db.ErrCartCompleted) {
+		return terrors.Conflict(err, "cart is already checked out")
+	} else if err != nil {
 		return terrors.InternalServerError(err, "failed to update cart customer")
 	}
 
@@ -328,7 +364,11 @@ func (h Handler) UpdateCartCurrency(c echo.Context) error {
 		return err
 	}
 
-	if err := h.st.UpdateCartCurrency(cartID, req.Currency); err != nil {
+	if err := h.st.UpdateCartCurrency(cartID, req.Currency); err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "cart not found")
+	} else if err != nil && errors.Is(err, db.ErrCartCompleted) {
+		return terrors.Conflict(err, "cart is already checked out")
+	} else if err != nil {
 		return terrors.InternalServerError(err, "failed to update cart currency")
 	}
 
@@ -5,12 +5,11 @@ import (
 	"fmt"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/gommon/log"
-	"github.com/plutov/paypal/v4"
 	"net/http"
 	"rednit/db"
 	"rednit/payment"
 	"rednit/terrors"
-	"strconv"
+	"slices"
 )
 
 type CartItem struct {
@@ -21,7 +20,7 @@ type CartItem struct {
 
 type CheckoutRequest struct {
 	CartID          int64                  `json:"cart_id" validate:"required"`
-	PaymentProvider string                 `json:"payment_provider" validate:"required,oneof=bepaid paypal"`
+	PaymentProvider string                 `json:"payment_provider" validate:"required"`
 	Name            string                 `json:"name" validate:"required"`
 	CustomerID      int64                  `json:"customer_id" validate:"required"`
 	Phone           string                 `json:"phone" validate:"required"`
@@ -32,11 +31,6 @@ type CheckoutRequest struct {
 	Metadata        map[string]interface{} `json:"metadata"`
 }
 
-var (
-	PaymentProviderBePaid = "bepaid"
-	PaymentProviderPayPal = "paypal"
-)
-
 type CheckoutResponse struct {
 	Order       db.Order `json:"order"`
 	PaymentLink string   `json:"payment_link"`
@@ -52,211 +46,281 @@ func (h Handler) Checkout(c echo.Context) error {
 		return err
 	}
 
+	provider, err := h.payments.Get(req.PaymentProvider)
+	if err != nil {
+		return terrors.BadRequest(err, "unsupported payment provider")
+	}
+
 	// get locale from header
 	locale := langFromContext(c)
 
 	// locale := "ru"
 
-	customer, err := h.st.GetCustomerByID(req.CustomerID)
-
-	if err != nil {
-		return terrors.InternalServerError(err, "failed to get customer")
-	} else {
-		// update customer info
-		customer.Name = &req.Name
-		customer.Phone = &req.Phone
-		customer.Country = &req.Country
-		customer.Address = &req.Address
-		customer.ZIP = &req.ZIP
+	var order *db.Order
+	var customer *db.Customer
+	var cartCurrency string
+	var renewed bool
+	status := http.StatusCreated
 
-		customer, err = h.st.UpdateCustomer(customer)
+	// placing the order is one unit of work, so a failure doesn't leave
+	// orders without items or items attached to an order that can't be paid.
+	// The provider is called once it's committed, not to hold the database
+	// lock while waiting for it, and the order is undone if that fails.
+	err = h.st.WithTx(func(tx db.Storage) error {
+		var err error
 
+		customer, err = tx.GetCustomerByID(req.CustomerID)
 		if err != nil {
-			return terrors.InternalServerError(err, "failed to update customer")
+			return terrors.InternalServerError(err, "failed to get customer")
 		}
 
-		log.Infof("Customer updated: %v", customer)
-	}
+		cart, err := tx.GetCartByID(req.CartID, locale)
 
-	// Никита попросил использовать только BYN для Bepaid - USD не поддерживается
-	cart, err := h.st.GetCartByID(req.CartID, locale)
+		if err != nil && errors.Is(err, db.ErrNotFound) {
+			return terrors.NotFound(err, "cart not found")
+		} else if err != nil {
+			return terrors.InternalServerError(err, "failed to get cart")
+		}
 
-	if err != nil && errors.Is(err, db.ErrNotFound) {
-		return terrors.NotFound(err, "cart not found")
-	} else if err != nil {
-		return terrors.InternalServerError(err, "failed to get cart")
-	}
+		cartCurrency = cart.CurrencyCode
+
+		if cart.CompletedAt != nil {
+			// the cart was already checked out, pay for the order placed then
+			// instead of creating a duplicate
+			order, err = tx.GetOrder(db.GetOrderQuery{CartID: &cart.ID})
+			if err != nil {
+				return terrors.InternalServerError(err, "failed to get order")
+			}
+
+			if order.CustomerID != customer.ID {
+				return terrors.Forbidden(errors.New("customer mismatch"), "cart is checked out by another customer")
+			} else if order.PaymentStatus != db.PaymentPending || order.Status != db.OrderNew {
+				return terrors.Conflict(db.ErrCartCompleted, "cart is already checked out")
+			} else if order.PaymentProvider != provider.Name() {
+				return terrors.Conflict(errors.New("payment provider mismatch"), "order is paid with another provider")
+			}
+
+			// the reservations made with the order may have expired or been
+			// released by a failed payment, hold the items again
+			active, err := tx.HasActiveOrderStock(order.ID)
+			if err != nil {
+				return terrors.InternalServerError(err, "failed to get stock reservations")
+			}
+
+			if !active {
+				renewed = true
+
+				if err := tx.ReserveOrderStock(order.ID); err != nil && errors.Is(err, db.ErrOutOfStock) {
+					return terrors.Conflict(err, "not enough stock")
+				} else if err != nil {
+					return terrors.InternalServerError(err, "failed to reserve stock")
+				}
+			}
+
+			if err := tx.ReserveOrderDiscount(order.ID); err != nil && errors.Is(err, db.ErrDiscountUsedUp) {
+				return terrors.Conflict(err, "discount is no longer available")
+			} else if err != nil {
+				return terrors.InternalServerError(err, "failed to reserve discount")
+			}
+
+			status = http.StatusOK
+		} else {
+			// reprice the cart in a currency the provider accepts
+			if currencies := provider.Currencies(); len(currencies) > 0 && !slices.Contains(currencies, cart.CurrencyCode) {
+				if err := tx.UpdateCartCurrency(cart.ID, currencies[0]); err != nil {
+					return terrors.InternalServerError(err, "failed to update cart currency")
+				}
+
+				cart, err = tx.GetCartByID(cart.ID, locale)
+				if err != nil {
+					return terrors.InternalServerError(err, "failed to get cart")
+				}
+			}
+
+			if cart.ShippingMethod == nil {
+				return terrors.BadRequest(errors.New("no shipping method"), "shipping is not available for the selected country")
+			}
+
+			newOrder := db.Order{
+				CustomerID:       customer.ID,
+				Status:           db.OrderNew,
+				PaymentStatus:    db.PaymentPending,
+				Metadata:         req.Metadata,
+				CartID:           cart.ID,
+				Total:            cart.Total,
+				Subtotal:         cart.Subtotal,
+				CurrencyCode:     cart.CurrencyCode,
+				DiscountAmount:   cart.DiscountAmount,
+				PaymentProvider:  req.PaymentProvider,
+				ShippingMethodID: &cart.ShippingMethod.ID,
+			}
+
+			// a discount that no longer applies isn't part of the total
+			if cart.DiscountReason == "" {
+				newOrder.DiscountID = cart.DiscountID
+			}
+
+			order, err = tx.CreateOrder(newOrder)
+
+			if err != nil {
+				return terrors.InternalServerError(err, "failed to create order")
+			}
+
+			if err := tx.UpdateLineItemsOrderID(cart.ID, order.ID, locale); err != nil && errors.Is(err, db.ErrPriceMissing) {
+				return terrors.Conflict(err, "some items are not sold in the order currency")
+			} else if err != nil {
+				return terrors.InternalServerError(err, "failed to update line items order id")
+			}
+
+			if err := tx.CompleteCart(cart.ID); err != nil && errors.Is(err, db.ErrCartCompleted) {
+				return terrors.Conflict(err, "cart is already checked out")
+			} else if err != nil {
+				return terrors.InternalServerError(err, "failed to complete cart")
+			}
+
+			if err := tx.ReserveOrderStock(order.ID); err != nil && errors.Is(err, db.ErrOutOfStock) {
+				return terrors.Conflict(err, "not enough stock")
+			} else if err != nil {
+				return terrors.InternalServerError(err, "failed to reserve stock")
+			}
+
+			if err := tx.ReserveOrderDiscount(order.ID); err != nil && errors.Is(err, db.ErrDiscountUsedUp) {
+				return terrors.Conflict(err, "discount is no longer available")
+			} else if err != nil {
+				return terrors.InternalServerError(err, "failed to reserve discount")
+			}
+
+			order, err = tx.GetOrder(db.GetOrderQuery{ID: &order.ID})
+			if err != nil {
+				return terrors.InternalServerError(err, "failed to get order")
+			}
+		}
+
+		return nil
+	})
 
-	currencyCode := "BYN"
-	if req.PaymentProvider == PaymentProviderPayPal {
-		currencyCode = "USD"
+	if err != nil {
+		return err
 	}
 
-	newOrder := db.Order{
-		CustomerID:      customer.ID,
-		Status:          db.OrderNew,
-		PaymentStatus:   db.PaymentPending,
-		Metadata:        req.Metadata,
-		CartID:          cart.ID,
-		Total:           cart.Total,
-		Subtotal:        cart.Subtotal,
-		CurrencyCode:    currencyCode,
-		PaymentProvider: req.PaymentProvider,
+	if status == http.StatusOK && !renewed {
+		// hand out the payment started last time while it's still open,
+		// rather than a second one the customer could pay as well. Once the
+		// reservations lapsed a new payment is started instead
+		open, err := h.st.GetOpenOrderPayment(order.ID, provider.Name())
+		if err == nil {
+			if err := h.st.WithTx(func(tx db.Storage) error { return saveCustomer(tx, customer, req) }); err != nil {
+				return err
+			}
+
+			return c.JSON(status, CheckoutResponse{Order: *order, PaymentLink: open.RedirectURL})
+		} else if !errors.Is(err, db.ErrNotFound) {
+			return terrors.InternalServerError(err, "failed to get order payment")
+		}
 	}
 
-	order, err := h.st.CreateOrder(newOrder)
+	p, err := provider.CreatePayment(payment.PaymentRequest{
+		OrderID:     order.ID,
+		Amount:      order.Total * 100,
+		Currency:    order.CurrencyCode,
+		Description: order.ToString(),
+		Language:    locale,
+		Customer: payment.Customer{
+			ID:      customer.ID,
+			Email:   customer.Email,
+			Name:    req.Name,
+			Phone:   req.Phone,
+			Country: req.Country,
+			Address: req.Address,
+			ZIP:     req.ZIP,
+		},
+		ReturnURL:       fmt.Sprintf("%s/en/orders?orderId=%d", h.config.WebURL, order.ID),
+		CancelURL:       fmt.Sprintf("%s/en/orders/cancel?orderId=%d", h.config.WebURL, order.ID),
+		NotificationURL: fmt.Sprintf("%s/webhook/%s", h.config.ExternalURL, provider.Name()),
+	})
 
 	if err != nil {
-		return terrors.InternalServerError(err, "failed to create order")
-	}
+		// a new order is taken back with its reservations and the cart is
+		// reopened as it was, so the customer can try again
+		if status == http.StatusCreated {
+			if err := h.st.UndoCheckout(order.ID, cartCurrency); err != nil {
+				log.Errorf("failed to undo checkout of order %d: %v", order.ID, err)
+			}
+		} else if renewed {
+			if err := h.st.ReleaseOrderReservations(order.ID); err != nil {
+				log.Errorf("failed to release reservations of order %d: %v", order.ID, err)
+			}
+		}
 
-	if err := h.st.UpdateLineItemsOrderID(cart.ID, order.ID); err != nil {
-		return terrors.InternalServerError(err, "failed to update line items order id")
+		return terrors.InternalServerError(err, "failed to create payment")
 	}
 
-	order, err = h.st.GetOrder(db.GetOrderQuery{ID: &order.ID})
-	if err != nil {
-		return terrors.InternalServerError(err, "failed to get order")
+	// earlier payments stay linked to the order, the customer may still pay
+	// one of them
+	op := db.OrderPayment{
+		OrderID:     order.ID,
+		Provider:    provider.Name(),
+		RedirectURL: p.RedirectURL,
 	}
 
-	var paymentLink string
-	if req.PaymentProvider == PaymentProviderBePaid {
-		paymentRequest := payment.BepaidTokenRequest{
-			Checkout: payment.BepaidCheckout{
-				Attempts:        1,
-				Test:            h.config.Bepaid.TestMode,
-				TransactionType: "payment",
-				Settings: payment.BepaidSettings{
-					NotificationUrl: fmt.Sprintf("%s/webhook/bepaid", h.config.ExternalURL),
-					SuccessUrl:      fmt.Sprintf("%s/en/orders?orderId=%d", h.config.WebURL, order.ID),
-					Language:        locale,
-					AutoReturn:      "0",
-					WidgetStyle: map[string]interface{}{
-						"widget": map[string]interface{}{
-							"backgroundColor": "#ffffff",
-							"buttonsColor":    "#262626",
-							"backgroundType":  "2",
-							"color":           "#262626",
-							"fontSize":        "15px",
-							"fontWeight":      "400",
-							"lineHeight":      "21px",
-						},
-						"inputs": map[string]interface{}{
-							"backgroundColor": "#f8f8f8",
-							"holder": map[string]interface{}{
-								"backgroundColor": "#f8f8f8",
-							},
-						},
-						"button": map[string]interface{}{
-							"backgroundColor": "#262626",
-							"pay": map[string]interface{}{
-								"color": "#ffffff",
-							},
-							"card": map[string]interface{}{
-								"color": "#ffffff",
-							},
-							"brands": map[string]interface{}{
-								"color": "#ffffff",
-							},
-						},
-					},
-				},
-				Order: payment.BepaidOrder{
-					Amount:      order.Total * 100,
-					Currency:    order.CurrencyCode,
-					Description: order.ToString(),
-					TrackingID:  strconv.FormatInt(order.ID, 10),
-				},
-				Customer: payment.BepaidCustomer{
-					Email:     customer.Email,
-					FirstName: *customer.Name,
-					LastName:  *customer.Name,
-					Address:   *customer.Address,
-					ZIP:       *customer.ZIP,
-					Country:   *customer.Country,
-					Phone:     *customer.Phone,
-				},
-			},
-		}
+	if p.ID != "" {
+		op.PaymentID = &p.ID
+	}
 
-		tokenResp, err := payment.CreatePaymentToken(
-			paymentRequest,
-			fmt.Sprintf("%s/ctp/api/checkouts", h.config.Bepaid.ApiURL),
-			h.config.Bepaid.ShopID,
-			h.config.Bepaid.SecretKey,
-		)
-		if err != nil {
-			return terrors.InternalServerError(err, "failed to create payment token")
-		}
-		paymentLink = tokenResp.Checkout.RedirectUrl
-	} else if req.PaymentProvider == PaymentProviderPayPal {
-		// Populate PayPal-specific fields
-		paypalRequest := payment.PayPalRequest{
-			PurchaseUnits: []paypal.PurchaseUnitRequest{
-				{
-					Amount: &paypal.PurchaseUnitAmount{
-						Currency: order.CurrencyCode,
-						Value:    strconv.Itoa(order.Total),
-					},
-					Description: order.ToString(),
-					CustomID:    strconv.FormatInt(order.ID, 10), // Order ID as tracking ID
-				},
-			},
-			ApplicationContext: &paypal.ApplicationContext{
-				BrandName:   "PLUM<3",
-				LandingPage: "BILLING",
-				UserAction:  "PAY_NOW",
-				ReturnURL:   fmt.Sprintf("%s/en/orders?orderId=%d", h.config.WebURL, order.ID),
-				CancelURL:   fmt.Sprintf("%s/en/orders/cancel?orderId=%d", h.config.WebURL, order.ID),
-			},
-			Payer: &paypal.Payer{
-				PayerInfo: &paypal.PayerInfo{
-					Email:       customer.Email,
-					FirstName:   req.Name,
-					Phone:       req.Phone,
-					CountryCode: req.Country,
-					PayerID:     strconv.FormatInt(customer.ID, 10),
-					ShippingAddress: &paypal.ShippingAddress{
-						RecipientName: req.Name,
-						Line1:         req.Address,
-						PostalCode:    req.ZIP,
-						CountryCode:   req.Country,
-					},
-				},
-			},
+	err = h.st.WithTx(func(tx db.Storage) error {
+		if err := saveCustomer(tx, customer, req); err != nil {
+			return err
 		}
 
-		// Create PayPal order
-		paypalResp, err := h.paypal.CreatePaypalOrder(paypalRequest)
-		if err != nil {
-			return terrors.InternalServerError(err, "failed to create PayPal payment")
-		}
-		id := paypalResp.ID
-		// save payment id
-		order.PaymentID = &id
-		order, err = h.st.UpdateOrder(order)
-		if err != nil {
+		if err := tx.AddOrderPayment(op); err != nil && errors.Is(err, db.ErrNotFound) {
+			return terrors.Conflict(err, "order is no longer awaiting payment")
+		} else if err != nil {
 			return terrors.InternalServerError(err, "failed to update order")
 		}
 
-	} else {
-		return terrors.BadRequest(errors.New("unsupported payment provider"), "unsupported payment provider")
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	order, err = h.st.GetOrder(db.GetOrderQuery{ID: &order.ID})
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to get order")
 	}
 
 	cr := CheckoutResponse{
 		Order:       *order,
-		PaymentLink: paymentLink,
+		PaymentLink: p.RedirectURL,
+	}
+
+	return c.JSON(status, cr)
+}
+
+// saveCustomer stores the contact details the customer checked out with.
+func saveCustomer(tx db.Storage, customer *db.Customer, req CheckoutRequest) error {
+	customer.Name = &req.Name
+	customer.Phone = &req.Phone
+	customer.Country = &req.Country
+	customer.Address = &req.Address
+	customer.ZIP = &req.ZIP
+
+	if _, err := tx.UpdateCustomer(customer); err != nil {
+		return terrors.InternalServerError(err, "failed to update customer")
 	}
 
-	return c.JSON(http.StatusCreated, cr)
+	return nil
 }
 
-type CapturePaypalPaymentRequest struct {
-	OrderID string `json:"order_id" validate:"required"`
+type CapturePaymentRequest struct {
+	Provider string `param:"provider" json:"-" validate:"required"`
+	// PaymentID is the provider's payment reference, e.g. the PayPal order ID.
+	PaymentID string `json:"order_id" validate:"required"`
 }
 
-func (h Handler) CapturePaypalPayment(c echo.Context) error {
-	var req CapturePaypalPaymentRequest
+func (h Handler) CapturePayment(c echo.Context) error {
+	var req CapturePaymentRequest
 	if err := c.Bind(&req); err != nil {
 		return err
 	}
@@ -265,32 +329,43 @@ func (h Handler) CapturePaypalPayment(c echo.Context) error {
 		return err
 	}
 
-	resp, err := h.paypal.CapturePaypalOrder(req.OrderID)
+	provider, err := h.payments.Get(req.Provider)
 	if err != nil {
-		return terrors.InternalServerError(err, "failed to capture PayPal payment")
+		return terrors.NotFound(err, "unknown payment provider")
 	}
 
-	log.Infof("PayPal payment captured: %v", resp)
+	order, err := h.st.GetOrder(db.GetOrderQuery{PaymentID: &req.PaymentID})
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "order not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to get order")
+	}
 
-	if resp.Status != "COMPLETED" {
-		return terrors.BadRequest(errors.New("payment not completed"), "payment not completed")
+	if order.PaymentProvider != provider.Name() {
+		return terrors.BadRequest(errors.New("payment provider mismatch"), "order is paid with another provider")
 	}
 
-	order, err := h.st.GetOrder(db.GetOrderQuery{PaymentID: &req.OrderID})
+	tx, err := provider.Capture(req.PaymentID)
+	if err != nil && errors.Is(err, payment.ErrNotSupported) {
+		return terrors.BadRequest(err, "capture is not supported by the payment provider")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to capture payment")
+	}
 
-	if err != nil {
-		return terrors.InternalServerError(err, "failed to get order")
+	if tx.PaymentStatus != payment.StatusPaid {
+		return terrors.BadRequest(errors.New("payment not completed"), "payment not completed")
 	}
 
-	order.PaymentStatus = db.PaymentPaid
+	tx.OrderID = &order.ID
 
-	if _, err = h.st.UpdateOrder(order); err != nil {
+	if _, err := h.applyTransaction(provider.Name(), *tx); err != nil {
 		return terrors.InternalServerError(err, "failed to update order")
 	}
 
-	go func() {
-		h.telegramOrderPaid(*order)
-	}()
+	order, err = h.st.GetOrder(db.GetOrderQuery{ID: &order.ID})
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to get order")
+	}
 
 	return c.JSON(http.StatusOK, order)
 }
@@ -2,50 +2,55 @@ package store
 
 import (
 	"github.com/labstack/echo/v4"
-	"github.com/plutov/paypal/v4"
 	"log"
 	"rednit/config"
 	"rednit/db"
+	"rednit/notification"
 	"rednit/payment"
 )
 
 type Handler struct {
-	st     storage
-	config config.Default
-	paypal paymentPaypal
+	st       storage
+	config   config.Default
+	payments paymentProviders
+	team     notification.TeamNotifier
 }
 
-func New(st storage, config config.Default, p paymentPaypal) Handler {
-	return Handler{st: st, config: config, paypal: p}
+func New(st storage, config config.Default, p paymentProviders, team notification.TeamNotifier) Handler {
+	return Handler{st: st, config: config, payments: p, team: team}
 }
 
-type paymentPaypal interface {
-	CreatePaypalOrder(request payment.PayPalRequest) (*paypal.Order, error)
-	CapturePaypalOrder(orderID string) (*paypal.CaptureOrderResponse, error)
+type paymentProviders interface {
+	Get(name string) (payment.Provider, error)
 }
 
 type storage interface {
-	ListProducts(params db.ListProductsQuery) ([]db.Product, error)
+	ListProducts(params db.ListProductsQuery) (*db.Page[db.Product], error)
+	ListCategories(locale string) ([]db.Category, error)
 	GetProduct(query db.GetProductQuery) (*db.Product, error)
 	CreateCart(cart db.Cart, lang string) (*db.Cart, error)
 	GetCartByID(cartID int64, locale string) (*db.Cart, error)
 	SaveLineItem(li db.LineItem) error
 	GetCustomerByEmail(email string) (*db.Customer, error)
-	GetCustomerByID(id int64) (*db.Customer, error)
 	AddCustomer(c db.Customer) (*db.Customer, error)
-	CreateOrder(o db.Order) (*db.Order, error)
 	GetDiscount(query db.DiscountQuery) (*db.Discount, error)
-	UpdateDiscountUsageCount(id int64) error
-	UpdateOrder(o *db.Order) (*db.Order, error)
+	ValidateCartDiscount(d db.Discount, cart db.Cart) (db.DiscountReason, error)
 	GetOrder(query db.GetOrderQuery) (*db.Order, error)
-	UpdateLineItemsOrderID(cartID, orderID int64) error
+	AddOrderPayment(p db.OrderPayment) error
+	GetOpenOrderPayment(orderID int64, provider string) (*db.OrderPayment, error)
+	UndoCheckout(orderID int64, cartCurrency string) error
+	ReleaseOrderReservations(orderID int64) error
 	UpdateCartDiscount(cartID, discountID int64) error
 	DropCartDiscount(cartID int64) error
-	UpdateLineItemQuantity(li int64, quantity int) error
-	RemoveLineItem(li int64) error
-	UpdateCustomer(c *db.Customer) (*db.Customer, error)
+	UpdateLineItemQuantity(cartID, li int64, quantity int) error
+	RemoveLineItem(cartID, li int64) error
 	UpdateCartCustomer(cartID int64, customerID int64) error
 	UpdateCartCurrency(cartID int64, currency string) error
+	ListCartShippingMethods(cart *db.Cart) ([]db.ShippingMethod, error)
+	UpdateCartShippingMethod(cartID int64, shippingMethodID int64) error
+	ProcessPaymentEvent(e db.PaymentEvent) (*db.PaymentEvent, error)
+	GetOrderIDByTransaction(provider, transactionID string) (int64, error)
+	WithTx(fn func(tx db.Storage) error) error
 }
 
 func langFromContext(c echo.Context) string {
@@ -8,13 +8,69 @@ import (
 	"rednit/terrors"
 )
 
+// nextCursorHeader carries the cursor of the next page of a list.
+const nextCursorHeader = "X-Next-Cursor"
+
+type ListProductsRequest struct {
+	Category string `query:"category"`
+	Search   string `query:"q" validate:"max=255"`
+	Currency string `query:"currency" validate:"omitempty,iso4217"`
+	MinPrice *int   `query:"min_price" validate:"omitempty,min=0"`
+	MaxPrice *int   `query:"max_price" validate:"omitempty,min=0"`
+	InStock  bool   `query:"in_stock"`
+	Size     string `query:"size"`
+	Sort     string `query:"sort" validate:"omitempty,oneof=newest price_asc price_desc"`
+	Cursor   string `query:"cursor"`
+	Limit    int    `query:"limit" validate:"min=0,max=100"`
+}
+
+// ListProducts returns a page of the published products. The cursor of the
+// next page, if there is one, is sent in the X-Next-Cursor header.
 func (h Handler) ListProducts(c echo.Context) error {
-	products, err := h.st.ListProducts(db.ListProductsQuery{Locale: langFromContext(c), IsPublished: true})
-	if err != nil {
+	var req ListProductsRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	list, err := h.st.ListProducts(db.ListProductsQuery{
+		Locale:      langFromContext(c),
+		IsPublished: true,
+		Category:    req.Category,
+		Search:      req.Search,
+		Currency:    req.Currency,
+		MinPrice:    req.MinPrice,
+		MaxPrice:    req.MaxPrice,
+		InStock:     req.InStock,
+		Size:        req.Size,
+		Sort:        req.Sort,
+		Cursor:      req.Cursor,
+		Limit:       req.Limit,
+	})
+
+	if err != nil && errors.Is(err, db.ErrInvalidCursor) {
+		return terrors.BadRequest(err, "invalid cursor")
+	} else if err != nil {
 		return terrors.InternalServerError(err, "failed to list products")
 	}
 
-	return c.JSON(http.StatusOK, products)
+	if list.NextCursor != "" {
+		c.Response().Header().Set(nextCursorHeader, list.NextCursor)
+	}
+
+	return c.JSON(http.StatusOK, list.Items)
+}
+
+func (h Handler) ListCategories(c echo.Context) error {
+	categories, err := h.st.ListCategories(langFromContext(c))
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to list categories")
+	}
+
+	return c.JSON(http.StatusOK, categories)
 }
 
 func (h Handler) GetProduct(c echo.Context) error {
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"rednit/db"
+	"rednit/terrors"
+	"strconv"
+)
+
+func (h Handler) ListCartShippingMethods(c echo.Context) error {
+	cartID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+
+	if err != nil {
+		return terrors.BadRequest(err, "invalid cart id")
+	}
+
+	cart, err := h.st.GetCartByID(cartID, langFromContext(c))
+
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "cart not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to get cart")
+	}
+
+	methods, err := h.st.ListCartShippingMethods(cart)
+
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to list shipping methods")
+	}
+
+	return c.JSON(http.StatusOK, methods)
+}
+
+type UpdateCartShippingMethodRequest struct {
+	ShippingMethodID int64 `json:"shipping_method_id" validate:"required"`
+}
+
+func (h Handler) UpdateCartShippingMethod(c echo.Context) error {
+	cartID, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+
+	if cartID == 0 {
+		return terrors.BadRequest(errors.New("invalid cart id"), "invalid cart id")
+	}
+
+	var req UpdateCartShippingMethodRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if err := c.Validate(req); err != nil {
+		return err
+	}
+
+	cart, err := h.st.GetCartByID(cartID, langFromContext(c))
+
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		return terrors.NotFound(err, "cart not found")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to get cart")
+	}
+
+	methods, err := h.st.ListCartShippingMethods(cart)
+
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to list shipping methods")
+	}
+
+	available := false
+	for _, m := range methods {
+		if m.ID == req.ShippingMethodID {
+			available = true
+			break
+		}
+	}
+
+	if !available {
+		return terrors.BadRequest(errors.New("shipping method not available"), "shipping method is not available for this cart")
+	}
+
+	if err := h.st.UpdateCartShippingMethod(cartID, req.ShippingMethodID); err != nil && errors.Is(err, db.ErrCartCompleted) {
+		return terrors.Conflict(err, "cart is already checked out")
+	} else if err != nil {
+		return terrors.InternalServerError(err, "failed to update cart shipping method")
+	}
+
+	cart, err = h.st.GetCartByID(cartID, langFromContext(c))
+
+	if err != nil {
+		return terrors.InternalServerError(err, "failed to get cart")
+	}
+
+	return c.JSON(http.StatusOK, cart)
+}
@@ -10,12 +10,13 @@ import (
 	"rednit/notification"
 	"rednit/payment"
 	"rednit/terrors"
-	"strconv"
 )
 
 func (h Handler) telegramOrderPaid(order db.Order) {
 	var delivery string
-	if order.CurrencyCode == "BYN" {
+	if order.ShippingMethod != nil {
+		delivery = order.ShippingMethod.Name
+	} else if order.CurrencyCode == "BYN" {
 		delivery = "Сдэком по СНГ"
 	} else {
 		delivery = "Международная Экспресс доставка"
@@ -38,65 +39,138 @@ Email: %s
 
 	msg = notification.EscapeMarkdown(msg)
 
-	if err := notification.NotifyTelegram(h.config.Notifications.Telegram.BotToken, h.config.Notifications.Telegram.ChatID, msg); err != nil {
+	if err := h.team.NotifyTeam(msg); err != nil {
 		log.Printf("failed to send notification to telegram: %v", err)
 	}
 }
 
-func (h Handler) BepaidNotification(c echo.Context) error {
-	req := new(payment.BepaidNotification)
+// transactionOrderID maps a provider transaction back to our order: by the
+// order ID the provider echoes back, by the payment reference saved at
+// checkout or by the transaction it refers to, e.g. the refunded capture.
+func (h Handler) transactionOrderID(provider string, tx payment.Transaction) *int64 {
+	if tx.OrderID != nil {
+		return tx.OrderID
+	}
 
-	if err := c.Bind(req); err != nil {
-		return err
+	if tx.PaymentID != "" {
+		if order, err := h.st.GetOrder(db.GetOrderQuery{PaymentID: &tx.PaymentID}); err == nil {
+			return &order.ID
+		}
 	}
 
-	username, password, ok := c.Request().BasicAuth()
-	if !ok {
-		return terrors.Unauthorized(errors.New("bepaid: missing credentials"), "missing credentials")
+	if tx.ParentID != "" {
+		if id, err := h.st.GetOrderIDByTransaction(provider, tx.ParentID); err == nil {
+			return &id
+		}
 	}
 
-	if username != h.config.Bepaid.ShopID || password != h.config.Bepaid.SecretKey {
-		return terrors.Unauthorized(errors.New("bepaid: invalid credentials"), "invalid credentials")
+	return nil
+}
+
+// applyTransaction records a provider transaction against its order and
+// notifies the team the first time the order becomes paid.
+func (h Handler) applyTransaction(provider string, tx payment.Transaction) (*db.PaymentEvent, error) {
+	event := db.PaymentEvent{
+		Provider:      provider,
+		TransactionID: tx.ID,
+		OrderID:       h.transactionOrderID(provider, tx),
+		Status:        tx.Status,
+		PaymentStatus: db.PaymentStatus(tx.PaymentStatus),
+		Amount:        tx.Amount,
+		CurrencyCode:  tx.Currency,
+		RawBody:       tx.Raw,
 	}
 
-	// get order by tracking_id
-	id, err := strconv.ParseInt(req.Transaction.TrackingId, 10, 64)
+	if tx.PaymentID != "" {
+		event.PaymentID = &tx.PaymentID
+	}
 
+	processed, err := h.st.ProcessPaymentEvent(event)
 	if err != nil {
-		return terrors.BadRequest(err, "invalid tracking_id")
+		return nil, err
+	}
+
+	if processed.Result == db.PaymentEventOutOfStock {
+		log.Printf("%s: order %d was paid by transaction %s but its stock is gone, refund or restock it", provider, *processed.OrderID, processed.TransactionID)
+	} else if processed.Result != db.PaymentEventApplied {
+		log.Printf("%s: transaction %s (%s) not applied: %s", provider, processed.TransactionID, processed.Status, processed.Result)
+		return processed, nil
+	}
+
+	if processed.PaymentStatus == db.PaymentPaid {
+		order, err := h.st.GetOrder(db.GetOrderQuery{ID: processed.OrderID})
+		if err != nil {
+			return nil, err
+		}
+
+		go func() {
+			h.telegramOrderPaid(*order)
+		}()
 	}
 
-	order, err := h.st.GetOrder(db.GetOrderQuery{ID: &id})
+	return processed, nil
+}
 
+func (h Handler) PaymentNotification(c echo.Context) error {
+	provider, err := h.payments.Get(c.Param("provider"))
 	if err != nil {
-		return err
+		return terrors.NotFound(err, "unknown payment provider")
 	}
 
-	switch req.Transaction.Status {
-	case "successful":
-		order.PaymentStatus = db.PaymentPaid
-	case "failed":
-		order.PaymentStatus = db.PaymentFailed
-	case "incomplete":
-		order.PaymentStatus = db.PaymentPending
-	case "expired":
-		order.PaymentStatus = db.PaymentFailed
-	default:
-		return terrors.BadRequest(errors.New(fmt.Sprintf("bepaid: invalid status %s", req.Transaction.Status)), "invalid status")
+	event, err := provider.ParseWebhook(c.Request())
+	if err != nil && errors.Is(err, payment.ErrInvalidSignature) {
+		return terrors.Unauthorized(err, "invalid signature")
+	} else if err != nil {
+		return terrors.BadRequest(err, "invalid body")
 	}
 
-	order.PaymentID = &req.Transaction.ID
+	if event.Approved != "" {
+		return h.captureApprovedPayment(c, provider, event.Approved)
+	}
 
-	_, err = h.st.UpdateOrder(order)
+	if event.Transaction == nil {
+		return c.NoContent(http.StatusOK)
+	}
 
-	if err != nil {
+	// events that are not applied are acknowledged as well, so that the
+	// provider stops retrying, the event log keeps the details
+	if _, err := h.applyTransaction(provider.Name(), *event.Transaction); err != nil {
+		return terrors.InternalServerError(err, "failed to process payment event")
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// captureApprovedPayment captures a payment the customer approved but that
+// was never captured from the browser, e.g. because the tab was closed.
+func (h Handler) captureApprovedPayment(c echo.Context, provider payment.Provider, paymentID string) error {
+	order, err := h.st.GetOrder(db.GetOrderQuery{PaymentID: &paymentID})
+	if err != nil && errors.Is(err, db.ErrNotFound) {
+		log.Printf("%s: approved payment %s not found", provider.Name(), paymentID)
+		return c.NoContent(http.StatusOK)
+	} else if err != nil {
 		return err
 	}
 
 	if order.PaymentStatus == db.PaymentPaid {
-		go func() {
-			h.telegramOrderPaid(*order)
-		}()
+		return c.NoContent(http.StatusOK)
+	}
+
+	tx, err := provider.Capture(paymentID)
+	if err != nil {
+		// most likely already captured by the browser, the capture webhook follows
+		log.Printf("%s: failed to capture approved payment %s: %v", provider.Name(), paymentID, err)
+		return c.NoContent(http.StatusOK)
+	}
+
+	if tx.PaymentStatus != payment.StatusPaid {
+		return c.NoContent(http.StatusOK)
+	}
+
+	tx.OrderID = &order.ID
+
+	if _, err := h.applyTransaction(provider.Name(), *tx); err != nil {
+		return err
 	}
 
 	return c.NoContent(http.StatusOK)
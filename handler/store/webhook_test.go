@@ -0,0 +1,337 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"rednit/config"
+	"rednit/db"
+	"rednit/payment"
+	"rednit/terrors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const testOrderID = 1
+
+// paypalStub is a local PayPal API that accepts every webhook signature
+// but the one sent as "bad".
+func paypalStub(t *testing.T) *httptest.Server {
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/v1/oauth2/token":
+			fmt.Fprint(w, `{"access_token":"token","token_type":"Bearer","expires_in":3600}`)
+		case "/v1/notifications/verify-webhook-signature":
+			var req struct {
+				TransmissionSig string `json:"transmission_sig"`
+				WebhookID       string `json:"webhook_id"`
+			}
+
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			status := "SUCCESS"
+			if req.TransmissionSig == "bad" || req.WebhookID != "WH-1" {
+				status = "FAILURE"
+			}
+
+			fmt.Fprintf(w, `{"verification_status":%q}`, status)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	t.Cleanup(stub.Close)
+
+	return stub
+}
+
+// teamStub collects the team messages instead of posting them to Telegram.
+type teamStub chan string
+
+func (t teamStub) NotifyTeam(message string) error {
+	t <- message
+	return nil
+}
+
+type webhookTest struct {
+	t    *testing.T
+	e    *echo.Echo
+	st   *db.Storage
+	raw  *sql.DB
+	team teamStub
+}
+
+// newWebhookTest sets up the webhook handler with PayPal pointed at a stub
+// and a database holding an unpaid 100 USD order with a reserved item.
+func newWebhookTest(t *testing.T) *webhookTest {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	st, err := db.ConnectDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := st.Migrate(); err != nil && strings.Contains(err.Error(), "fts5") {
+		t.Skip("the migrations need go-sqlite3 built with -tags sqlite_fts5, run make test")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { raw.Close() })
+
+	_, err = raw.Exec(`
+		INSERT INTO customers (id, email, name, phone, country, address, zip) VALUES (1, 'a@example.com', 'Ann', '+100', 'US', 'Main St 1', '10001');
+		INSERT INTO products (id, handle, cover_image_url, image_urls, name, description, materials, is_published) VALUES (1, 'dress', 'c', 'i', 'Dress', 'd', 'm', 1);
+		INSERT INTO product_variants (id, product_id, name, available) VALUES (1, 1, 'S', 5);
+		INSERT INTO cart (id, customer_id, currency_code, context) VALUES (1, 1, 'USD', '{}');
+		INSERT INTO orders (id, customer_id, cart_id, status, payment_status, payment_provider, payment_id, currency_code, total, subtotal)
+		VALUES (1, 1, 1, 'new', 'pending', 'paypal', 'PAYPAL-ORDER-1', 'USD', 100, 100);
+		INSERT INTO line_items (cart_id, order_id, variant_id, quantity, price, currency_code, product_name, variant_name, image_url)
+		VALUES (1, 1, 1, 1, 100, 'USD', 'Dress', 'S', 'c');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := st.ReserveOrderStock(testOrderID); err != nil {
+		t.Fatal(err)
+	}
+
+	stub := paypalStub(t)
+
+	client, err := payment.NewPaypalClient("client", "secret", stub.URL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	team := make(teamStub, 10)
+
+	h := New(st, config.Default{}, payment.NewRegistry(payment.NewPaypal(client, "WH-1", []string{"USD"})), team)
+
+	e := echo.New()
+	e.HTTPErrorHandler = func(err error, c echo.Context) {
+		var terr *terrors.Error
+		if errors.As(err, &terr) {
+			c.JSON(terr.Code, terr.Message)
+			return
+		}
+
+		e.DefaultHTTPErrorHandler(err, c)
+	}
+
+	e.POST("/webhook/:provider", h.PaymentNotification)
+
+	return &webhookTest{t: t, e: e, st: st, raw: raw, team: team}
+}
+
+// send posts a PAYMENT.CAPTURE.* event for the resource with the signature
+// and returns the response status.
+func (wt *webhookTest) send(eventType, signature, resource string) int {
+	body := fmt.Sprintf(`{"id":"WH-EVENT","event_type":%q,"resource":%s}`, eventType, resource)
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook/paypal", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("PAYPAL-TRANSMISSION-SIG", signature)
+
+	rec := httptest.NewRecorder()
+	wt.e.ServeHTTP(rec, req)
+
+	return rec.Code
+}
+
+func (wt *webhookTest) order() *db.Order {
+	id := int64(testOrderID)
+
+	order, err := wt.st.GetOrder(db.GetOrderQuery{ID: &id})
+	if err != nil {
+		wt.t.Fatal(err)
+	}
+
+	return order
+}
+
+func (wt *webhookTest) count(query string) int {
+	var n int
+	if err := wt.raw.QueryRow(query).Scan(&n); err != nil {
+		wt.t.Fatal(err)
+	}
+
+	return n
+}
+
+const (
+	captureCompleted = `{"id":"CAPTURE-1","status":"COMPLETED","custom_id":"1","amount":{"currency_code":"USD","value":"100.00"},
+		"supplementary_data":{"related_ids":{"order_id":"PAYPAL-ORDER-1"}}}`
+	captureDenied = `{"id":"CAPTURE-1","status":"DECLINED","custom_id":"1","amount":{"currency_code":"USD","value":"100.00"},
+		"supplementary_data":{"related_ids":{"order_id":"PAYPAL-ORDER-1"}}}`
+	captureRefunded = `{"id":"REFUND-1","status":"COMPLETED","amount":{"currency_code":"USD","value":"100.00"},
+		"links":[{"href":"https://api.paypal.com/v2/payments/captures/CAPTURE-1","rel":"up"}]}`
+)
+
+func TestPaypalWebhookCompleted(t *testing.T) {
+	wt := newWebhookTest(t)
+
+	if code := wt.send("PAYMENT.CAPTURE.COMPLETED", "good", captureCompleted); code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+
+	if status := wt.order().PaymentStatus; status != db.PaymentPaid {
+		t.Errorf("payment status = %s, want %s", status, db.PaymentPaid)
+	}
+
+	if n := wt.count("SELECT available FROM product_variants WHERE id = 1"); n != 4 {
+		t.Errorf("available = %d, want 4", n)
+	}
+
+	select {
+	case <-wt.team:
+	case <-time.After(time.Second):
+		t.Error("the team wasn't notified of the paid order")
+	}
+}
+
+func TestPaypalWebhookDenied(t *testing.T) {
+	wt := newWebhookTest(t)
+
+	if code := wt.send("PAYMENT.CAPTURE.DENIED", "good", captureDenied); code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+
+	if status := wt.order().PaymentStatus; status != db.PaymentFailed {
+		t.Errorf("payment status = %s, want %s", status, db.PaymentFailed)
+	}
+
+	if n := wt.count("SELECT COUNT(*) FROM stock_reservations WHERE status = 'reserved'"); n != 0 {
+		t.Errorf("reserved reservations = %d, want 0", n)
+	}
+}
+
+func TestPaypalWebhookRefunded(t *testing.T) {
+	wt := newWebhookTest(t)
+
+	if code := wt.send("PAYMENT.CAPTURE.COMPLETED", "good", captureCompleted); code != http.StatusOK {
+		t.Fatalf("capture status = %d, want %d", code, http.StatusOK)
+	}
+
+	if code := wt.send("PAYMENT.CAPTURE.REFUNDED", "good", captureRefunded); code != http.StatusOK {
+		t.Fatalf("refund status = %d, want %d", code, http.StatusOK)
+	}
+
+	if status := wt.order().PaymentStatus; status != db.PaymentRefunded {
+		t.Errorf("payment status = %s, want %s", status, db.PaymentRefunded)
+	}
+
+	if n := wt.count("SELECT COUNT(*) FROM refunds WHERE order_id = 1 AND provider_refund_id = 'REFUND-1' AND status = 'succeeded'"); n != 1 {
+		t.Errorf("succeeded refunds = %d, want 1", n)
+	}
+}
+
+func TestPaypalWebhookInvalidSignature(t *testing.T) {
+	wt := newWebhookTest(t)
+
+	code := wt.send("PAYMENT.CAPTURE.COMPLETED", "bad", captureCompleted)
+	if code < 400 || code >= 500 {
+		t.Fatalf("status = %d, want 4xx", code)
+	}
+
+	if status := wt.order().PaymentStatus; status != db.PaymentPending {
+		t.Errorf("payment status = %s, want %s", status, db.PaymentPending)
+	}
+
+	if n := wt.count("SELECT COUNT(*) FROM payment_events"); n != 0 {
+		t.Errorf("payment events = %d, want 0", n)
+	}
+}
+
+func TestPaypalWebhookReplay(t *testing.T) {
+	wt := newWebhookTest(t)
+
+	for i := 0; i < 2; i++ {
+		if code := wt.send("PAYMENT.CAPTURE.COMPLETED", "good", captureCompleted); code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", code, http.StatusOK)
+		}
+	}
+
+	if status := wt.order().PaymentStatus; status != db.PaymentPaid {
+		t.Errorf("payment status = %s, want %s", status, db.PaymentPaid)
+	}
+
+	if n := wt.count("SELECT available FROM product_variants WHERE id = 1"); n != 4 {
+		t.Errorf("available = %d, want 4", n)
+	}
+
+	if n := wt.count("SELECT COUNT(*) FROM payment_events WHERE result = 'applied'"); n != 1 {
+		t.Errorf("applied events = %d, want 1", n)
+	}
+}
+
+func TestPaypalWebhookPaidAfterRelease(t *testing.T) {
+	wt := newWebhookTest(t)
+
+	if code := wt.send("PAYMENT.CAPTURE.DENIED", "good", captureDenied); code != http.StatusOK {
+		t.Fatalf("denied status = %d, want %d", code, http.StatusOK)
+	}
+
+	if code := wt.send("PAYMENT.CAPTURE.COMPLETED", "good", captureCompleted); code != http.StatusOK {
+		t.Fatalf("completed status = %d, want %d", code, http.StatusOK)
+	}
+
+	if status := wt.order().PaymentStatus; status != db.PaymentPaid {
+		t.Errorf("payment status = %s, want %s", status, db.PaymentPaid)
+	}
+
+	if n := wt.count("SELECT available FROM product_variants WHERE id = 1"); n != 4 {
+		t.Errorf("available = %d, want 4", n)
+	}
+}
+
+func TestPaypalWebhookPaidAfterReleaseSoldOut(t *testing.T) {
+	wt := newWebhookTest(t)
+
+	if code := wt.send("PAYMENT.CAPTURE.DENIED", "good", captureDenied); code != http.StatusOK {
+		t.Fatalf("denied status = %d, want %d", code, http.StatusOK)
+	}
+
+	// the released unit is sold to someone else
+	if _, err := wt.raw.Exec("UPDATE product_variants SET available = 0 WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := wt.send("PAYMENT.CAPTURE.COMPLETED", "good", captureCompleted); code != http.StatusOK {
+		t.Fatalf("completed status = %d, want %d", code, http.StatusOK)
+	}
+
+	order := wt.order()
+	if order.PaymentStatus != db.PaymentPaid {
+		t.Errorf("payment status = %s, want %s", order.PaymentStatus, db.PaymentPaid)
+	}
+
+	if order.Status != db.OrderOutOfStock {
+		t.Errorf("status = %s, want %s", order.Status, db.OrderOutOfStock)
+	}
+
+	if n := wt.count("SELECT available FROM product_variants WHERE id = 1"); n != 0 {
+		t.Errorf("available = %d, want 0", n)
+	}
+
+	if n := wt.count("SELECT COUNT(*) FROM payment_events WHERE result = 'out_of_stock'"); n != 1 {
+		t.Errorf("out of stock events = %d, want 1", n)
+	}
+}
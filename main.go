@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"flag"
 	"github.com/caarlos0/env/v11"
 	"github.com/go-playground/validator/v10"
 	"github.com/labstack/echo/v4"
@@ -16,6 +19,7 @@ import (
 	"rednit/db"
 	"rednit/handler/admin"
 	"rednit/handler/store"
+	"rednit/notification"
 	"rednit/payment"
 	"rednit/terrors"
 	"strings"
@@ -82,6 +86,9 @@ func getServerErrorHandler(e *echo.Echo) func(err error, context2 echo.Context)
 		case errors.As(err, &he):
 			code = he.Code
 			msg = he.Message
+		case errors.As(err, &terror) && terror.Reason != "":
+			code = terror.Code
+			msg = map[string]interface{}{"error": terror.Message, "reason": terror.Reason}
 		case errors.As(err, &terror):
 			code = terror.Code
 			msg = terror.Message
@@ -119,7 +126,14 @@ func (cv *customValidator) Validate(i interface{}) error {
 }
 
 func main() {
+	pendingMigrations := flag.Bool("pending-migrations", false, "list pending database migrations and exit")
+	inviteOwner := flag.String("invite-owner", "", "send an invitation to become the owner to the email and exit")
+	flag.Parse()
+
 	e := echo.New()
+	// The ingress appends the client address to X-Forwarded-For, take the
+	// last untrusted one so clients can't pick their IP for sign-in throttling.
+	e.IPExtractor = echo.ExtractIPFromXFFHeader()
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 
@@ -128,28 +142,96 @@ func main() {
 		log.Fatalf("Failed to parse config: %v\n", err)
 	}
 
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid config: %v\n", err)
+	}
+
+	if cfg.Auth.JWTSecret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("Failed to generate JWT secret: %v\n", err)
+		}
+
+		cfg.Auth.JWTSecret = hex.EncodeToString(secret)
+		log.Printf("JWT_SECRET is not set, admins will be signed out when the server restarts")
+	}
+
 	sql, err := db.ConnectDB(cfg.DBPath)
 
 	if err != nil {
 		e.Logger.Fatalf("failed to connect to db: %v", err)
 	}
 
-	if err := sql.Migrate(); err != nil {
+	if *pendingMigrations {
+		pending, err := sql.PendingMigrations()
+		if err != nil {
+			log.Fatalf("failed to list pending migrations: %v", err)
+		}
+
+		for _, m := range pending {
+			log.Printf("pending migration %d: %s", m.Version, m.Name)
+		}
+
+		log.Printf("%d pending migration(s)", len(pending))
+		return
+	}
+
+	applied, err := sql.Migrate()
+	for _, m := range applied {
+		log.Printf("applied migration %d: %s", m.Version, m.Name)
+	}
+
+	if err != nil {
 		e.Logger.Fatalf("failed to migrate db: %v", err)
 	}
 
-	paypal, err := payment.NewPaypalClient(cfg.PayPal.ClientID, cfg.PayPal.ClientSecret, cfg.PayPal.LiveMode)
+	if len(applied) == 0 {
+		log.Printf("database schema is up to date")
+	}
+
+	paypal, err := payment.NewPaypalClient(cfg.PayPal.ClientID, cfg.PayPal.ClientSecret, cfg.PayPal.ApiURL, cfg.PayPal.LiveMode)
 	if err != nil {
 		e.Logger.Fatalf("failed to create paypal client: %v", err)
 	}
 
-	h := store.New(sql, cfg, paypal)
-	a := admin.New(sql, cfg)
+	payments := payment.NewRegistry(
+		payment.NewBepaid(cfg.Bepaid.ShopID, cfg.Bepaid.SecretKey, cfg.Bepaid.ApiURL, cfg.Bepaid.GatewayURL, cfg.Bepaid.TestMode, cfg.Bepaid.Currencies),
+		payment.NewPaypal(paypal, cfg.PayPal.WebhookID, cfg.PayPal.Currencies),
+	)
+
+	var notifier notification.Notifier = notification.LogNotifier{}
+	if email := cfg.Notifications.Email; email.Host != "" {
+		notifier = notification.SMTPNotifier{
+			Host:     email.Host,
+			Port:     email.Port,
+			Username: email.Username,
+			Password: email.Password,
+			From:     email.From,
+		}
+	}
+
+	team := notification.TelegramNotifier{
+		BotToken: cfg.Notifications.Telegram.BotToken,
+		ChatID:   cfg.Notifications.Telegram.ChatID,
+	}
+
+	h := store.New(sql, cfg, payments, team)
+	a := admin.New(sql, cfg, payments, notifier)
+
+	if *inviteOwner != "" {
+		if err := a.InviteOwner(*inviteOwner); err != nil {
+			log.Fatalf("failed to invite owner: %v", err)
+		}
+
+		log.Printf("invitation sent to %s", *inviteOwner)
+		return
+	}
 
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowOrigins:     []string{"http://localhost:3000", "https://clan-api.pages.dev", "https://plumplum.co"},
 		AllowMethods:     []string{http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete},
 		AllowHeaders:     []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization},
+		ExposeHeaders:    []string{"X-Next-Cursor", "Retry-After"},
 		AllowCredentials: true,
 	}))
 
@@ -167,21 +249,85 @@ func main() {
 
 	adm := api.Group("/admin")
 
-	adm.Use(admin.AuthMiddleware)
+	adm.Use(a.AuthMiddleware)
+
+	view := admin.Require(admin.PermissionView)
+	fulfill := admin.Require(admin.PermissionFulfill)
+	refund := admin.Require(admin.PermissionRefund)
+	catalog := admin.Require(admin.PermissionManageCatalog)
+	users := admin.Require(admin.PermissionManageUsers)
 
 	adm.POST("/sign-in", a.LoginUser)
-	adm.POST("/users", a.CreateUser)
+	adm.POST("/sign-in/2fa", a.VerifySignIn)
+	adm.POST("/sign-in/2fa/setup", a.SetupSignInTOTP)
+	adm.POST("/refresh", a.RefreshSession)
+	adm.POST("/sign-out", a.SignOut)
+	adm.POST("/sign-out-everywhere", a.SignOutEverywhere)
+	adm.GET("/sessions", a.ListSessions)
+	adm.DELETE("/sessions/:id", a.RevokeSession)
+	adm.POST("/invitations/accept", a.AcceptInvitation)
+	adm.POST("/password-reset", a.RequestPasswordReset)
+	adm.POST("/password-reset/confirm", a.ResetPassword)
+	adm.GET("/invitations", a.ListInvitations, users)
+	adm.POST("/invitations", a.InviteUser, users)
+	adm.DELETE("/invitations/:id", a.DeleteInvitation, users)
+	adm.PUT("/users/:id/role", a.UpdateUserRole, users)
+	adm.GET("/auth-events", a.ListAuthEvents, users)
+	adm.POST("/users/:id/deactivate", a.DeactivateUser, users)
+	adm.POST("/users/:id/activate", a.ActivateUser, users)
+	adm.DELETE("/users/:id/2fa", a.ResetUserTOTP, users)
+	adm.PUT("/settings/2fa", a.SetTwoFactorRequired, users)
 	adm.GET("/me", a.GetUserMe)
-	adm.GET("/customers", a.ListCustomers)
-	adm.GET("/orders", a.ListOrders)
-	adm.GET("/discounts", a.ListDiscounts)
-	adm.GET("/users", a.ListUsers)
-
-	adm.GET("/products", a.ListProducts)
+	adm.POST("/me/password", a.ChangePassword)
+	adm.GET("/me/2fa", a.GetTwoFactorStatus)
+	adm.POST("/me/2fa/setup", a.SetupTOTP)
+	adm.POST("/me/2fa/enable", a.EnableTOTP)
+	adm.POST("/me/2fa/disable", a.DisableTOTP)
+	adm.POST("/me/2fa/recovery-codes", a.RegenerateRecoveryCodes)
+	adm.GET("/customers", a.ListCustomers, view)
+	adm.GET("/orders", a.ListOrders, view)
+	adm.POST("/orders/:id/status", a.UpdateOrderStatus, fulfill)
+	adm.GET("/orders/:id/status-history", a.ListOrderStatusHistory, view)
+	adm.POST("/orders/:id/refunds", a.RefundOrder, refund)
+	adm.GET("/orders/:id/refunds", a.ListOrderRefunds, view)
+	adm.GET("/discounts", a.ListDiscounts, view)
+	adm.POST("/discounts", a.CreateDiscount, catalog)
+	adm.POST("/discounts/generate", a.GenerateDiscounts, catalog)
+	adm.GET("/discounts/:id", a.GetDiscount, view)
+	adm.PUT("/discounts/:id", a.UpdateDiscount, catalog)
+	adm.POST("/discounts/:id/activate", a.ActivateDiscount, catalog)
+	adm.POST("/discounts/:id/deactivate", a.DeactivateDiscount, catalog)
+	adm.DELETE("/discounts/:id", a.DeleteDiscount, catalog)
+	adm.GET("/users", a.ListUsers, users)
+
+	adm.GET("/products", a.ListProducts, view)
+	adm.POST("/products", a.CreateProduct, catalog)
+	adm.GET("/products/:id", a.GetProduct, view)
+	adm.PUT("/products/:id", a.UpdateProduct, catalog)
+	adm.DELETE("/products/:id", a.DeleteProduct, catalog)
+	adm.POST("/products/:id/publish", a.PublishProduct, catalog)
+	adm.POST("/products/:id/unpublish", a.UnpublishProduct, catalog)
+	adm.POST("/products/:id/variants", a.CreateProductVariant, catalog)
+	adm.PUT("/products/:id/variants/:variant_id", a.UpdateProductVariant, catalog)
+	adm.DELETE("/products/:id/variants/:variant_id", a.DeleteProductVariant, catalog)
+	adm.PUT("/products/:id/variants/:variant_id/prices", a.SaveVariantPrice, catalog)
+	adm.DELETE("/products/:id/variants/:variant_id/prices/:currency", a.DeleteVariantPrice, catalog)
+	adm.PUT("/products/:id/translations/:language", a.SaveProductTranslation, catalog)
+	adm.DELETE("/products/:id/translations/:language", a.DeleteProductTranslation, catalog)
+	adm.PUT("/products/:id/categories", a.SetProductCategories, catalog)
+
+	adm.GET("/categories", a.ListCategories, view)
+	adm.POST("/categories", a.CreateCategory, catalog)
+	adm.GET("/categories/:id", a.GetCategory, view)
+	adm.PUT("/categories/:id", a.UpdateCategory, catalog)
+	adm.DELETE("/categories/:id", a.DeleteCategory, catalog)
+	adm.PUT("/categories/:id/translations/:language", a.SaveCategoryTranslation, catalog)
+	adm.DELETE("/categories/:id/translations/:language", a.DeleteCategoryTranslation, catalog)
 
 	st := api.Group("/store")
 	st.GET("/products", h.ListProducts)
 	st.GET("/products/:handle", h.GetProduct)
+	st.GET("/categories", h.ListCategories)
 	st.POST("/cart", h.CreateCart)
 	st.GET("/cart/:id", h.GetCart)
 	st.GET("/orders/:id", h.GetOrder)
@@ -193,14 +339,16 @@ func main() {
 	st.DELETE("/cart/:id/discounts", h.DropDiscount)
 	st.POST("/cart/:id/customer", h.SaveCartCustomer)
 	st.POST("/cart/:id/currency", h.UpdateCartCurrency)
-	st.POST("/paypal/capture", h.CapturePaypalPayment)
+	st.GET("/cart/:id/shipping-methods", h.ListCartShippingMethods)
+	st.POST("/cart/:id/shipping-method", h.UpdateCartShippingMethod)
+	st.POST("/:provider/capture", h.CapturePayment)
 	st.GET("/debug", h.Debug)
 
 	//g.PUT("/cart/:id/products", h.AddProductToCart)
 	//g.DELETE("/cart/:id/products/:product_id", h.RemoveProductFromCart)
 
 	wh := e.Group("/webhook")
-	wh.POST("/bepaid", h.BepaidNotification)
+	wh.POST("/:provider", h.PaymentNotification)
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
@@ -0,0 +1,55 @@
+package notification
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+)
+
+// Notifier delivers account messages, like invitations and password reset
+// links, to the person with the email address.
+type Notifier interface {
+	Notify(to, subject, message string) error
+}
+
+// LogNotifier writes the messages to the log instead of sending them, for
+// development.
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(to, subject, message string) error {
+	log.Printf("notification to %s: %s\n%s", to, subject, message)
+	return nil
+}
+
+// SMTPNotifier emails the messages.
+type SMTPNotifier struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (n SMTPNotifier) Notify(to, subject, message string) error {
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("invalid email header")
+	}
+
+	var auth smtp.Auth
+	if n.Username != "" {
+		auth = smtp.PlainAuth("", n.Username, n.Password, n.Host)
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		n.From, to, subject, message)
+
+	addr := net.JoinHostPort(n.Host, strconv.Itoa(n.Port))
+	if err := smtp.SendMail(addr, auth, n.From, []string{to}, []byte(msg)); err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+
+	return nil
+}
@@ -23,6 +23,22 @@ func EscapeMarkdown(s string) string {
 	return string(result)
 }
 
+// TeamNotifier delivers messages to the shop team, like paid orders.
+type TeamNotifier interface {
+	NotifyTeam(message string) error
+}
+
+// TelegramNotifier posts the team messages to a Telegram chat, formatted
+// with MarkdownV2.
+type TelegramNotifier struct {
+	BotToken string
+	ChatID   int64
+}
+
+func (n TelegramNotifier) NotifyTeam(message string) error {
+	return NotifyTelegram(n.BotToken, n.ChatID, message)
+}
+
 func NotifyTelegram(botToken string, chatID int64, message string) error {
 	url := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", botToken)
 
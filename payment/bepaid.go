@@ -5,7 +5,10 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -126,6 +129,22 @@ type BepaidTransaction struct {
 	ManuallyCorrectedAt *time.Time `json:"manually_corrected_at"`
 	Language            string     `json:"language"`
 	ID                  string     `json:"id"`
+	ParentUid           string     `json:"parent_uid"`
+}
+
+type BepaidRefundRequest struct {
+	Request BepaidRefund `json:"request"`
+}
+
+type BepaidRefund struct {
+	ParentUid string `json:"parent_uid"`
+	Amount    int    `json:"amount"`
+	Reason    string `json:"reason"`
+}
+
+type BepaidTransactionResponse struct {
+	Transaction BepaidTransaction `json:"transaction"`
+	Message     string            `json:"message"`
 }
 
 func CreatePaymentToken(request BepaidTokenRequest, apiURL, shopID, shopSecret string) (*BepaidTokenResponse, error) {
@@ -164,3 +183,278 @@ func CreatePaymentToken(request BepaidTokenRequest, apiURL, shopID, shopSecret s
 
 	return &tokenResp, nil
 }
+
+// CreateRefund refunds a successful payment transaction through the bePaid
+// gateway API.
+func CreateRefund(request BepaidRefundRequest, apiURL, shopID, shopSecret string) (*BepaidTransaction, error) {
+	auth := base64.StdEncoding.EncodeToString([]byte(shopID + ":" + shopSecret))
+
+	client := &http.Client{}
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-API-Version", "2")
+	req.Header.Set("Authorization", "Basic "+auth)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var refundResp BepaidTransactionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&refundResp); err != nil && isDeclined(resp.StatusCode) {
+		return nil, fmt.Errorf("%w: bepaid: refund status %d", ErrDeclined, resp.StatusCode)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if isDeclined(resp.StatusCode) {
+		return nil, fmt.Errorf("%w: bepaid: failed to create refund: %s", ErrDeclined, refundResp.Message)
+	} else if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("bepaid: failed to create refund: %s", refundResp.Message)
+	}
+
+	return &refundResp.Transaction, nil
+}
+
+// bepaidWidgetStyle matches the payment widget to the storefront design.
+var bepaidWidgetStyle = map[string]interface{}{
+	"widget": map[string]interface{}{
+		"backgroundColor": "#ffffff",
+		"buttonsColor":    "#262626",
+		"backgroundType":  "2",
+		"color":           "#262626",
+		"fontSize":        "15px",
+		"fontWeight":      "400",
+		"lineHeight":      "21px",
+	},
+	"inputs": map[string]interface{}{
+		"backgroundColor": "#f8f8f8",
+		"holder": map[string]interface{}{
+			"backgroundColor": "#f8f8f8",
+		},
+	},
+	"button": map[string]interface{}{
+		"backgroundColor": "#262626",
+		"pay": map[string]interface{}{
+			"color": "#ffffff",
+		},
+		"card": map[string]interface{}{
+			"color": "#ffffff",
+		},
+		"brands": map[string]interface{}{
+			"color": "#ffffff",
+		},
+	},
+}
+
+// Bepaid is the bePaid hosted checkout Provider. Payments are captured by
+// bePaid itself and reported through the notification webhook.
+type Bepaid struct {
+	shopID     string
+	secretKey  string
+	apiURL     string
+	gatewayURL string
+	test       bool
+	currencies []string
+}
+
+// NewBepaid creates the provider, apiURL is the hosted checkout API and
+// gatewayURL the API for operations on existing transactions.
+func NewBepaid(shopID, secretKey, apiURL, gatewayURL string, test bool, currencies []string) *Bepaid {
+	return &Bepaid{
+		shopID:     shopID,
+		secretKey:  secretKey,
+		apiURL:     apiURL,
+		gatewayURL: gatewayURL,
+		test:       test,
+		currencies: currencies,
+	}
+}
+
+func (b *Bepaid) Name() string {
+	return "bepaid"
+}
+
+func (b *Bepaid) Currencies() []string {
+	return b.currencies
+}
+
+func (b *Bepaid) CreatePayment(req PaymentRequest) (*Payment, error) {
+	tokenResp, err := CreatePaymentToken(BepaidTokenRequest{
+		Checkout: BepaidCheckout{
+			Attempts:        1,
+			Test:            b.test,
+			TransactionType: "payment",
+			Settings: BepaidSettings{
+				NotificationUrl: req.NotificationURL,
+				SuccessUrl:      req.ReturnURL,
+				Language:        req.Language,
+				AutoReturn:      "0",
+				WidgetStyle:     bepaidWidgetStyle,
+			},
+			Order: BepaidOrder{
+				Amount:      req.Amount,
+				Currency:    req.Currency,
+				Description: req.Description,
+				TrackingID:  strconv.FormatInt(req.OrderID, 10),
+			},
+			Customer: BepaidCustomer{
+				Email:     req.Customer.Email,
+				FirstName: req.Customer.Name,
+				LastName:  req.Customer.Name,
+				Address:   req.Customer.Address,
+				ZIP:       req.Customer.ZIP,
+				Country:   req.Customer.Country,
+				Phone:     req.Customer.Phone,
+			},
+		},
+	}, fmt.Sprintf("%s/ctp/api/checkouts", b.apiURL), b.shopID, b.secretKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Payment{RedirectURL: tokenResp.Checkout.RedirectUrl}, nil
+}
+
+func (b *Bepaid) Capture(paymentID string) (*Transaction, error) {
+	return nil, ErrNotSupported
+}
+
+func (b *Bepaid) Refund(req RefundRequest) (*Transaction, error) {
+	reason := req.Reason
+	if reason == "" {
+		// required by bePaid
+		reason = "Refund"
+	}
+
+	t, err := CreateRefund(BepaidRefundRequest{
+		Request: BepaidRefund{
+			ParentUid: req.TransactionID,
+			Amount:    req.Amount,
+			Reason:    reason,
+		},
+	}, fmt.Sprintf("%s/transactions/refunds", b.gatewayURL), b.shopID, b.secretKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tx := Transaction{
+		ID:            t.Uid,
+		ParentID:      req.TransactionID,
+		Status:        t.Status,
+		PaymentStatus: bepaidRefundStatus(t.Status),
+		Amount:        t.Amount,
+		Currency:      t.Currency,
+	}
+
+	if raw, err := json.Marshal(t); err == nil {
+		tx.Raw = string(raw)
+	}
+
+	return &tx, nil
+}
+
+func bepaidRefundStatus(status string) Status {
+	switch status {
+	case "successful":
+		return StatusRefunded
+	case "failed", "expired":
+		return StatusFailed
+	default:
+		return StatusPending
+	}
+}
+
+func bepaidPaymentStatus(status string) (Status, error) {
+	switch status {
+	case "successful":
+		return StatusPaid, nil
+	case "failed", "expired":
+		return StatusFailed, nil
+	case "incomplete":
+		return StatusPending, nil
+	default:
+		return "", fmt.Errorf("bepaid: invalid status %s", status)
+	}
+}
+
+func (b *Bepaid) ParseWebhook(r *http.Request) (*WebhookEvent, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, fmt.Errorf("%w: bepaid: missing credentials", ErrInvalidSignature)
+	}
+
+	if username != b.shopID || password != b.secretKey {
+		return nil, fmt.Errorf("%w: bepaid: invalid credentials", ErrInvalidSignature)
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var notification BepaidNotification
+	if err := json.Unmarshal(body, &notification); err != nil {
+		return nil, err
+	}
+
+	t := notification.Transaction
+
+	if t.Uid == "" {
+		return nil, errors.New("bepaid: missing transaction uid")
+	}
+
+	if t.Type == "refund" {
+		if bepaidRefundStatus(t.Status) != StatusRefunded {
+			// the refund request already reported the failure
+			return &WebhookEvent{}, nil
+		}
+
+		tx := Transaction{
+			ID:            t.Uid,
+			ParentID:      t.ParentUid,
+			Status:        t.Status,
+			PaymentStatus: StatusRefunded,
+			Amount:        t.Amount,
+			Currency:      t.Currency,
+			Raw:           string(body),
+		}
+
+		return &WebhookEvent{Transaction: &tx}, nil
+	}
+
+	status, err := bepaidPaymentStatus(t.Status)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := Transaction{
+		ID:            t.Uid,
+		PaymentID:     t.ID,
+		Status:        t.Status,
+		PaymentStatus: status,
+		Amount:        t.Amount,
+		Currency:      t.Currency,
+		Raw:           string(body),
+	}
+
+	// the order ID is sent as tracking_id at checkout
+	if id, err := strconv.ParseInt(t.TrackingId, 10, 64); err == nil {
+		tx.OrderID = &id
+	}
+
+	return &WebhookEvent{Transaction: &tx}, nil
+}
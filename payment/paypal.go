@@ -2,8 +2,15 @@ package payment
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/plutov/paypal/v4"
+	"io"
 	"log"
+	"net/http"
+	"strconv"
+	"strings"
 )
 
 type PaypalClient struct {
@@ -17,11 +24,18 @@ type PayPalRequest struct {
 	Payer              *paypal.Payer
 }
 
-func NewPaypalClient(clientID, secret string, live bool) (*PaypalClient, error) {
+// NewPaypalClient creates a client for the live or sandbox PayPal API.
+// A non-empty apiURL overrides both, e.g. to point at a local stub.
+func NewPaypalClient(clientID, secret, apiURL string, live bool) (*PaypalClient, error) {
 	url := paypal.APIBaseLive
 	if !live {
 		url = paypal.APIBaseSandBox
 	}
+
+	if apiURL != "" {
+		url = apiURL
+	}
+
 	c, err := paypal.NewClient(clientID, secret, url)
 
 	if err != nil {
@@ -53,3 +67,303 @@ func (pc PaypalClient) CapturePaypalOrder(orderID string) (*paypal.CaptureOrderR
 
 	return capture, nil
 }
+
+func (pc PaypalClient) RefundPaypalCapture(captureID string, req paypal.RefundCaptureRequest) (*paypal.RefundResponse, error) {
+	refund, err := pc.client.RefundCapture(context.Background(), captureID, req)
+	if err != nil {
+		log.Printf("failed to refund paypal capture: %v", err)
+		return nil, err
+	}
+
+	log.Printf("paypal capture refunded: %v", refund)
+
+	return refund, nil
+}
+
+// VerifyWebhookSignature asks PayPal to verify the transmission signature
+// headers of a webhook request against the configured webhook ID.
+func (pc PaypalClient) VerifyWebhookSignature(r *http.Request, webhookID string) error {
+	if webhookID == "" {
+		return errors.New("paypal: webhook id is not configured")
+	}
+
+	resp, err := pc.client.VerifyWebhookSignature(r.Context(), r, webhookID)
+	if err != nil {
+		return err
+	}
+
+	if resp.VerificationStatus != "SUCCESS" {
+		return fmt.Errorf("paypal: webhook verification status %s", resp.VerificationStatus)
+	}
+
+	return nil
+}
+
+type PaypalMoney struct {
+	CurrencyCode string `json:"currency_code"`
+	Value        string `json:"value"`
+}
+
+type PaypalLink struct {
+	Href string `json:"href"`
+	Rel  string `json:"rel"`
+}
+
+// PaypalWebhookResource is the capture or refund a PAYMENT.CAPTURE.* event
+// refers to.
+type PaypalWebhookResource struct {
+	ID                string       `json:"id"`
+	Status            string       `json:"status"`
+	CustomID          string       `json:"custom_id"`
+	Amount            PaypalMoney  `json:"amount"`
+	Links             []PaypalLink `json:"links"`
+	SupplementaryData struct {
+		RelatedIDs struct {
+			OrderID string `json:"order_id"`
+		} `json:"related_ids"`
+	} `json:"supplementary_data"`
+}
+
+type PaypalWebhookEvent struct {
+	ID        string                `json:"id"`
+	EventType string                `json:"event_type"`
+	Resource  PaypalWebhookResource `json:"resource"`
+}
+
+// CaptureID returns the ID of the capture a refund resource belongs to.
+func (r PaypalWebhookResource) CaptureID() string {
+	for _, l := range r.Links {
+		if l.Rel == "up" && strings.Contains(l.Href, "/captures/") {
+			return l.Href[strings.LastIndex(l.Href, "/")+1:]
+		}
+	}
+
+	return ""
+}
+
+// Paypal is the PayPal Provider. Orders are approved on the storefront with
+// the PayPal JS SDK and captured either from the browser or, if the customer
+// closes the tab, when the approval webhook arrives.
+type Paypal struct {
+	client     *PaypalClient
+	webhookID  string
+	currencies []string
+}
+
+func NewPaypal(client *PaypalClient, webhookID string, currencies []string) *Paypal {
+	return &Paypal{client: client, webhookID: webhookID, currencies: currencies}
+}
+
+func (p *Paypal) Name() string {
+	return "paypal"
+}
+
+func (p *Paypal) Currencies() []string {
+	return p.currencies
+}
+
+func (p *Paypal) CreatePayment(req PaymentRequest) (*Payment, error) {
+	order, err := p.client.CreatePaypalOrder(PayPalRequest{
+		PurchaseUnits: []paypal.PurchaseUnitRequest{
+			{
+				Amount: &paypal.PurchaseUnitAmount{
+					Currency: req.Currency,
+					Value:    FormatAmount(req.Amount),
+				},
+				Description: req.Description,
+				CustomID:    strconv.FormatInt(req.OrderID, 10), // Order ID as tracking ID
+			},
+		},
+		ApplicationContext: &paypal.ApplicationContext{
+			BrandName:   "PLUM<3",
+			LandingPage: "BILLING",
+			UserAction:  "PAY_NOW",
+			ReturnURL:   req.ReturnURL,
+			CancelURL:   req.CancelURL,
+		},
+		Payer: &paypal.Payer{
+			PayerInfo: &paypal.PayerInfo{
+				Email:       req.Customer.Email,
+				FirstName:   req.Customer.Name,
+				Phone:       req.Customer.Phone,
+				CountryCode: req.Customer.Country,
+				PayerID:     strconv.FormatInt(req.Customer.ID, 10),
+				ShippingAddress: &paypal.ShippingAddress{
+					RecipientName: req.Customer.Name,
+					Line1:         req.Customer.Address,
+					PostalCode:    req.Customer.ZIP,
+					CountryCode:   req.Customer.Country,
+				},
+			},
+		},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Payment{ID: order.ID}, nil
+}
+
+func paypalCaptureStatus(status string) Status {
+	switch status {
+	case "COMPLETED":
+		return StatusPaid
+	case "DECLINED", "FAILED":
+		return StatusFailed
+	case "REFUNDED":
+		return StatusRefunded
+	default:
+		return StatusPending
+	}
+}
+
+func (p *Paypal) Capture(paymentID string) (*Transaction, error) {
+	resp, err := p.client.CapturePaypalOrder(paymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.PurchaseUnits) == 0 || resp.PurchaseUnits[0].Payments == nil || len(resp.PurchaseUnits[0].Payments.Captures) == 0 {
+		return nil, errors.New("paypal: capture response without captures")
+	}
+
+	capture := resp.PurchaseUnits[0].Payments.Captures[0]
+
+	tx := Transaction{
+		ID:            capture.ID,
+		PaymentID:     paymentID,
+		Status:        capture.Status,
+		PaymentStatus: paypalCaptureStatus(capture.Status),
+	}
+
+	if id, err := strconv.ParseInt(capture.CustomID, 10, 64); err == nil {
+		tx.OrderID = &id
+	}
+
+	if capture.Amount != nil {
+		amount, err := ParseAmount(capture.Amount.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		tx.Amount = amount
+		tx.Currency = capture.Amount.Currency
+	}
+
+	if raw, err := json.Marshal(resp); err == nil {
+		tx.Raw = string(raw)
+	}
+
+	return &tx, nil
+}
+
+func paypalRefundStatus(status string) Status {
+	switch status {
+	case "COMPLETED":
+		return StatusRefunded
+	case "CANCELLED", "FAILED":
+		return StatusFailed
+	default:
+		return StatusPending
+	}
+}
+
+func (p *Paypal) Refund(req RefundRequest) (*Transaction, error) {
+	resp, err := p.client.RefundPaypalCapture(req.TransactionID, paypal.RefundCaptureRequest{
+		Amount: &paypal.Money{
+			Currency: req.Currency,
+			Value:    FormatAmount(req.Amount),
+		},
+		NoteToPayer: req.Reason,
+	})
+
+	var errResp *paypal.ErrorResponse
+	if errors.As(err, &errResp) && errResp.Response != nil && isDeclined(errResp.Response.StatusCode) {
+		return nil, fmt.Errorf("%w: %v", ErrDeclined, err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	tx := Transaction{
+		ID:            resp.ID,
+		ParentID:      req.TransactionID,
+		Status:        resp.Status,
+		PaymentStatus: paypalRefundStatus(resp.Status),
+		Amount:        req.Amount,
+		Currency:      req.Currency,
+	}
+
+	if raw, err := json.Marshal(resp); err == nil {
+		tx.Raw = string(raw)
+	}
+
+	return &tx, nil
+}
+
+func paypalPaymentStatus(eventType string) (Status, bool) {
+	switch eventType {
+	case paypal.EventPaymentCaptureCompleted:
+		return StatusPaid, true
+	case paypal.EventPaymentCaptureDenied:
+		return StatusFailed, true
+	case paypal.EventPaymentCaptureRefunded:
+		return StatusRefunded, true
+	default:
+		return "", false
+	}
+}
+
+func (p *Paypal) ParseWebhook(r *http.Request) (*WebhookEvent, error) {
+	if err := p.client.VerifyWebhookSignature(r, p.webhookID); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var event PaypalWebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+
+	if event.EventType == paypal.EventCheckoutOrderApproved {
+		return &WebhookEvent{Approved: event.Resource.ID}, nil
+	}
+
+	status, ok := paypalPaymentStatus(event.EventType)
+	if !ok {
+		// subscribed to more events than we handle, nothing to do
+		return &WebhookEvent{}, nil
+	}
+
+	if event.Resource.ID == "" {
+		return nil, errors.New("paypal: missing resource id")
+	}
+
+	amount, err := ParseAmount(event.Resource.Amount.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	// the order ID is sent as custom_id at checkout, captures also carry the
+	// PayPal order ID and refunds link to the refunded capture
+	tx := Transaction{
+		ID:            event.Resource.ID,
+		PaymentID:     event.Resource.SupplementaryData.RelatedIDs.OrderID,
+		ParentID:      event.Resource.CaptureID(),
+		Status:        event.EventType,
+		PaymentStatus: status,
+		Amount:        amount,
+		Currency:      event.Resource.Amount.CurrencyCode,
+		Raw:           string(body),
+	}
+
+	if id, err := strconv.ParseInt(event.Resource.CustomID, 10, 64); err == nil {
+		tx.OrderID = &id
+	}
+
+	return &WebhookEvent{Transaction: &tx}, nil
+}
@@ -0,0 +1,167 @@
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUnknownProvider  = errors.New("payment: unknown provider")
+	ErrNotSupported     = errors.New("payment: operation is not supported by the provider")
+	ErrInvalidSignature = errors.New("payment: invalid webhook signature")
+	// ErrDeclined is wrapped by operations the provider rejected, as opposed
+	// to ones that may or may not have gone through, e.g. on a timeout.
+	ErrDeclined = errors.New("payment: declined by the provider")
+)
+
+// isDeclined tells if the HTTP status of a provider response rejects the
+// request. Timeouts and rate limits are not declines, the request may be
+// retried.
+func isDeclined(statusCode int) bool {
+	return statusCode >= 400 && statusCode < 500 &&
+		statusCode != http.StatusRequestTimeout && statusCode != http.StatusTooManyRequests
+}
+
+// Status is the payment state a provider reports, it mirrors db.PaymentStatus.
+type Status string
+
+const (
+	StatusPending  Status = "pending"
+	StatusPaid     Status = "paid"
+	StatusFailed   Status = "failed"
+	StatusRefunded Status = "refunded"
+)
+
+// Provider is a payment method the store can check out with. Operations a
+// provider can't perform, e.g. capture for auto-captured payments, return
+// ErrNotSupported.
+type Provider interface {
+	// Name is the key the provider is registered under and stored in
+	// orders.payment_provider.
+	Name() string
+	// Currencies lists the currencies the provider accepts, the first one is
+	// used when the cart currency is not supported.
+	Currencies() []string
+	CreatePayment(req PaymentRequest) (*Payment, error)
+	Capture(paymentID string) (*Transaction, error)
+	Refund(req RefundRequest) (*Transaction, error)
+	// ParseWebhook authenticates a webhook request and extracts the event.
+	// Authentication failures wrap ErrInvalidSignature.
+	ParseWebhook(r *http.Request) (*WebhookEvent, error)
+}
+
+type Customer struct {
+	ID      int64
+	Email   string
+	Name    string
+	Phone   string
+	Country string
+	Address string
+	ZIP     string
+}
+
+type PaymentRequest struct {
+	OrderID int64
+	// Amount is in minor units.
+	Amount          int
+	Currency        string
+	Description     string
+	Language        string
+	Customer        Customer
+	ReturnURL       string
+	CancelURL       string
+	NotificationURL string
+}
+
+type Payment struct {
+	// ID is the provider's reference for the payment, empty if the provider
+	// only assigns one once the customer pays.
+	ID string
+	// RedirectURL is the hosted payment page, empty if the payment is approved
+	// on the storefront.
+	RedirectURL string
+}
+
+type RefundRequest struct {
+	// TransactionID is the paid transaction (or capture) to refund.
+	TransactionID string
+	// Amount is in minor units.
+	Amount   int
+	Currency string
+	Reason   string
+}
+
+// Transaction is a state change of a payment reported by a provider.
+type Transaction struct {
+	// ID identifies the transaction at the provider, it is the idempotency key
+	// of the payment event.
+	ID string
+	// OrderID is our order ID if the provider echoes it back.
+	OrderID *int64
+	// PaymentID is the provider's payment reference stored on the order.
+	PaymentID string
+	// ParentID is the transaction this one refers to, e.g. the refunded capture.
+	ParentID      string
+	Status        string
+	PaymentStatus Status
+	// Amount is in minor units.
+	Amount   int
+	Currency string
+	Raw      string
+}
+
+type WebhookEvent struct {
+	// Approved is set to the payment ID when the customer approved a payment
+	// that still has to be captured.
+	Approved string
+	// Transaction is nil for events that need no action.
+	Transaction *Transaction
+}
+
+type Registry struct {
+	providers map[string]Provider
+}
+
+func NewRegistry(providers ...Provider) Registry {
+	r := Registry{providers: make(map[string]Provider, len(providers))}
+
+	for _, p := range providers {
+		r.providers[p.Name()] = p
+	}
+
+	return r
+}
+
+func (r Registry) Get(name string) (Provider, error) {
+	p, ok := r.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProvider, name)
+	}
+
+	return p, nil
+}
+
+// ParseAmount converts a decimal amount such as "125.00" to minor units.
+func ParseAmount(value string) (int, error) {
+	whole, frac, _ := strings.Cut(value, ".")
+	if len(frac) > 2 {
+		return 0, fmt.Errorf("payment: invalid amount %s", value)
+	}
+
+	frac += strings.Repeat("0", 2-len(frac))
+
+	amount, err := strconv.Atoi(whole + frac)
+	if err != nil {
+		return 0, fmt.Errorf("payment: invalid amount %s", value)
+	}
+
+	return amount, nil
+}
+
+// FormatAmount converts minor units to a decimal amount such as "125.00".
+func FormatAmount(amount int) string {
+	return fmt.Sprintf("%d.%02d", amount/100, amount%100)
+}
@@ -8,12 +8,20 @@ type Error struct {
 	Code    int
 	Err     error
 	Message string
+	// Reason is a machine-readable cause clients can act on, e.g. why a
+	// discount code doesn't apply.
+	Reason string
 }
 
 func (e *Error) Error() string {
 	return e.Err.Error()
 }
 
+func (e *Error) WithReason(reason string) *Error {
+	e.Reason = reason
+	return e
+}
+
 func NotFound(err error, message string) *Error {
 	return &Error{
 		Code:    http.StatusNotFound,
@@ -54,3 +62,19 @@ func Unauthorized(err error, message string) *Error {
 		Message: message,
 	}
 }
+
+func Forbidden(err error, message string) *Error {
+	return &Error{
+		Code:    http.StatusForbidden,
+		Err:     err,
+		Message: message,
+	}
+}
+
+func TooManyRequests(err error, message string) *Error {
+	return &Error{
+		Code:    http.StatusTooManyRequests,
+		Err:     err,
+		Message: message,
+	}
+}
@@ -47,6 +47,28 @@ export async function signInWithPassword({
   })
 }
 
+export async function setupSignInTOTP({ challenge }: { challenge: string }) {
+  return await apiRequest('/admin/sign-in/2fa/setup', {
+    method: 'POST',
+    body: JSON.stringify({ challenge }),
+  })
+}
+
+export async function verifySignIn({
+  challenge,
+  code,
+  recoveryCode,
+}: {
+  challenge: string
+  code?: string
+  recoveryCode?: string
+}) {
+  return await apiRequest('/admin/sign-in/2fa', {
+    method: 'POST',
+    body: JSON.stringify({ challenge, code, recovery_code: recoveryCode }),
+  })
+}
+
 export async function listCustomers() {
   return await apiRequest('/admin/customers', {
     method: 'GET',
@@ -59,18 +81,18 @@ export async function listUsers() {
   })
 }
 
-export async function createUser({
+export async function inviteUser({
   email,
-  password,
   name,
+  role,
 }: {
   email: string
-  password: string
   name: string | null
+  role: string
 }) {
-  return await apiRequest('/admin/users', {
+  return await apiRequest('/admin/invitations', {
     method: 'POST',
-    body: JSON.stringify({ email, password, name }),
+    body: JSON.stringify({ email, name, role }),
   })
 }
 
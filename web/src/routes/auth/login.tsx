@@ -1,10 +1,13 @@
-import { createSignal } from 'solid-js'
+import { createSignal, Show } from 'solid-js'
 import { useNavigate } from '@solidjs/router'
-import { signInWithPassword } from '~/lib/api'
+import { setupSignInTOTP, signInWithPassword, verifySignIn } from '~/lib/api'
 
 export default function Login() {
   const [email, setEmail] = createSignal('')
   const [password, setPassword] = createSignal('')
+  const [challenge, setChallenge] = createSignal('')
+  const [setup, setSetup] = createSignal<{ secret: string; url: string }>()
+  const [code, setCode] = createSignal('')
 
   const navigate = useNavigate()
 
@@ -20,6 +23,50 @@ export default function Login() {
       return
     }
 
+    if (data?.challenge) {
+      setChallenge(data.challenge)
+
+      if (data.setup_required) {
+        const res = await setupSignInTOTP({ challenge: data.challenge })
+        if (res.error) {
+          alert(res.error)
+          return
+        }
+
+        setSetup(res.data)
+      }
+
+      return
+    }
+
+    if (data) {
+      navigate('/')
+    }
+  }
+
+  // Codes from the authenticator app are digits, anything else is taken
+  // as a recovery code.
+  const verifyCode = async (e: Event) => {
+    e.preventDefault()
+    const value = code().trim()
+    const { data, error } = await verifySignIn(
+      /^[0-9 ]+$/.test(value)
+        ? { challenge: challenge(), code: value }
+        : { challenge: challenge(), recoveryCode: value },
+    )
+
+    if (error) {
+      alert(error)
+      return
+    }
+
+    if (data?.recovery_codes) {
+      alert(
+        'Save these recovery codes, each signs you in once if you lose your authenticator app:\n\n' +
+          data.recovery_codes.join('\n'),
+      )
+    }
+
     if (data) {
       navigate('/')
     }
@@ -33,7 +80,37 @@ export default function Login() {
         </div>
         <p class="text-xl">SignIn on Platform</p>
       </div>
+      <Show when={challenge()}>
+        <form
+          class="flex w-full max-w-sm flex-col space-y-4"
+          onSubmit={(e) => verifyCode(e)}>
+          <Show when={setup()}>
+            <p class="text-sm">
+              Two-factor authentication is required. Add this key to your
+              authenticator app, then enter the code it shows.
+            </p>
+            <code class="break-all rounded-lg bg-background p-2 text-sm">
+              {setup()?.secret}
+            </code>
+          </Show>
+          <label for="code">
+            <input
+              type="text"
+              id="code"
+              name="code"
+              autocomplete="one-time-code"
+              placeholder="Authentication or recovery code"
+              onChange={(e) => setCode(e.target.value)}
+              class="h-11 w-full rounded-lg bg-background px-2"
+            />
+          </label>
+          <button class="h-11 w-full rounded-lg bg-primary text-primary-foreground">
+            Verify
+          </button>
+        </form>
+      </Show>
       <form
+        hidden={!!challenge()}
         class="flex w-full max-w-sm flex-col space-y-4"
         onSubmit={(e) => loginUser(e)}>
         <div class="flex w-full flex-col space-y-1">
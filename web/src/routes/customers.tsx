@@ -30,7 +30,7 @@ export default function CustomersPage() {
     queryKey: ['customers'],
     queryFn: async () => {
       const { data } = await listCustomers()
-      return data as Customer[]
+      return (data?.items ?? []) as Customer[]
     },
   }))
 
@@ -47,7 +47,7 @@ export default function DiscountPage() {
     queryKey: ['discounts'],
     queryFn: async () => {
       const { data } = await listDiscounts()
-      return data as Discount[]
+      return (data?.items ?? []) as Discount[]
     },
   }))
 
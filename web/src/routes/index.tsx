@@ -53,7 +53,7 @@ export default function IndexPage() {
     queryKey: ['products'],
     queryFn: async () => {
       const { data } = await fetchProducts()
-      return data as Product[]
+      return (data?.items ?? []) as Product[]
     },
   }))
 
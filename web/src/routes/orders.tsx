@@ -66,7 +66,7 @@ export default function OrdersPage() {
     queryKey: ['orders'],
     queryFn: async () => {
       const { data } = await listOrders()
-      return data as Order[]
+      return (data?.items ?? []) as Order[]
     },
   }))
 
@@ -10,7 +10,7 @@ import {
 } from '~/components/table'
 import { SearchInput } from '~/components/input'
 import { createQuery } from '@tanstack/solid-query'
-import { createUser, listUsers } from '~/lib/api'
+import { inviteUser, listUsers } from '~/lib/api'
 import { IconClose, IconPlus } from '~/components/icons'
 import { Checkbox } from '~/components/checkbox'
 import { useTableSelection } from '~/lib/table'
@@ -32,25 +32,25 @@ export default function UsersPage() {
 
   const [user, setUser] = createSignal<{
     email: string
-    password: string
     name: string | null
+    role: string
   }>({
     email: '',
-    password: '',
     name: null,
+    role: 'viewer',
   })
 
   const query = createQuery(() => ({
     queryKey: ['users'],
     queryFn: async () => {
       const { data } = await listUsers()
-      return data as User[]
+      return (data?.items ?? []) as User[]
     },
   }))
 
   async function onFormSubmit() {
-    const { email, password, name } = user()
-    await createUser({ email, password, name })
+    const { email, name, role } = user()
+    await inviteUser({ email, name, role })
     await query.refetch()
     setSideMenuIsOpen(false)
   }
@@ -100,25 +100,27 @@ export default function UsersPage() {
               placeholder="dummy@example.com"
             />
           </label>
-          <label class="text-sm font-semibold" for="password">
-            <input
+          <label class="text-sm font-semibold" for="role">
+            <select
               class="mt-1 h-11 w-full rounded-lg border border-neutral-200 bg-background p-2"
-              id="password"
-              type="password"
-              value={user().password}
-              onInput={(e) =>
+              id="role"
+              value={user().role}
+              onChange={(e) =>
                 setUser({
                   ...user(),
-                  password: e.currentTarget.value,
+                  role: e.currentTarget.value,
                 })
-              }
-              placeholder="********"
-            />
+              }>
+              <option value="owner">Owner</option>
+              <option value="manager">Manager</option>
+              <option value="fulfillment">Fulfillment</option>
+              <option value="viewer">Viewer</option>
+            </select>
           </label>
           <button
             class="mt-4 w-full rounded bg-primary p-2 text-white"
             type="submit">
-            Add User
+            Send Invite
           </button>
         </form>
       </SideMenu>